@@ -2,8 +2,11 @@ package main
 
 import (
 	"github.com/lab47/chell/pkg/cmd"
+	"github.com/lab47/chell/pkg/evt"
 )
 
 func main() {
+	evt.SandboxInit()
+
 	cmd.Execute()
 }
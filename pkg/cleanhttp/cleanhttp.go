@@ -1,6 +1,7 @@
 package cleanhttp
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"time"
@@ -28,3 +29,12 @@ var DefaultClient = &http.Client{
 func Get(url string) (resp *http.Response, err error) {
 	return DefaultClient.Get(url)
 }
+
+func GetContext(ctx context.Context, url string) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DefaultClient.Do(req)
+}
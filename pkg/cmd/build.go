@@ -6,9 +6,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/lab47/chell/pkg/ops"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -24,10 +27,21 @@ var (
 
 var (
 	buildOutputDir string
+	buildCheck     bool
+	buildFrom      string
+	buildUntil     string
 )
 
 func init() {
 	buildCmd.PersistentFlags().StringVarP(&buildOutputDir, "output-dir", "d", ".", "Directory to write car files when building only")
+	buildCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 1, "number of packages to build at the same time")
+	buildCmd.PersistentFlags().BoolVar(&sandbox, "sandbox", false, "build inside a sandbox that only exposes declared dependencies")
+	buildCmd.PersistentFlags().BoolVar(&keepFailed, "keep-failed", false, "keep the build and output dirs of failed builds")
+	buildCmd.PersistentFlags().BoolVar(&shellOnFailure, "shell-on-failure", false, "start a shell where a build failed")
+	buildCmd.PersistentFlags().BoolVar(&runTests, "test", false, "run the tests of each package built")
+	buildCmd.PersistentFlags().BoolVar(&buildCheck, "check", false, "rebuild an installed package and compare the outputs")
+	buildCmd.PersistentFlags().StringVar(&buildFrom, "from", "", "resume the build from this phase, using the build dir kept by --until")
+	buildCmd.PersistentFlags().StringVar(&buildUntil, "until", "", "stop the build after this phase, keeping the build dir")
 }
 
 func build(c *cobra.Command, args []string) {
@@ -63,7 +77,16 @@ func build(c *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+
+	go func() {
+		<-ch
+		cancel()
+	}()
+
+	signal.Notify(ch, os.Interrupt, os.Kill, syscall.SIGQUIT)
 
 	buildDir, err := ioutil.TempDir("", "chell-build")
 	if err != nil {
@@ -72,9 +95,39 @@ func build(c *cobra.Command, args []string) {
 
 	defer os.RemoveAll(buildDir)
 
+	mirrors, err := o.Mirrors()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ienv := &ops.InstallEnv{
-		BuildDir: buildDir,
-		StoreDir: StoreDir,
+		BuildDir:     buildDir,
+		StoreDir:     StoreDir,
+		Sandbox:      sandbox || cfg.Sandbox,
+		SandboxShell: cfg.SandboxShell,
+		LogDir:       cfg.LogsPath(),
+		SigDir:       cfg.SigsPath(),
+		CacheDir:     cfg.CachePath(),
+		GitCacheDir:  cfg.GitCachePath(),
+		Offline:      offline,
+		Mirrors:      mirrors,
+
+		ShellOnFailure:   shellOnFailure,
+		NoIsolateNetwork: noIsolateNetwork || cfg.NoIsolateNetwork,
+		ImpurityPolicy:   cfg.Impurity,
+		ImpurityPaths:    cfg.HostPaths(),
+		RunTests:         runTests,
+	}
+
+	if keepFailed {
+		ienv.FailedDir = cfg.FailedPath()
+	}
+
+	if buildFrom != "" || buildUntil != "" {
+		ienv.PhaseID = pkg.ID()
+		ienv.FromPhase = buildFrom
+		ienv.UntilPhase = buildUntil
+		ienv.PhaseDir = cfg.BuildsPath()
 	}
 
 	err = os.MkdirAll(ienv.StoreDir, 0755)
@@ -84,13 +137,24 @@ func build(c *cobra.Command, args []string) {
 	}
 
 	install := o.PackagesInstall(ienv)
+	install.Jobs = jobs
 
 	err = install.Install(ctx, toInstall)
 	if err != nil {
+		if errors.Is(err, ops.ErrBuildStopped) {
+			fmt.Println(err)
+			return
+		}
+
 		log.Print(err)
 		return
 	}
 
+	if buildCheck {
+		checkBuild(ctx, o.PackageCheck(ienv), pkg)
+		return
+	}
+
 	fmt.Printf("+ Write packages to %s\n", buildOutputDir)
 
 	stc := o.StoreToCar(buildOutputDir)
@@ -109,3 +173,31 @@ func build(c *cobra.Command, args []string) {
 		}
 	}
 }
+
+func checkBuild(ctx context.Context, pc *ops.PackageCheck, pkg *ops.ScriptPackage) {
+	fmt.Printf("+ Rebuilding %s to check reproducibility\n", pkg.ID())
+
+	res, err := pc.Check(ctx, pkg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if res.Reproducible() {
+		fmt.Printf("%s is reproducible\n", pkg.ID())
+		return
+	}
+
+	fmt.Printf("%s is not reproducible, %d files differ:\n", pkg.ID(), len(res.Differences))
+
+	for _, d := range res.Differences {
+		fmt.Printf("  %s\n", d)
+	}
+
+	for _, d := range res.Differences {
+		if d.Diff != "" {
+			fmt.Printf("\n%s", d.Diff)
+		}
+	}
+
+	os.Exit(1)
+}
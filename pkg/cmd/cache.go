@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab47/chell/pkg/dlcache"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of downloaded files",
+		Long:  ``,
+	}
+
+	cacheLsCmd = &cobra.Command{
+		Use:   "ls",
+		Short: "List the cached downloads, most recently used first",
+		Long:  ``,
+		Args:  cobra.NoArgs,
+		Run:   cacheLs,
+	}
+
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the least recently used downloads until the cache fits in --max-size",
+		Long:  ``,
+		Args:  cobra.NoArgs,
+		Run:   cachePrune,
+	}
+)
+
+var cacheMaxSize string
+
+func init() {
+	cachePruneCmd.PersistentFlags().StringVar(&cacheMaxSize, "max-size", "5G", "size to shrink the cache to, such as 500M or 0 to empty it")
+
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+}
+
+func cacheLs(c *cobra.Command, args []string) {
+	_, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entries, err := dlcache.New(cfg.CachePath()).List()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var total int64
+
+	for _, e := range entries {
+		fmt.Printf("%s  %8s  %s:%s\n", e.Used.Format(time.RFC3339), formatSize(e.Size), e.Type, e.Sum)
+		total += e.Size
+	}
+
+	fmt.Printf("%d files, %s total\n", len(entries), formatSize(total))
+}
+
+func cachePrune(c *cobra.Command, args []string) {
+	_, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	max, err := parseSize(cacheMaxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	removed, err := dlcache.New(cfg.CachePath()).Prune(max)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var total int64
+
+	for _, e := range removed {
+		total += e.Size
+	}
+
+	fmt.Printf("removed %d files, %s freed\n", len(removed), formatSize(total))
+}
+
+var sizeUnits = "KMGT"
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix, in
+// powers of 1024.
+func parseSize(str string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(str)), "B")
+
+	mult := int64(1)
+
+	if s != "" {
+		if idx := strings.IndexByte(sizeUnits, s[len(s)-1]); idx != -1 {
+			mult = 1 << (10 * uint(idx+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+
+	return int64(n * float64(mult)), nil
+}
+
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	f := float64(n)
+
+	for _, u := range sizeUnits {
+		f /= 1024
+
+		if f < 1024 || u == 'T' {
+			return fmt.Sprintf("%.1f%c", f, u)
+		}
+	}
+
+	return ""
+}
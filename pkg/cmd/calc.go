@@ -121,11 +121,18 @@ func calcLibs(c *cobra.Command, args []string) {
 
 	fmt.Printf("Chell libs:\n")
 	for _, lib := range libs.ChellLibs {
-		fmt.Printf("- %s\n", lib)
+		fmt.Printf("- %s (used by %s)\n", lib, strings.Join(libs.UsedBy[lib], ", "))
 	}
 
 	fmt.Printf("System libs:\n")
 	for _, lib := range libs.SystemLibs {
-		fmt.Printf("- %s\n", lib)
+		fmt.Printf("- %s (used by %s)\n", lib, strings.Join(libs.UsedBy[lib], ", "))
+	}
+
+	if len(libs.Missing) > 0 {
+		fmt.Printf("Missing:\n")
+		for _, lib := range libs.Missing {
+			fmt.Printf("- %s (used by %s)\n", lib, strings.Join(libs.UsedBy[lib], ", "))
+		}
 	}
 }
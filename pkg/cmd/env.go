@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lab47/chell/pkg/ops"
+	"github.com/spf13/cobra"
+)
+
+var (
+	envCmd = &cobra.Command{
+		Use:   "env",
+		Short: "Print the environment an installed package and it's runtime deps provide",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(1),
+		Run:   envPackage,
+	}
+)
+
+func envPackage(c *cobra.Command, args []string) {
+	o, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sl := o.ScriptLoad()
+
+	scriptArgs := make(map[string]string)
+
+	for _, a := range args[1:] {
+		idx := strings.IndexByte(a, '=')
+		if idx > -1 {
+			scriptArgs[a[:idx]] = a[idx+1:]
+		}
+	}
+
+	pkg, err := sl.Load(
+		args[0],
+		ops.WithArgs(scriptArgs),
+		ops.WithConstraints(cfg.Constraints()),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deps, err := o.ScriptAllDeps().EvalDeps([]*ops.ScriptPackage{pkg})
+	if err != nil {
+		log.Fatalf("unable to calculate runtime deps of %s, is it installed? %s", pkg.ID(), err)
+	}
+
+	env, err := o.EnvCompose().Compose(context.Background(), nil, deps)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, kv := range env {
+		fmt.Println(kv)
+	}
+}
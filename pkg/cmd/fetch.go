@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lab47/chell/pkg/ops"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fetchCmd = &cobra.Command{
+		Use:   "fetch",
+		Short: "Download everything needed to install a package, or the current project",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(0),
+		Run:   fetch,
+	}
+)
+
+func init() {
+	fetchCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 1, "number of fetch() instances to build at the same time")
+}
+
+func fetch(c *cobra.Command, args []string) {
+	o, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var pkgs []*ops.ScriptPackage
+
+	if len(args) == 0 {
+		r, err := os.Open("project.chell")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proj, err := o.ProjectLoad().LoadScript(r,
+			ops.WithConstraints(cfg.Constraints()),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pkgs = proj.ToInstall
+	} else {
+		scriptArgs := make(map[string]string)
+
+		for _, a := range args[1:] {
+			idx := strings.IndexByte(a, '=')
+			if idx > -1 {
+				scriptArgs[a[:idx]] = a[idx+1:]
+			}
+		}
+
+		pkg, err := o.ScriptLoad().Load(
+			args[0],
+			ops.WithArgs(scriptArgs),
+			ops.WithConstraints(cfg.Constraints()),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	toInstall, err := o.PackageCalcInstall().CalculateSet(pkgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+
+	go func() {
+		<-ch
+		cancel()
+	}()
+
+	signal.Notify(ch, os.Interrupt, os.Kill, syscall.SIGQUIT)
+
+	buildDir, err := ioutil.TempDir("", "chell-build")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer os.RemoveAll(buildDir)
+
+	mirrors, err := o.Mirrors()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ienv := &ops.InstallEnv{
+		BuildDir:     buildDir,
+		StoreDir:     StoreDir,
+		Sandbox:      sandbox || cfg.Sandbox,
+		SandboxShell: cfg.SandboxShell,
+		LogDir:       cfg.LogsPath(),
+		SigDir:       cfg.SigsPath(),
+		CacheDir:     cfg.CachePath(),
+		GitCacheDir:  cfg.GitCachePath(),
+		Offline:      offline,
+		Mirrors:      mirrors,
+
+		ImpurityPolicy: cfg.Impurity,
+		ImpurityPaths:  cfg.HostPaths(),
+
+		NoIsolateNetwork: noIsolateNetwork || cfg.NoIsolateNetwork,
+	}
+
+	err = os.MkdirAll(ienv.StoreDir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pf := o.PackageFetch(ienv)
+	pf.Jobs = jobs
+
+	err = pf.Fetch(ctx, toInstall)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, url := range pf.Uncacheable {
+		fmt.Printf("! %s can't be cached without a content sum, it will be downloaded when built\n", url)
+	}
+
+	fmt.Printf("+ Fetched %d downloads and %d fetch() instances\n", len(pf.Downloaded), len(pf.Instances))
+}
@@ -38,6 +38,12 @@ var (
 	force       bool
 	profileName string
 	dev         bool
+	jobs        int
+	sandbox     bool
+
+	keepFailed     bool
+	shellOnFailure bool
+	runTests       bool
 )
 
 func init() {
@@ -46,6 +52,11 @@ func init() {
 	installCmd.PersistentFlags().BoolVarP(&force, "force", "", false, "force the build")
 	installCmd.PersistentFlags().StringVarP(&profileName, "profile", "p", config.DefaultProfile, "profile to install into")
 	installCmd.PersistentFlags().BoolVar(&dev, "dev", false, "Start a shell for packages development")
+	installCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 1, "number of packages to build at the same time")
+	installCmd.PersistentFlags().BoolVar(&sandbox, "sandbox", false, "build inside a sandbox that only exposes declared dependencies")
+	installCmd.PersistentFlags().BoolVar(&keepFailed, "keep-failed", false, "keep the build and output dirs of failed builds")
+	installCmd.PersistentFlags().BoolVar(&shellOnFailure, "shell-on-failure", false, "start a shell where a build failed")
+	installCmd.PersistentFlags().BoolVar(&runTests, "test", false, "run the tests of each package built")
 }
 
 const StoreDir = "/usr/local/chell/main/store"
@@ -101,10 +112,33 @@ func install(c *cobra.Command, args []string) {
 
 	defer os.RemoveAll(buildDir)
 
+	mirrors, err := o.Mirrors()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ienv := &ops.InstallEnv{
-		BuildDir:   buildDir,
-		StoreDir:   StoreDir,
-		StartShell: dev,
+		BuildDir:     buildDir,
+		StoreDir:     StoreDir,
+		StartShell:   dev,
+		Sandbox:      sandbox || cfg.Sandbox,
+		SandboxShell: cfg.SandboxShell,
+		LogDir:       cfg.LogsPath(),
+		SigDir:       cfg.SigsPath(),
+		CacheDir:     cfg.CachePath(),
+		GitCacheDir:  cfg.GitCachePath(),
+		Offline:      offline,
+		Mirrors:      mirrors,
+
+		ShellOnFailure:   shellOnFailure,
+		NoIsolateNetwork: noIsolateNetwork || cfg.NoIsolateNetwork,
+		ImpurityPolicy:   cfg.Impurity,
+		ImpurityPaths:    cfg.HostPaths(),
+		RunTests:         runTests,
+	}
+
+	if keepFailed {
+		ienv.FailedDir = cfg.FailedPath()
 	}
 
 	err = os.MkdirAll(ienv.StoreDir, 0755)
@@ -117,6 +151,7 @@ func install(c *cobra.Command, args []string) {
 	ui.InstallPrologue(cfg)
 
 	install := o.PackagesInstall(ienv)
+	install.Jobs = jobs
 
 	err = install.Install(ctx, toInstall)
 	if err != nil {
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lab47/chell/pkg/ops"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logCmd = &cobra.Command{
+		Use:   "log",
+		Short: "Show the build log of a package",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(0),
+		Run:   showLog,
+	}
+)
+
+var (
+	logFailed bool
+)
+
+func init() {
+	logCmd.PersistentFlags().BoolVar(&logFailed, "failed", false, "list recently failed builds")
+}
+
+func showLog(c *cobra.Command, args []string) {
+	o, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pbl := o.PackageBuildLog()
+
+	if logFailed {
+		failed, err := pbl.Failed(20)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, f := range failed {
+			fmt.Printf("%s  %s\n", f.Time.Format(time.RFC3339), f.Id)
+		}
+
+		return
+	}
+
+	if len(args) == 0 {
+		log.Fatal("a package name is required")
+	}
+
+	sl := o.ScriptLoad()
+
+	scriptArgs := make(map[string]string)
+
+	for _, a := range args[1:] {
+		idx := strings.IndexByte(a, '=')
+		if idx > -1 {
+			scriptArgs[a[:idx]] = a[idx+1:]
+		}
+	}
+
+	pkg, err := sl.Load(
+		args[0],
+		ops.WithArgs(scriptArgs),
+		ops.WithConstraints(cfg.Constraints()),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r, err := pbl.Open(pkg.ID())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer r.Close()
+
+	io.Copy(os.Stdout, r)
+}
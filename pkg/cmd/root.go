@@ -26,7 +26,9 @@ var (
 )
 
 var (
-	debug int
+	debug            int
+	offline          bool
+	noIsolateNetwork bool
 )
 
 // Execute executes the root command.
@@ -78,6 +80,8 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().CountVarP(&debug, "debug", "D", "debug level")
+	rootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "fail instead of accessing the network, see chell fetch")
+	rootCmd.PersistentFlags().BoolVar(&noIsolateNetwork, "no-isolate-network", false, "give builds and tests the host's network, for hosts without user namespaces")
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cobra.yaml)")
 	// rootCmd.PersistentFlags().StringP("author", "a", "YOUR NAME", "author name for copyright attribution")
@@ -100,6 +104,12 @@ func init() {
 	rootCmd.AddCommand(buildCmd)
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(calcLibsCmd)
+	rootCmd.AddCommand(logCmd)
+	rootCmd.AddCommand(testCmd)
+	rootCmd.AddCommand(envCmd)
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(fetchCmd)
+	rootCmd.AddCommand(whyRebuildCmd)
 }
 
 func er(msg interface{}) {
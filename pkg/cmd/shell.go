@@ -8,10 +8,9 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"strings"
 	"syscall"
 
+	"github.com/lab47/chell/pkg/evt"
 	"github.com/lab47/chell/pkg/ops"
 	"github.com/spf13/cobra"
 )
@@ -32,6 +31,7 @@ var shellFlags struct {
 
 func init() {
 	shellCmd.PersistentFlags().BoolVarP(&shellFlags.printEnv, "print-env", "E", false, "print the environment that would be added")
+	shellCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 1, "number of packages to build at the same time")
 }
 
 func shell(c *cobra.Command, args []string) {
@@ -82,13 +82,27 @@ func shell(c *cobra.Command, args []string) {
 
 	defer os.RemoveAll(buildDir)
 
+	mirrors, err := o.Mirrors()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ienv := &ops.InstallEnv{
-		BuildDir:   buildDir,
-		StoreDir:   StoreDir,
-		StartShell: dev,
+		BuildDir:    buildDir,
+		StoreDir:    StoreDir,
+		StartShell:  dev,
+		LogDir:      cfg.LogsPath(),
+		SigDir:      cfg.SigsPath(),
+		CacheDir:    cfg.CachePath(),
+		GitCacheDir: cfg.GitCachePath(),
+		Offline:     offline,
+		Mirrors:     mirrors,
+
+		NoIsolateNetwork: noIsolateNetwork || cfg.NoIsolateNetwork,
 	}
 
 	install := o.PackagesInstall(ienv)
+	install.Jobs = jobs
 
 	err = install.Install(ctx, toInstall)
 	if err != nil {
@@ -96,37 +110,24 @@ func shell(c *cobra.Command, args []string) {
 		return
 	}
 
-	var path []string
-
 	deps, err := o.ScriptAllDeps().EvalDeps(proj.ToInstall)
 	if err != nil {
 		log.Panic(err)
 		return
 	}
 
-	for _, dep := range deps {
-		binPath := filepath.Join(cfg.StorePath(), dep.ID(), "bin")
-		if _, err := os.Stat(binPath); err == nil {
-			path = append(path, binPath)
-		}
-	}
-
-	pkgPath := strings.Join(path, ":")
+	base := os.Environ()
 
-	curPath := os.Getenv("PATH")
-	if curPath != "" {
-		curPath = pkgPath + ":" + curPath
-	} else {
-		curPath = pkgPath
+	env, err := o.EnvCompose().Compose(ctx, base, deps)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if shellFlags.printEnv {
-		fmt.Printf("PATH=" + curPath)
+		printAddedEnv(base, env)
 		os.Exit(0)
 	}
 
-	os.Setenv("PATH", curPath)
-
 	args = args[1:]
 
 	if len(args) == 0 {
@@ -138,13 +139,31 @@ func shell(c *cobra.Command, args []string) {
 		args = []string{shell}
 	}
 
+	// Lookup the command with the PATH it will run with.
+	os.Setenv("PATH", evt.LookupEnv(env, "PATH"))
+
 	exec, err := exec.LookPath(args[0])
 	if err != nil {
 		fmt.Printf("Unable to find command: %s (%s)\n", args[0], err)
 		os.Exit(1)
 	}
 
-	err = syscall.Exec(exec, args, os.Environ())
+	err = syscall.Exec(exec, args, env)
 	fmt.Printf("error execing: %s\n", err)
 	os.Exit(1)
 }
+
+// printAddedEnv prints the variables in env that differ from base.
+func printAddedEnv(base, env []string) {
+	orig := make(map[string]bool)
+
+	for _, kv := range base {
+		orig[kv] = true
+	}
+
+	for _, kv := range env {
+		if !orig[kv] {
+			fmt.Println(kv)
+		}
+	}
+}
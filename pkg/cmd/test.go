@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lab47/chell/pkg/ops"
+	"github.com/spf13/cobra"
+)
+
+var (
+	testCmd = &cobra.Command{
+		Use:   "test",
+		Short: "Run the tests of an installed package",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(1),
+		Run:   testPackage,
+	}
+)
+
+func init() {
+	testCmd.PersistentFlags().BoolVar(&sandbox, "sandbox", false, "test inside a sandbox that only exposes the package and it's runtime deps")
+}
+
+func testPackage(c *cobra.Command, args []string) {
+	o, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sl := o.ScriptLoad()
+
+	scriptArgs := make(map[string]string)
+
+	for _, a := range args[1:] {
+		idx := strings.IndexByte(a, '=')
+		if idx > -1 {
+			scriptArgs[a[:idx]] = a[idx+1:]
+		}
+	}
+
+	pkg, err := sl.Load(
+		args[0],
+		ops.WithArgs(scriptArgs),
+		ops.WithConstraints(cfg.Constraints()),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+
+	go func() {
+		<-ch
+		cancel()
+	}()
+
+	signal.Notify(ch, os.Interrupt, os.Kill, syscall.SIGQUIT)
+
+	ienv := &ops.InstallEnv{
+		StoreDir:     StoreDir,
+		Sandbox:      sandbox || cfg.Sandbox,
+		SandboxShell: cfg.SandboxShell,
+
+		NoIsolateNetwork: noIsolateNetwork || cfg.NoIsolateNetwork,
+	}
+
+	err = o.PackageTest(ienv).Test(ctx, pkg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s passed\n", pkg.ID())
+}
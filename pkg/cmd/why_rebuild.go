@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lab47/chell/pkg/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	whyRebuildCmd = &cobra.Command{
+		Use:   "why-rebuild",
+		Short: "Explain why a package's ID differs from the last installed build of it",
+		Long:  ``,
+		Args:  cobra.MinimumNArgs(1),
+		Run:   whyRebuild,
+	}
+)
+
+func whyRebuild(c *cobra.Command, args []string) {
+	o, cfg, err := loadAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scriptArgs := make(map[string]string)
+
+	for _, a := range args[1:] {
+		idx := strings.IndexByte(a, '=')
+		if idx > -1 {
+			scriptArgs[a[:idx]] = a[idx+1:]
+		}
+	}
+
+	ns, name := parseName(args[0])
+
+	pkg, err := o.ScriptLoad().Load(
+		name,
+		ops.WithNamespace(ns),
+		ops.WithArgs(scriptArgs),
+		ops.WithConstraints(cfg.Constraints()),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prev, changes, err := o.PackageWhyRebuild().Explain(pkg)
+	if err != nil {
+		if errors.Is(err, ops.ErrNoPreviousBuild) {
+			fmt.Printf("No other build of %s is installed to compare %s to\n", pkg.Name(), pkg.ID())
+			return
+		}
+
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s\n  was: %s\n", pkg.ID(), prev)
+
+	if len(changes) == 0 {
+		fmt.Printf("No differences found, the signature calculation itself has changed\n")
+		return
+	}
+
+	printSigChanges(changes, "  ")
+}
+
+func printSigChanges(changes []*ops.SigChange, indent string) {
+	for _, ch := range changes {
+		switch {
+		case ch.Old == "":
+			fmt.Printf("%s+ %s: %s\n", indent, ch.Field, ch.New)
+		case ch.New == "":
+			fmt.Printf("%s- %s: %s\n", indent, ch.Field, ch.Old)
+		default:
+			fmt.Printf("%s~ %s: %s => %s\n", indent, ch.Field, ch.Old, ch.New)
+		}
+
+		printSigChanges(ch.Changes, indent+"    ")
+	}
+}
@@ -43,6 +43,26 @@ type Config struct {
 	Path         string `json:"chell-path"`
 	ProfilesPath string `json:"profiles-path"`
 	Profile      string `json:"profile"`
+
+	// Build packages inside a sandbox that only exposes their declared
+	// dependencies (Linux only).
+	Sandbox      bool   `json:"sandbox"`
+	SandboxShell string `json:"sandbox-shell"`
+
+	// Build and test packages with the host's network, for hosts where
+	// user namespaces aren't available to isolate it.
+	NoIsolateNetwork bool `json:"no-isolate-network"`
+
+	// What to do when a package refers to the build dir or host paths:
+	// warn (the default), fail or ignore.
+	Impurity string `json:"impurity"`
+
+	// Host paths packages must not refer to. Defaults to the home dir.
+	ImpurityPaths []string `json:"impurity-paths"`
+
+	// Base URLs of the mirrors to download mirror://name/ URLs from, by
+	// name. Tried after the mirrors the repo defines.
+	Mirrors map[string][]string `json:"mirrors"`
 }
 
 const (
@@ -129,6 +149,13 @@ func loadFile(path string) (*Config, error) {
 		cfg.Profile = DefaultProfile
 	}
 
+	switch cfg.Impurity {
+	case "", "warn", "fail", "ignore":
+		// ok
+	default:
+		return nil, fmt.Errorf("unknown impurity policy in %s: %q, must be warn, fail or ignore", path, cfg.Impurity)
+	}
+
 	return updateFromEnv(&cfg)
 }
 
@@ -290,6 +317,49 @@ func (c *Config) RootsPath() string {
 	return filepath.Join(c.DataDir, "roots")
 }
 
+func (c *Config) LogsPath() string {
+	return filepath.Join(c.DataDir, "logs")
+}
+
+func (c *Config) SigsPath() string {
+	return filepath.Join(c.DataDir, "sigs")
+}
+
+func (c *Config) FailedPath() string {
+	return filepath.Join(c.DataDir, "failed")
+}
+
+func (c *Config) BuildsPath() string {
+	return filepath.Join(c.DataDir, "builds")
+}
+
+func (c *Config) CachePath() string {
+	return filepath.Join(c.DataDir, "cache", "downloads")
+}
+
+func (c *Config) GitCachePath() string {
+	return filepath.Join(c.DataDir, "cache", "git")
+}
+
+// HostPaths returns the expanded ImpurityPaths.
+func (c *Config) HostPaths() []string {
+	paths := c.ImpurityPaths
+	if paths == nil {
+		paths = []string{"~"}
+	}
+
+	var expanded []string
+
+	for _, p := range paths {
+		p, err := homedir.Expand(p)
+		if err == nil && p != "" {
+			expanded = append(expanded, p)
+		}
+	}
+
+	return expanded
+}
+
 type PathPart struct {
 	Name string
 	Path string
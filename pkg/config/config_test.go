@@ -0,0 +1,45 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFile(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell-config")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	write := func(t *testing.T, impurity string) string {
+		path := filepath.Join(top, "config.json")
+
+		data := `{"data-dir": "` + filepath.Join(top, "data") + `", "profiles-path": "` +
+			filepath.Join(top, "profiles") + `", "impurity": "` + impurity + `"}`
+
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+		return path
+	}
+
+	t.Run("accepts the known impurity policies", func(t *testing.T) {
+		for _, policy := range []string{"", "warn", "fail", "ignore"} {
+			cfg, err := loadFile(write(t, policy))
+			require.NoError(t, err, policy)
+
+			assert.Equal(t, policy, cfg.Impurity)
+		}
+	})
+
+	t.Run("rejects unknown impurity policies", func(t *testing.T) {
+		_, err := loadFile(write(t, "strict"))
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), `"strict"`)
+	})
+}
@@ -18,4 +18,8 @@ type CarInfo struct {
 	Dependencies []*CarDependency `json:"dependencies"`
 
 	Constraints map[string]string `json:"constraints"`
+
+	// Set when the car contains an output of the package other than the
+	// main one.
+	Output string `json:"output,omitempty"`
 }
@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 type PackageInput struct {
 	Name    string `json:"name"`
 	SumType string `json:"sum_type"`
@@ -18,4 +20,20 @@ type PackageInfo struct {
 	BuildDeps   []string          `json:"build_deps"`
 	Constraints map[string]string `json:"constraints"`
 	Inputs      []*PackageInput   `json:"inputs"`
+	Check       *PackageCheck     `json:"check,omitempty"`
+
+	// The name of the output this is the info of, empty for the main one.
+	Output string `json:"output,omitempty"`
+
+	// The IDs of the other outputs of the package, by name. Only set on
+	// the main output.
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// PackageCheck is the result of rebuilding an installed package and
+// comparing the outputs.
+type PackageCheck struct {
+	Time         time.Time `json:"time"`
+	Reproducible bool      `json:"reproducible"`
+	Differences  []string  `json:"differences,omitempty"`
 }
@@ -0,0 +1,319 @@
+package dlcache
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lab47/chell/pkg/cleanhttp"
+	"github.com/lab47/chell/pkg/hashdetect"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBadSum  = hashdetect.ErrMismatch
+	ErrOffline = errors.New("running offline")
+)
+
+// Cache stores downloaded files by the sum they were verified against, so
+// that a file is only fetched once no matter how many builds use it.
+//
+// Cached files are read-only and copied into the dirs that use them, rather
+// than linked, so that a build changing it's copy doesn't change the cached
+// one.
+type Cache struct {
+	dir string
+}
+
+func New(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Sum identifies a file by a hash of it's contents, or by it's etag.
+type Sum struct {
+	Type  string
+	Value []byte
+}
+
+// ParseSum returns the sum of type st with the encoded value sv. Hashes may
+// be encoded in any of the ways hashdetect.Decode accepts.
+func ParseSum(st, sv string) (Sum, error) {
+	if st == "etag" {
+		return Sum{Type: st, Value: []byte(sv)}, nil
+	}
+
+	b, err := hashdetect.Decode(st, sv)
+	if err != nil {
+		return Sum{}, err
+	}
+
+	return Sum{Type: st, Value: b}, nil
+}
+
+// Cacheable returns true if files with this type of sum can be cached.
+// Sums that don't cover the contents, such as etags, can't be.
+func (s Sum) Cacheable() bool {
+	return hashdetect.Known(s.Type)
+}
+
+// Weak returns true if the sum is made with an algo that's no longer
+// collision resistant.
+func (s Sum) Weak() bool {
+	return hashdetect.Weak(s.Type)
+}
+
+func (c *Cache) path(sum Sum) string {
+	return filepath.Join(c.dir, sum.Type, hex.EncodeToString(sum.Value))
+}
+
+// Get places the cached file with sum at path, returning false if there
+// isn't one.
+func (c *Cache) Get(sum Sum, path string) (bool, error) {
+	if !sum.Cacheable() {
+		return false, nil
+	}
+
+	cached := c.path(sum)
+
+	if _, err := os.Stat(cached); err != nil {
+		return false, nil
+	}
+
+	// Mark it as used, for Prune.
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+
+	err := copyFile(cached, path)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Has returns true if the file with sum is in the cache.
+func (c *Cache) Has(sum Sum) bool {
+	if !sum.Cacheable() {
+		return false
+	}
+
+	_, err := os.Stat(c.path(sum))
+	return err == nil
+}
+
+// Download fetches url into the cache, verifying it against sum first, and
+// then places it at path.
+func (c *Cache) Download(ctx context.Context, url string, sum Sum, path string) error {
+	err := c.Fetch(ctx, url, sum)
+	if err != nil {
+		return err
+	}
+
+	return copyFile(c.path(sum), path)
+}
+
+// Fetch downloads url into the cache, verifying it against sum, without
+// placing it anywhere.
+func (c *Cache) Fetch(ctx context.Context, url string, sum Sum) error {
+	if !sum.Cacheable() {
+		return fmt.Errorf("unable to cache files with sum type: %s", sum.Type)
+	}
+
+	cached := c.path(sum)
+
+	err := os.MkdirAll(filepath.Dir(cached), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(cached), ".download-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = FetchURL(ctx, url, sum, f)
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(0444)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), cached)
+}
+
+// FetchURL downloads url to w, verifying it against sum. Etags are compared
+// to the one the server returns, and a sum with no type isn't verified.
+func FetchURL(ctx context.Context, url string, sum Sum, w io.Writer) error {
+	resp, err := cleanhttp.GetContext(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unable to download %s: %s", url, resp.Status)
+	}
+
+	switch sum.Type {
+	case "":
+		_, err = io.Copy(w, resp.Body)
+		return err
+	case "etag":
+		if etag := resp.Header.Get("Etag"); trimEtag(etag) != trimEtag(string(sum.Value)) {
+			return errors.Wrapf(ErrBadSum, "%s (expected etag %s, got %s)", url, sum.Value, etag)
+		}
+
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+
+	v, err := hashdetect.NewVerifier(sum.Type, sum.Value)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.MultiWriter(w, v), resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "unable to download %s", url)
+	}
+
+	return errors.Wrapf(v.Verify(), "%s", url)
+}
+
+func trimEtag(etag string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(etag, `"`), `"`)
+}
+
+// copyFile copies src to dst, replacing anything already at dst.
+func copyFile(src, dst string) error {
+	os.Remove(dst)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Entry is a file in the cache.
+type Entry struct {
+	Type string
+	Sum  string
+	Size int64
+
+	// When the entry was last downloaded or used.
+	Used time.Time
+}
+
+func (e *Entry) path(dir string) string {
+	return filepath.Join(dir, e.Type, e.Sum)
+}
+
+// List returns the entries in the cache, most recently used first.
+func (c *Cache) List() ([]*Entry, error) {
+	types, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var entries []*Entry
+
+	for _, t := range types {
+		if !t.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(c.dir, t.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if !f.Mode().IsRegular() || f.Name()[0] == '.' {
+				continue
+			}
+
+			entries = append(entries, &Entry{
+				Type: t.Name(),
+				Sum:  f.Name(),
+				Size: f.Size(),
+				Used: f.ModTime(),
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.After(entries[j].Used)
+	})
+
+	return entries, nil
+}
+
+// Prune removes the least recently used entries until the cache is no
+// larger than maxSize bytes, returning the removed entries.
+func (c *Cache) Prune(maxSize int64) ([]*Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	var removed []*Entry
+
+	for i := len(entries) - 1; i >= 0 && total > maxSize; i-- {
+		e := entries[i]
+
+		err = os.Remove(e.path(c.dir))
+		if err != nil {
+			return removed, err
+		}
+
+		total -= e.Size
+		removed = append(removed, e)
+	}
+
+	return removed, nil
+}
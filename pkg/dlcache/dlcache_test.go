@@ -0,0 +1,152 @@
+package dlcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	top, err := ioutil.TempDir("", "dlcache")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	var requests int
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello"))
+	}))
+
+	defer serv.Close()
+
+	h := sha256.Sum256([]byte("hello"))
+	sum := Sum{Type: "sha256", Value: h[:]}
+
+	c := New(filepath.Join(top, "cache"))
+
+	t.Run("downloads into the cache and reuses it", func(t *testing.T) {
+		path := filepath.Join(top, "a")
+
+		found, err := c.Get(sum, path)
+		require.NoError(t, err)
+		assert.False(t, found)
+
+		require.NoError(t, c.Download(context.Background(), serv.URL, sum, path))
+
+		assert.True(t, c.Has(sum))
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		other := filepath.Join(top, "b")
+
+		found, err = c.Get(sum, other)
+		require.NoError(t, err)
+		assert.True(t, found)
+
+		data, err = ioutil.ReadFile(other)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		assert.Equal(t, 1, requests)
+	})
+
+	t.Run("places copies that don't change the cached file", func(t *testing.T) {
+		path := filepath.Join(top, "d")
+
+		found, err := c.Get(sum, path)
+		require.NoError(t, err)
+		require.True(t, found)
+
+		require.NoError(t, ioutil.WriteFile(path, []byte("changed"), 0644))
+
+		data, err := ioutil.ReadFile(c.path(sum))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	})
+
+	t.Run("doesn't cache files that don't match the sum", func(t *testing.T) {
+		bad := Sum{Type: "sha256", Value: make([]byte, sha256.Size)}
+
+		err := c.Download(context.Background(), serv.URL, bad, filepath.Join(top, "c"))
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrBadSum))
+
+		found, err := c.Get(bad, filepath.Join(top, "c"))
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("verifies downloads by etag or any supported sum", func(t *testing.T) {
+		serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Etag", `"v1"`)
+			w.Write([]byte("hello"))
+		}))
+
+		defer serv.Close()
+
+		var buf bytes.Buffer
+
+		require.NoError(t, FetchURL(context.Background(), serv.URL, Sum{Type: "etag", Value: []byte("v1")}, &buf))
+		assert.Equal(t, "hello", buf.String())
+
+		err := FetchURL(context.Background(), serv.URL, Sum{Type: "etag", Value: []byte(`"v2"`)}, ioutil.Discard)
+		assert.True(t, errors.Is(err, ErrBadSum))
+
+		h := sha512.Sum512([]byte("hello"))
+
+		s512, err := ParseSum("sha512", "sha512-"+base64.StdEncoding.EncodeToString(h[:]))
+		require.NoError(t, err)
+
+		require.NoError(t, FetchURL(context.Background(), serv.URL, s512, ioutil.Discard))
+
+		md5, err := ParseSum("md5", "5d41402abc4b2a76b9719d911017c592")
+		require.NoError(t, err)
+
+		assert.True(t, md5.Weak())
+		require.NoError(t, FetchURL(context.Background(), serv.URL, md5, ioutil.Discard))
+	})
+
+	t.Run("prunes the least recently used files", func(t *testing.T) {
+		b2 := Sum{Type: "b2", Value: []byte{1}}
+
+		old := c.path(b2)
+		require.NoError(t, os.MkdirAll(filepath.Dir(old), 0755))
+		require.NoError(t, ioutil.WriteFile(old, []byte("old data"), 0444))
+
+		then := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(old, then, then))
+
+		entries, err := c.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+
+		assert.Equal(t, "sha256", entries[0].Type)
+
+		removed, err := c.Prune(5)
+		require.NoError(t, err)
+
+		require.Len(t, removed, 1)
+		assert.Equal(t, "b2", removed[0].Type)
+
+		_, err = os.Stat(old)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
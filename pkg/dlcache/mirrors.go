@@ -0,0 +1,110 @@
+package dlcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const mirrorScheme = "mirror://"
+
+// Mirrors maps the names used in mirror://name/path URLs to the base URLs of
+// the mirrors that serve them, in the order they're tried.
+type Mirrors map[string][]string
+
+// ReadMirrors reads mirrors from the JSON file at path, which maps each name
+// to a list of base URLs. A missing file defines no mirrors.
+func ReadMirrors(path string) (Mirrors, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var m Mirrors
+
+	err = json.NewDecoder(f).Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mirrors from %s: %s", path, err)
+	}
+
+	return m, nil
+}
+
+// Merge returns the mirrors of m, followed by those in o, for each name.
+func (m Mirrors) Merge(o Mirrors) Mirrors {
+	res := make(Mirrors)
+
+	for name, bases := range m {
+		res[name] = append(res[name], bases...)
+	}
+
+	for name, bases := range o {
+		res[name] = append(res[name], bases...)
+	}
+
+	return res
+}
+
+// Expand returns the URLs to try for urls, in order, with each mirror:// URL
+// replaced by it's path on each of the named mirrors.
+func (m Mirrors) Expand(urls []string) ([]string, error) {
+	var res []string
+
+	for _, url := range urls {
+		if !strings.HasPrefix(url, mirrorScheme) {
+			res = append(res, url)
+			continue
+		}
+
+		rest := url[len(mirrorScheme):]
+
+		idx := strings.IndexByte(rest, '/')
+		if idx == -1 {
+			return nil, fmt.Errorf("mirror URL missing path: %s", url)
+		}
+
+		bases, ok := m[rest[:idx]]
+		if !ok {
+			return nil, fmt.Errorf("unknown mirror in URL: %s", url)
+		}
+
+		for _, base := range bases {
+			res = append(res, strings.TrimRight(base, "/")+rest[idx:])
+		}
+	}
+
+	return res, nil
+}
+
+// TryEach calls fn with each of urls in turn until it succeeds, returning the
+// URL it succeeded with. If none do, the error for each URL is returned.
+func TryEach(urls []string, fn func(url string) error) (string, error) {
+	if len(urls) == 0 {
+		return "", fmt.Errorf("no URLs to download from")
+	}
+
+	var msgs []string
+
+	for _, url := range urls {
+		err := fn(url)
+		if err == nil {
+			return url, nil
+		}
+
+		if len(urls) == 1 {
+			return "", err
+		}
+
+		msgs = append(msgs, err.Error())
+	}
+
+	return "", fmt.Errorf("unable to download from any of %d URLs:\n  %s",
+		len(urls), strings.Join(msgs, "\n  "))
+}
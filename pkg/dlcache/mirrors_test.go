@@ -0,0 +1,66 @@
+package dlcache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrors(t *testing.T) {
+	t.Run("expands mirror URLs in order", func(t *testing.T) {
+		m := Mirrors{
+			"gnu": {"https://ftpmirror.gnu.org/", "https://ftp.gnu.org/gnu"},
+		}
+
+		urls, err := m.Expand([]string{
+			"https://example.com/make-4.3.tar.gz",
+			"mirror://gnu/make/make-4.3.tar.gz",
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"https://example.com/make-4.3.tar.gz",
+			"https://ftpmirror.gnu.org/make/make-4.3.tar.gz",
+			"https://ftp.gnu.org/gnu/make/make-4.3.tar.gz",
+		}, urls)
+
+		_, err = m.Expand([]string{"mirror://sourceforge/x.tar.gz"})
+		assert.Error(t, err)
+	})
+
+	t.Run("merges mirrors, keeping the first ones first", func(t *testing.T) {
+		var repo Mirrors
+
+		m := repo.Merge(Mirrors{"gnu": {"a"}}).Merge(Mirrors{"gnu": {"b"}, "cpan": {"c"}})
+
+		assert.Equal(t, Mirrors{"gnu": {"a", "b"}, "cpan": {"c"}}, m)
+	})
+
+	t.Run("tries each URL until one works", func(t *testing.T) {
+		var tried []string
+
+		url, err := TryEach([]string{"a", "b", "c"}, func(url string) error {
+			tried = append(tried, url)
+
+			if url == "b" {
+				return nil
+			}
+
+			return fmt.Errorf("%s is down", url)
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, "b", url)
+		assert.Equal(t, []string{"a", "b"}, tried)
+
+		_, err = TryEach([]string{"a", "c"}, func(url string) error {
+			return fmt.Errorf("%s is down", url)
+		})
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "a is down")
+		assert.Contains(t, err.Error(), "c is down")
+	})
+}
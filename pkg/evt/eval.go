@@ -3,50 +3,195 @@ package evt
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hashicorp/go-getter"
 	"github.com/hashicorp/go-hclog"
-	"github.com/lab47/chell/pkg/cleanhttp"
+	"github.com/lab47/chell/pkg/dlcache"
 	"github.com/lab47/chell/pkg/fileutils"
-	"github.com/mr-tron/base58"
+	"github.com/lab47/chell/pkg/gitfetch"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/blake2b"
 )
 
+// Observer is informed as each statement of a work tree is executed.
+type Observer interface {
+	StatementStart(n EVTNode)
+	StatementFinish(n EVTNode, dur time.Duration, exitStatus int, err error)
+}
+
 type Evaluator struct {
 	L            hclog.Logger
+	top          string
 	cwd          string
 	outdir       string
+	outputs      []string
 	env          []string
 	outputPrefix string
 	path         string
+	placeholders placeholders
+	observer     Observer
+	sandbox      *Sandbox
+	log          io.Writer
+	ctx          context.Context
+	killGrace    time.Duration
+
+	isolateNetwork bool
+	offline        bool
+
+	cache    *dlcache.Cache
+	mirrors  dlcache.Mirrors
+	gitCache string
+
+	fromPhase  string
+	untilPhase string
+	stopped    bool
 }
 
 type EvaluatorEnv struct {
-	WorkingDir   string
-	OutputDir    string
+	// Directory that $top refers to. Defaults to WorkingDir.
+	TopDir string
+
+	// Directory that statements run in, and that $build refers to.
+	WorkingDir string
+
+	// Directory that $prefix refers to.
+	OutputDir string
+
+	// Directories of the other outputs of the package, by the name used
+	// with Output.
+	Outputs map[string]string
+
 	Environ      []string
 	OutputPrefix string
+
+	// Notified about each statement as it's run. May be nil.
+	Observer Observer
+
+	// Receives the output of all commands run, in addition to it being
+	// printed. May be nil.
+	Log io.Writer
+
+	// Run commands inside this sandbox. May be nil.
+	Sandbox *Sandbox
+
+	// Run commands in a new network namespace with only loopback. Only
+	// downloads and git checkouts that are verified by a sum are allowed,
+	// as their contents are fixed regardless of where they come from. Only
+	// supported on Linux.
+	IsolateNetwork bool
+
+	// When done, the running command's process group is sent SIGTERM,
+	// followed by SIGKILL if it hasn't exited after KillGrace, and no
+	// further statements are run. Defaults to context.Background().
+	Context context.Context
+
+	// Defaults to DefaultKillGrace.
+	KillGrace time.Duration
+
+	// Skip the phases before FromPhase, only applying the statements that
+	// setup state for later ones, such as set_root. Used to resume a
+	// build in a dir kept from an earlier run.
+	FromPhase string
+
+	// Don't run any phases after UntilPhase.
+	UntilPhase string
+
+	// Downloads with a sum are looked up in and added to this cache. May
+	// be nil.
+	Cache *dlcache.Cache
+
+	// Base URLs of the mirrors that mirror://name/ URLs are downloaded
+	// from, by name.
+	Mirrors dlcache.Mirrors
+
+	// Directory to keep clones of the repos checked out by GitCheckout in,
+	// so that checking out other revisions only fetches what's new. Repos
+	// are cloned into a temporary dir if empty.
+	GitCache string
+
+	// Refuse to download anything that isn't already in Cache, failing
+	// with an error wrapping dlcache.ErrOffline that names the download.
+	Offline bool
+
+	// Number of jobs that $jobs refers to, for commands that build in
+	// parallel. Defaults to the number of CPUs.
+	Jobs int
 }
 
+// DefaultKillGrace is how long a command has to exit after SIGTERM before
+// it's killed.
+const DefaultKillGrace = 10 * time.Second
+
 func NewEvaluator(L hclog.Logger, opts EvaluatorEnv) *Evaluator {
+	top := opts.TopDir
+	if top == "" {
+		top = opts.WorkingDir
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	grace := opts.KillGrace
+	if grace == 0 {
+		grace = DefaultKillGrace
+	}
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	ph := placeholders{
+		Prefix:   opts.OutputDir,
+		BuildDir: opts.WorkingDir,
+		TopDir:   top,
+		Jobs:     strconv.Itoa(jobs),
+	}
+
+	var outputs []string
+
+	for name, dir := range opts.Outputs {
+		ph[Output(name)] = dir
+		outputs = append(outputs, dir)
+	}
+
 	ev := &Evaluator{
 		L:            L,
+		top:          top,
 		cwd:          opts.WorkingDir,
 		outdir:       opts.OutputDir,
+		outputs:      outputs,
 		env:          opts.Environ,
 		outputPrefix: opts.OutputPrefix,
+		observer:     opts.Observer,
+		sandbox:      opts.Sandbox,
+		log:          opts.Log,
+		ctx:          ctx,
+		killGrace:    grace,
+
+		isolateNetwork: opts.IsolateNetwork,
+		offline:        opts.Offline,
+		cache:          opts.Cache,
+		mirrors:        opts.Mirrors,
+		gitCache:       opts.GitCache,
+		fromPhase:      opts.FromPhase,
+		untilPhase:     opts.UntilPhase,
+		placeholders:   ph,
 	}
 
 	for _, kv := range opts.Environ {
@@ -60,8 +205,37 @@ func NewEvaluator(L hclog.Logger, opts EvaluatorEnv) *Evaluator {
 
 func (e *Evaluator) Eval(n EVTNode) error {
 	switch n := n.(type) {
+	case *Statements:
+		for _, stmt := range n.Statements {
+			err := e.evalStatement(stmt)
+			if err != nil {
+				return err
+			}
+		}
+	case *Phase:
+		if e.stopped {
+			return nil
+		}
+
+		if e.fromPhase != "" {
+			if n.Name != e.fromPhase {
+				return e.replay(n.Body)
+			}
+
+			e.fromPhase = ""
+		}
+
+		err := e.Eval(n.Body)
+		if err == nil && n.Name == e.untilPhase {
+			e.stopped = true
+		}
+
+		return err
 	case *SetRoot:
-		tgt := e.workPath(n.Dir)
+		tgt, err := e.workPath(n.Dir)
+		if err != nil {
+			return err
+		}
 
 		sf, err := ioutil.ReadDir(tgt)
 		if err != nil {
@@ -89,23 +263,47 @@ func (e *Evaluator) Eval(n EVTNode) error {
 			e.cwd = dir
 		}(e.cwd)
 
-		e.cwd = e.workPath(n.Dir)
+		dir, err := e.workPath(n.Dir)
+		if err != nil {
+			return err
+		}
+
+		e.cwd = dir
 
 		return e.Eval(n.Body)
 	case *MakeDir:
-		err := os.MkdirAll(e.workPath(n.Dir), 0755)
+		dir, err := e.workPath(n.Dir)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(dir, 0755)
 		if err != nil {
 			return err
 		}
 	case *Shell:
-		cmd := exec.Command("bash")
-		cmd.Stdin = strings.NewReader(n.Code)
+		shell := "bash"
+		if e.sandbox != nil && e.sandbox.Shell != "" {
+			shell = "/bin/sh"
+		}
+
+		cmd := exec.Command(shell)
+		cmd.Stdin = strings.NewReader(e.expand(n.Code))
 		cmd.Env = e.env
 		cmd.Dir = e.cwd
 
 		return e.runCmd(cmd)
 	case *System:
-		exe := n.Arguments[0]
+		if len(n.Arguments) == 0 {
+			return fmt.Errorf("system called without a command")
+		}
+
+		args := make([]string, len(n.Arguments))
+		for i, arg := range n.Arguments {
+			args[i] = e.expand(arg)
+		}
+
+		exe := args[0]
 		var err error
 
 		if filepath.Base(exe) == exe {
@@ -115,10 +313,17 @@ func (e *Evaluator) Eval(n EVTNode) error {
 			}
 		}
 
-		cmd := exec.Command("bash")
+		cmd := exec.Command(exe, args[1:]...)
 		cmd.Env = e.env
 		cmd.Dir = e.cwd
 
+		if n.Dir != "" {
+			cmd.Dir, err = e.workPath(n.Dir)
+			if err != nil {
+				return err
+			}
+		}
+
 		return e.runCmd(cmd)
 	case *Patch:
 		cmd := exec.Command("patch", "-p1")
@@ -128,7 +333,10 @@ func (e *Evaluator) Eval(n EVTNode) error {
 
 		return e.runCmd(cmd)
 	case *Replace:
-		path := e.workPath(n.File)
+		path, err := e.workPath(n.File)
+		if err != nil {
+			return err
+		}
 
 		data, err := ioutil.ReadFile(path)
 		if err != nil {
@@ -157,51 +365,48 @@ func (e *Evaluator) Eval(n EVTNode) error {
 		}
 
 	case *Rmrf:
-		target := filepath.Join(e.cwd, n.Target)
+		target, err := e.workPath(FSPath(n.Target))
+		if err != nil {
+			return err
+		}
 
-		err := os.RemoveAll(target)
+		err = os.RemoveAll(target)
 		if err != nil {
 			return err
 		}
 	case *SetEnv:
-		if n.Append {
-			if n.Key == "PATH" {
-				e.path = e.path + ":" + n.Value
-			}
-
-			prefix := n.Key + "="
-
-			for i, kv := range e.env {
-				if strings.HasPrefix(kv, prefix) {
-					e.env[i] += (string(filepath.ListSeparator) + n.Value)
-					return nil
-				}
-			}
-		} else if n.Prepend {
-			if n.Key == "PATH" {
-				e.path = n.Value + ":" + e.path
-			}
-
-			prefix := n.Key + "="
-
-			for i, kv := range e.env {
-				if strings.HasPrefix(kv, prefix) {
-					e.env[i] = n.Value + string(filepath.ListSeparator) + kv
-					return nil
-				}
-			}
+		e.env = ApplyEnv(e.env, &SetEnv{
+			Append:  n.Append,
+			Prepend: n.Prepend,
+			Key:     n.Key,
+			Value:   e.expand(n.Value),
+		})
+
+		if n.Key == "PATH" {
+			e.path = LookupEnv(e.env, "PATH")
 		}
-		e.env = append(e.env, n.Key+"="+n.Value)
 	case *Link:
-		target := e.outPath(n.Target)
+		target, err := e.outPath(n.Target)
+		if err != nil {
+			return err
+		}
+
+		original, err := e.outPath(n.Original)
+		if err != nil {
+			return err
+		}
+
 		os.MkdirAll(filepath.Dir(target), 0755)
 
-		err := os.Symlink(e.outPath(n.Original), target)
+		err = os.Symlink(original, target)
 		if err != nil {
 			return err
 		}
 	case *Unpack:
-		path := e.workPath(n.Path)
+		path, err := e.workPath(n.Path)
+		if err != nil {
+			return err
+		}
 
 		var (
 			archive string
@@ -216,7 +421,10 @@ func (e *Evaluator) Eval(n EVTNode) error {
 			}
 		}
 
-		output := e.workPath(n.Output)
+		output, err := e.workPath(n.Output)
+		if err != nil {
+			return err
+		}
 
 		if output == "" {
 			output = filepath.Dir(path)
@@ -233,80 +441,170 @@ func (e *Evaluator) Eval(n EVTNode) error {
 			return errors.Wrapf(err, "target missing")
 		}
 
-		err := dec.Decompress(target, path, true, 0)
+		err = dec.Decompress(target, path, true, 0)
 		if err != nil {
 			return errors.Wrapf(err, "unable to decompress %s", path)
 		}
 	case *Download:
-		resp, err := cleanhttp.Get(n.URL)
+		urls, err := e.mirrors.Expand(append([]string{n.URL}, n.Mirrors...))
 		if err != nil {
 			return err
 		}
 
-		defer resp.Body.Close()
-
-		path := e.workPath(n.Path)
-
-		f, err := os.Create(path)
+		path, err := e.workPath(n.Path)
 		if err != nil {
 			return err
 		}
 
-		defer f.Close()
+		var sum dlcache.Sum
 
-		if n.Sum == nil {
-			_, err = io.Copy(f, resp.Body)
+		if n.Sum != nil {
+			sum, err = n.Sum.Decode()
 			if err != nil {
 				return err
 			}
 
-			return nil
+			if sum.Weak() {
+				e.L.Warn("download is verified with a weak sum", "url", n.URL, "algo", sum.Type)
+			}
 		}
 
-		var (
-			w  io.Writer
-			h  hash.Hash
-			sv []byte
-		)
+		if e.cache != nil && sum.Cacheable() {
+			return e.cachedDownload(n, urls, sum, path)
+		}
+
+		if e.offline {
+			return OfflineError(n.URL, n.Sum)
+		}
+
+		if e.isolateNetwork && !sum.Cacheable() {
+			return ErrNoNetwork
+		}
+
+		url, err := dlcache.TryEach(urls, func(url string) error {
+			return e.download(url, sum, path)
+		})
+		if err != nil {
+			return err
+		}
+
+		e.logDownload(path, url)
+	case *GitCheckout:
+		return e.gitCheckout(n)
+	case *Copy:
+		source, target, err := e.workPaths(n.Source, n.Target)
+		if err != nil {
+			return err
+		}
+
+		return e.copy(source, target)
+	case *Move:
+		source, target, err := e.workPaths(n.Source, n.Target)
+		if err != nil {
+			return err
+		}
+
+		return e.move(source, target)
+	case *Chmod:
+		path, err := e.workPath(n.Path)
+		if err != nil {
+			return err
+		}
+
+		// Chmod follows links, so the file they point to has to be checked.
+		path, err = e.realPath(path, true)
+		if err != nil {
+			return err
+		}
+
+		return os.Chmod(path, n.Mode)
+	case *Symlink:
+		link, err := e.workPath(n.Link)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(filepath.Dir(link), 0755)
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(e.expand(n.Target), link)
+	case *RemoveGlob:
+		pattern, err := e.workPath(n.Pattern)
+		if err != nil {
+			return err
+		}
 
-		switch n.Sum.Type {
-		case "b2":
-			h, _ = blake2b.New256(nil)
-			w = io.MultiWriter(f, h)
-			sv, err = base58.Decode(n.Sum.Value)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range matches {
+			_, err = e.realPath(path, false)
 			if err != nil {
 				return err
 			}
-		case "sha256":
-			sv, err = hex.DecodeString(n.Sum.Value)
+
+			err = os.RemoveAll(path)
 			if err != nil {
 				return err
 			}
-			h = sha256.New()
-			w = io.MultiWriter(f, h)
-		case "etag":
-			w = f
-			// ok
-		default:
-			return fmt.Errorf("unknown sum type: %s", n.Sum.Type)
+		}
+	case *IfExists:
+		path, err := e.workPath(n.Path)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
 		}
 
-		io.Copy(w, resp.Body)
+		return e.Eval(n.Body)
+	case *Substitute:
+		return e.substitute(n)
+	case *WrapProgram:
+		return e.wrapProgram(n)
+	case *Glob:
+		pattern, err := e.workPath(n.Pattern)
+		if err != nil {
+			return err
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
 
-		switch n.Sum.Type {
-		case "etag":
-			if CompareEtag(n.Sum.Value, resp.Header.Get("Etag")) {
-				return fmt.Errorf("bad etag sum: %s (%s <> %s)",
-					path, n.Sum.Value, resp.Header.Get("Etag"))
+		// Globs can be nested, so the outer match is restored after.
+		defer func(match string, ok bool) {
+			if ok {
+				e.placeholders[Match] = match
+			} else {
+				delete(e.placeholders, Match)
 			}
-		default:
-			if !bytes.Equal(sv, h.Sum(nil)) {
-				return fmt.Errorf("bad sum: %s", path)
+		}(e.placeholders[Match], e.placeholders[Match] != "")
+
+		for _, path := range matches {
+			e.placeholders[Match] = path
+
+			err = e.Eval(n.Body)
+			if err != nil {
+				return err
 			}
 		}
 	case *InstallFiles:
-		pattern := e.workPath(n.Pattern)
-		target := e.workPath(n.Target)
+		pattern, target, err := e.workPaths(n.Pattern, n.Target)
+		if err != nil {
+			return err
+		}
 
 		var inst fileutils.Install
 		inst.L = e.L
@@ -316,7 +614,10 @@ func (e *Evaluator) Eval(n EVTNode) error {
 
 		return inst.Install()
 	case *WriteFile:
-		target := e.outPath(n.Target)
+		target, err := e.outPath(n.Target)
+		if err != nil {
+			return err
+		}
 
 		f, err := os.Create(target)
 		if err != nil {
@@ -333,16 +634,543 @@ func (e *Evaluator) Eval(n EVTNode) error {
 	return nil
 }
 
-func (e *Evaluator) checkPath(path string) string {
-	if !(strings.HasPrefix(path, e.cwd) || strings.HasPrefix(path, e.outdir)) {
-		panic(fmt.Sprintf("invalid path used, outside work or output dir: %s", path))
+// StatementError is returned by Eval when a statement fails, naming the
+// innermost statement that did.
+type StatementError struct {
+	Statement EVTNode
+	Err       error
+
+	// The directory and environment the statement ran with.
+	Dir string
+	Env []string
+
+	// Set when the statement ran without network access.
+	NoNetwork bool
+}
+
+func (s *StatementError) Error() string {
+	msg := fmt.Sprintf("statement '%s' failed: %s", Describe(s.Statement), s.Err)
+
+	if s.NoNetwork {
+		msg += " (only fetch() and downloads with a sum have network access)"
+	}
+
+	return msg
+}
+
+func (s *StatementError) Unwrap() error {
+	return s.Err
+}
+
+// replay applies the statements in n that only change the state of the
+// evaluator, without running anything.
+func (e *Evaluator) replay(n EVTNode) error {
+	switch n := n.(type) {
+	case *Statements:
+		for _, stmt := range n.Statements {
+			err := e.replay(stmt)
+			if err != nil {
+				return err
+			}
+		}
+	case *SetRoot, *SetEnv:
+		return e.Eval(n)
+	}
+
+	return nil
+}
+
+// evalStatement runs a single statement of a Statements block, informing
+// the observer about it's start and finish.
+func (e *Evaluator) evalStatement(n EVTNode) error {
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+
+	if e.observer != nil {
+		e.observer.StatementStart(n)
+	}
+
+	start := time.Now()
+	err := e.Eval(n)
+
+	if e.observer != nil {
+		e.observer.StatementFinish(n, time.Since(start), ExitStatus(err), err)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	var se *StatementError
+	if errors.As(err, &se) {
+		return err
+	}
+
+	dir := e.cwd
+	if sys, ok := n.(*System); ok && sys.Dir != "" {
+		if path, perr := e.workPath(sys.Dir); perr == nil {
+			dir = path
+		}
+	}
+
+	return &StatementError{
+		Statement: n,
+		Err:       err,
+		Dir:       dir,
+		Env:       append([]string(nil), e.env...),
+		NoNetwork: e.isolateNetwork,
+	}
+}
+
+// ExitStatus returns the exit status of a statement that returned err.
+// Errors that didn't come from a command exiting are reported as -1.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+
+	return -1
+}
+
+// cachedDownload places the file for n from the cache, downloading it into
+// the cache first if needed. A cached file has been verified against it's sum,
+// so it can be used even without network access.
+func (e *Evaluator) cachedDownload(n *Download, urls []string, sum dlcache.Sum, path string) error {
+	found, err := e.cache.Get(sum, path)
+	if err != nil || found {
+		return err
+	}
+
+	if e.offline {
+		return OfflineError(n.URL, n.Sum)
+	}
+
+	url, err := dlcache.TryEach(urls, func(url string) error {
+		return e.cache.Download(e.ctx, url, sum, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	e.logDownload(path, url)
+
+	return nil
+}
+
+// download fetches url into path, verifying it against sum if it has one.
+func (e *Evaluator) download(url string, sum dlcache.Sum, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	err = dlcache.FetchURL(e.ctx, url, sum, f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// logDownload records in the build log which URL path was downloaded from,
+// as it may have come from any of the mirrors.
+func (e *Evaluator) logDownload(path, url string) {
+	if e.log != nil {
+		fmt.Fprintf(e.log, "downloaded %s from %s\n", path, url)
+	}
+}
+
+// gitCheckout checks out the tree for n, verifying it against n's sum. The
+// build fails with the tree's sum if it doesn't match, which is also how to
+// find the sum of a new checkout.
+func (e *Evaluator) gitCheckout(n *GitCheckout) error {
+	dir, err := e.workPath(n.Dir)
+	if err != nil {
+		return err
+	}
+
+	f := gitfetch.Fetcher{
+		Dir:     e.gitCache,
+		NoFetch: e.offline || (e.isolateNetwork && n.Sum == ""),
+	}
+
+	_, err = f.Checkout(e.ctx, n.URL, n.Rev, dir)
+	if err != nil {
+		if errors.Is(err, gitfetch.ErrNotFetched) {
+			if e.offline {
+				return errors.Wrapf(dlcache.ErrOffline, "git repo %s at %s is not in the cache", n.URL, n.Rev)
+			}
+
+			return ErrNoNetwork
+		}
+
+		return err
+	}
+
+	sum, err := gitfetch.HashTree(dir)
+	if err != nil {
+		return err
+	}
+
+	if sum != n.Sum {
+		return errors.Wrapf(gitfetch.ErrBadSum, "%s at %s has sum %s, expected %q", n.URL, n.Rev, sum, n.Sum)
+	}
+
+	return nil
+}
+
+// OfflineError returns the error for the download of url, declared with
+// sum, not being in the download cache while offline.
+func OfflineError(url string, sum *KnownSum) error {
+	if sum == nil {
+		return errors.Wrapf(dlcache.ErrOffline, "%s has no sum, so it can't be cached", url)
+	}
+
+	return errors.Wrapf(dlcache.ErrOffline, "%s (%s) is not in the download cache", url, sum)
+}
+
+// ApplyEnv returns env, a list of KEY=value pairs, with the change described
+// by n made to it. Appending or prepending to a variable that isn't set sets
+// it.
+func ApplyEnv(env []string, n *SetEnv) []string {
+	prefix := n.Key + "="
+
+	for i, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+
+		out := append([]string(nil), env...)
+
+		switch {
+		case n.Append:
+			out[i] = kv + string(filepath.ListSeparator) + n.Value
+		case n.Prepend:
+			out[i] = prefix + n.Value + string(filepath.ListSeparator) + kv[len(prefix):]
+		default:
+			out[i] = prefix + n.Value
+		}
+
+		return out
+	}
+
+	return append(env[:len(env):len(env)], prefix+n.Value)
+}
+
+// LookupEnv returns the value of key in env, a list of KEY=value pairs, or
+// "" if it's not set.
+func LookupEnv(env []string, key string) string {
+	prefix := key + "="
+
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return kv[len(prefix):]
+		}
+	}
+
+	return ""
+}
+
+// copy copies source to target like cp -R, into target if it's an existing
+// dir. source may be a glob pattern, but has to match something.
+func (e *Evaluator) copy(source, target string) error {
+	matches, err := filepath.Glob(source)
+	if err != nil {
+		return err
+	}
+
+	if len(matches) == 0 {
+		return fmt.Errorf("unable to copy %s: no such file", source)
+	}
+
+	for _, path := range append(matches, target) {
+		_, err = e.realPath(path, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The matches of a pattern are always copied into target, by Install.
+	_, err = os.Lstat(source)
+	if fi, terr := os.Stat(target); err == nil && terr == nil && fi.IsDir() {
+		target = filepath.Join(target, filepath.Base(source))
+	}
+
+	var inst fileutils.Install
+	inst.L = e.L
+	inst.Pattern = source
+	inst.Dest = target
+
+	return inst.Install()
+}
+
+// move renames source to target, into target if it's an existing dir,
+// copying it instead if they're on different filesystems.
+func (e *Evaluator) move(source, target string) error {
+	for _, path := range []string{source, target} {
+		_, err := e.realPath(path, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		target = filepath.Join(target, filepath.Base(source))
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(source, target)
+
+	var le *os.LinkError
+	if err == nil || !errors.As(err, &le) || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	err = e.copy(source, target)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(source)
+}
+
+// substitute replaces the @name@ placeholders in n's file, failing if one
+// isn't used so that a misspelt name doesn't go unnoticed.
+func (e *Evaluator) substitute(n *Substitute) error {
+	path, err := e.workPath(n.File)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var pairs []string
+
+	for name, val := range n.Vars {
+		key := "@" + name + "@"
+
+		if !bytes.Contains(data, []byte(key)) {
+			return fmt.Errorf("%s not found in %s", key, path)
+		}
+
+		pairs = append(pairs, key, e.expand(val))
+	}
+
+	out := strings.NewReplacer(pairs...).Replace(string(data))
+
+	return ioutil.WriteFile(path, []byte(out), fi.Mode().Perm())
+}
+
+// wrapProgram moves n's program to a hidden file next to it and writes a
+// script in it's place that sets up the environment and execs it.
+func (e *Evaluator) wrapProgram(n *WrapProgram) error {
+	path, err := e.workPath(n.Program)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	wrapped := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"-wrapped")
+
+	if _, err := os.Lstat(wrapped); err == nil {
+		return fmt.Errorf("%s is already wrapped", path)
+	}
+
+	err = os.Rename(path, wrapped)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+
+	for k := range n.SetEnv {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+
+	buf.WriteString("#!/bin/sh\n")
+
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "export %s=%s\n", k, shellQuote(e.expand(n.SetEnv[k])))
+	}
+
+	if len(n.PrefixPath) > 0 {
+		dirs := make([]string, len(n.PrefixPath))
+		for i, dir := range n.PrefixPath {
+			dirs[i] = e.expand(dir)
+		}
+
+		fmt.Fprintf(&buf, "export PATH=%s\"${PATH:+:$PATH}\"\n", shellQuote(strings.Join(dirs, ":")))
+	}
+
+	fmt.Fprintf(&buf, "exec %s \"$@\"\n", shellQuote(wrapped))
+
+	return ioutil.WriteFile(path, buf.Bytes(), fi.Mode().Perm()|0111)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (e *Evaluator) expand(str string) string {
+	return e.placeholders.expand(str)
+}
+
+// placeholders maps the placeholders an Evaluator expands to their values.
+type placeholders map[string]string
+
+// expand replaces the placeholders in str. A placeholder followed by more
+// of a name isn't one, so shell variables that start the same, such as
+// $prefix_dir or $topdir, are left alone.
+func (p placeholders) expand(str string) string {
+	if !strings.Contains(str, "$") {
+		return str
+	}
+
+	var sb strings.Builder
+
+	for {
+		idx := strings.IndexByte(str, '$')
+		if idx == -1 {
+			sb.WriteString(str)
+			return sb.String()
+		}
+
+		sb.WriteString(str[:idx])
+		str = str[idx:]
+
+		key, val := p.lookup(str)
+		if key == "" {
+			sb.WriteByte('$')
+			str = str[1:]
+			continue
+		}
+
+		sb.WriteString(val)
+		str = str[len(key):]
+	}
+}
+
+// lookup returns the longest placeholder that str starts with, and it's
+// value.
+func (p placeholders) lookup(str string) (string, string) {
+	var key, val string
+
+	for k, v := range p {
+		if len(k) <= len(key) || !strings.HasPrefix(str, k) {
+			continue
+		}
+
+		rest := str[len(k):]
+		if rest != "" && isNameByte(k[len(k)-1]) && isNameByte(rest[0]) {
+			continue
+		}
+
+		key, val = k, v
+	}
+
+	return key, val
+}
+
+func isNameByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+func (e *Evaluator) checkPath(path string) (string, error) {
+	path = filepath.Clean(path)
+
+	for _, dir := range e.pathDirs() {
+		if inDir(path, dir) {
+			return path, nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrOutsidePath, "%s", path)
+}
+
+// realPath returns path with the links in it resolved, failing if that puts
+// it outside of the work and output dirs, as a link made by the build could
+// otherwise be used to reach files elsewhere on the host. The last element
+// of path is only resolved if follow is set, for operations that act on
+// what a link points to. The parts of path that don't exist yet are kept.
+func (e *Evaluator) realPath(path string, follow bool) (string, error) {
+	dir, rest := path, ""
+
+	if !follow {
+		dir, rest = filepath.Dir(path), filepath.Base(path)
+	}
+
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			path = filepath.Join(real, rest)
+			break
+		}
+
+		if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+
+		dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+	}
+
+	for _, dir := range e.pathDirs() {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+
+		if inDir(path, dir) {
+			return path, nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrOutsidePath, "%s", path)
+}
+
+// pathDirs returns the dirs that statements can access paths in.
+func (e *Evaluator) pathDirs() []string {
+	return append([]string{e.top, e.outdir}, e.outputs...)
+}
+
+// inDir returns true if path is dir or inside it.
+func inDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
 	}
 
-	return path
+	return rel != ".." && !strings.HasPrefix(rel, "../")
 }
 
-func (e *Evaluator) workPath(fspath FSPath) string {
-	path := string(fspath)
+func (e *Evaluator) workPath(fspath FSPath) (string, error) {
+	path := e.expand(string(fspath))
 
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(e.cwd, path)
@@ -351,8 +1179,23 @@ func (e *Evaluator) workPath(fspath FSPath) string {
 	return e.checkPath(path)
 }
 
-func (e *Evaluator) outPath(fspath FSPath) string {
-	path := string(fspath)
+// workPaths returns the work paths of a and b.
+func (e *Evaluator) workPaths(a, b FSPath) (string, string, error) {
+	pa, err := e.workPath(a)
+	if err != nil {
+		return "", "", err
+	}
+
+	pb, err := e.workPath(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	return pa, pb, nil
+}
+
+func (e *Evaluator) outPath(fspath FSPath) (string, error) {
+	path := e.expand(string(fspath))
 
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(e.outdir, path)
@@ -362,6 +1205,17 @@ func (e *Evaluator) outPath(fspath FSPath) string {
 }
 
 func (e *Evaluator) runCmd(cmd *exec.Cmd) error {
+	isolated := e.sandbox != nil || e.isolateNetwork
+
+	if isolated {
+		cleanup, err := e.isolate(cmd)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+	}
+
 	or, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -382,7 +1236,7 @@ func (e *Evaluator) runCmd(cmd *exec.Cmd) error {
 		for {
 			line, err := br.ReadString('\n')
 			if len(line) > 0 {
-				fmt.Printf("%s │ %s\n", e.outputPrefix, strings.TrimRight(line, " \n\t"))
+				e.output(line)
 			}
 
 			if err != nil {
@@ -398,7 +1252,7 @@ func (e *Evaluator) runCmd(cmd *exec.Cmd) error {
 		for {
 			line, err := br.ReadString('\n')
 			if len(line) > 0 {
-				fmt.Printf("%s │ %s\n", e.outputPrefix, strings.TrimRight(line, " \n\t"))
+				e.output(line)
 			}
 
 			if err != nil {
@@ -407,14 +1261,36 @@ func (e *Evaluator) runCmd(cmd *exec.Cmd) error {
 		}
 	}()
 
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	// Run the command in it's own process group so that anything it starts
+	// is signaled along with it.
+	cmd.SysProcAttr.Setpgid = true
+
 	err = cmd.Start()
 	if err != nil {
+		if isolated {
+			return startError(err)
+		}
+
 		return err
 	}
 
+	done := make(chan struct{})
+	defer close(done)
+
+	go e.killOnCancel(cmd.Process.Pid, done)
+
 	wg.Wait()
 
 	err = cmd.Wait()
+
+	if ctxErr := e.ctx.Err(); ctxErr != nil {
+		return errors.Wrapf(ctxErr, "command interrupted")
+	}
+
 	if err != nil {
 		return err
 	}
@@ -422,8 +1298,43 @@ func (e *Evaluator) runCmd(cmd *exec.Cmd) error {
 	return nil
 }
 
+// killOnCancel signals the process group pgid when the evaluator's context
+// is done, first with SIGTERM and then SIGKILL once the grace period is up.
+// It returns when done is closed.
+func (e *Evaluator) killOnCancel(pgid int, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-e.ctx.Done():
+	}
+
+	syscall.Kill(-pgid, syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(e.killGrace):
+		e.L.Warn("command didn't exit after SIGTERM, killing", "pgid", pgid)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// output prints a line of output from a command, also writing it to the
+// log if there is one.
+func (e *Evaluator) output(line string) {
+	line = strings.TrimRight(line, " \n\t")
+
+	fmt.Printf("%s │ %s\n", e.outputPrefix, line)
+
+	if e.log != nil {
+		fmt.Fprintln(e.log, line)
+	}
+}
+
 var (
-	ErrNotFound = errors.New("entry not found")
+	ErrNotFound  = errors.New("entry not found")
+	ErrNoNetwork = errors.New("download attempted without network access")
+
+	ErrOutsidePath = errors.New("path is outside the work and output dirs")
 )
 
 func findExecutable(file string) error {
@@ -466,15 +1377,3 @@ func lookPath(file string, path string) (string, error) {
 	}
 	return "", errors.Wrapf(ErrNotFound, "unable to find executable: %s", path)
 }
-
-func CompareEtag(a, b string) bool {
-	if a[0] == '"' {
-		a = a[1 : len(a)-2]
-	}
-
-	if b[0] == '"' {
-		b = b[1 : len(b)-2]
-	}
-
-	return a == b
-}
@@ -0,0 +1,796 @@
+package evt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hashicorp/go-hclog"
+	"github.com/lab47/chell/pkg/dlcache"
+	"github.com/lab47/chell/pkg/gitfetch"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testObserver struct {
+	started  []EVTNode
+	finished []EVTNode
+	statuses []int
+}
+
+func (t *testObserver) StatementStart(n EVTNode) {
+	t.started = append(t.started, n)
+}
+
+func (t *testObserver) StatementFinish(n EVTNode, dur time.Duration, exitStatus int, err error) {
+	t.finished = append(t.finished, n)
+	t.statuses = append(t.statuses, exitStatus)
+}
+
+func TestEvaluator(t *testing.T) {
+	setup := func(t *testing.T) (string, string, func()) {
+		top, err := ioutil.TempDir("", "evt")
+		require.NoError(t, err)
+
+		build := filepath.Join(top, "build")
+		out := filepath.Join(top, "out")
+
+		require.NoError(t, os.Mkdir(build, 0755))
+		require.NoError(t, os.Mkdir(out, 0755))
+
+		return build, out, func() { os.RemoveAll(top) }
+	}
+
+	t.Run("runs statements with arguments and expands placeholders", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		var obs testObserver
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Observer:   &obs,
+		})
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&MakeDir{Dir: Prefix + "/bin"},
+				&System{Arguments: []string{"touch", Prefix + "/bin/flag"}},
+			},
+		}
+
+		err := ev.Eval(work)
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(out, "bin", "flag"))
+		require.NoError(t, err)
+
+		assert.Equal(t, work.Statements, obs.started)
+		assert.Equal(t, work.Statements, obs.finished)
+		assert.Equal(t, []int{0, 0}, obs.statuses)
+	})
+
+	t.Run("expands the placeholders of other outputs", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		dev := filepath.Join(filepath.Dir(out), "out-dev")
+		require.NoError(t, os.Mkdir(dev, 0755))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Outputs:    map[string]string{"dev": dev, "devel": out + "-devel"},
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&MakeDir{Dir: FSPath(Output("dev") + "/include")},
+				&System{Arguments: []string{"touch", Output("dev") + "/include/foo.h"}},
+			},
+		}
+
+		err := ev.Eval(work)
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(dev, "include", "foo.h"))
+		require.NoError(t, err)
+	})
+
+	t.Run("expands the number of jobs", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Jobs:       3,
+		})
+
+		err := ev.Eval(&System{Arguments: []string{"touch", Prefix + "/jobs-" + Jobs}})
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(out, "jobs-3"))
+		require.NoError(t, err)
+	})
+
+	t.Run("leaves shell variables that start like a placeholder alone", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Jobs:       3,
+		})
+
+		err := ev.Eval(&Shell{Code: `prefix_dir=a; topdir=b; jobs2=c; echo "$prefix_dir $topdir $jobs2 ` + Jobs + `" > ` + Prefix + `/vars`})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(out, "vars"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "a b c 3\n", string(data))
+	})
+
+	t.Run("reports the exit status of a failed statement", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		var obs testObserver
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Observer:   &obs,
+		})
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&Shell{Code: "exit 3"},
+				&MakeDir{Dir: "never"},
+			},
+		}
+
+		err := ev.Eval(work)
+		require.Error(t, err)
+
+		assert.Equal(t, 3, ExitStatus(err))
+		assert.Equal(t, []int{3}, obs.statuses)
+
+		var se *StatementError
+		require.True(t, errors.As(err, &se))
+
+		assert.Equal(t, build, se.Dir)
+		assert.Equal(t, []string{"PATH=/bin:/usr/bin"}, se.Env)
+
+		_, err = os.Stat(filepath.Join(build, "never"))
+		assert.Error(t, err)
+	})
+
+	t.Run("refuses to download without network access", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir:     build,
+			OutputDir:      out,
+			Environ:        []string{"PATH=/bin:/usr/bin"},
+			IsolateNetwork: true,
+		})
+
+		dl := &Download{URL: "http://example.com/src.tar.gz", Path: "src.tar.gz"}
+
+		err := ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrNoNetwork))
+
+		var se *StatementError
+		require.True(t, errors.As(err, &se))
+
+		assert.Equal(t, dl, se.Statement)
+		assert.Contains(t, err.Error(), "download: http://example.com/src.tar.gz")
+		assert.Contains(t, err.Error(), "fetch()")
+	})
+
+	t.Run("downloads files with a sum without network access", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("source"))
+		}))
+
+		defer serv.Close()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir:     build,
+			OutputDir:      out,
+			Environ:        []string{"PATH=/bin:/usr/bin"},
+			IsolateNetwork: true,
+		})
+
+		h := sha256.Sum256([]byte("source"))
+
+		dl := &Download{
+			URL:  serv.URL + "/src.tar.gz",
+			Path: "src.tar.gz",
+			Sum:  &KnownSum{Type: "sha256", Value: hex.EncodeToString(h[:])},
+		}
+
+		err := ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "src.tar.gz"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "source", string(data))
+
+		dl = &Download{
+			URL:  serv.URL + "/other.tar.gz",
+			Path: "other.tar.gz",
+			Sum:  &KnownSum{Type: "etag", Value: "v1"},
+		}
+
+		err = ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		assert.True(t, errors.Is(err, ErrNoNetwork))
+	})
+
+	t.Run("uses cached downloads without network access", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		cacheDir := filepath.Join(filepath.Dir(build), "cache")
+		cache := dlcache.New(cacheDir)
+
+		h := sha256.Sum256([]byte("source"))
+
+		cached := filepath.Join(cacheDir, "sha256", hex.EncodeToString(h[:]))
+		require.NoError(t, os.MkdirAll(filepath.Dir(cached), 0755))
+		require.NoError(t, ioutil.WriteFile(cached, []byte("source"), 0444))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir:     build,
+			OutputDir:      out,
+			Environ:        []string{"PATH=/bin:/usr/bin"},
+			IsolateNetwork: true,
+			Cache:          cache,
+		})
+
+		dl := &Download{
+			URL:  "http://example.com/src.tar.gz",
+			Path: "src.tar.gz",
+			Sum:  &KnownSum{Type: "sha256", Value: hex.EncodeToString(h[:])},
+		}
+
+		err := ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "src.tar.gz"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "source", string(data))
+	})
+
+	t.Run("falls back to mirrors and logs the one used", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/down/") {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Write([]byte("source"))
+		}))
+
+		defer serv.Close()
+
+		var log bytes.Buffer
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Log:        &log,
+			Mirrors:    dlcache.Mirrors{"gnu": {serv.URL + "/down", serv.URL + "/up"}},
+		})
+
+		h := sha256.Sum256([]byte("source"))
+
+		dl := &Download{
+			URL:     serv.URL + "/down/src.tar.gz",
+			Mirrors: []string{"mirror://gnu/src.tar.gz"},
+			Path:    "src.tar.gz",
+			Sum:     &KnownSum{Type: "sha256", Value: hex.EncodeToString(h[:])},
+		}
+
+		err := ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "src.tar.gz"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "source", string(data))
+		assert.Contains(t, log.String(), "from "+serv.URL+"/up/src.tar.gz")
+
+		// Where a file comes from doesn't change what it is.
+		a, err := Hash(dl)
+		require.NoError(t, err)
+
+		b, err := Hash(&Download{URL: dl.URL, Path: dl.Path, Sum: dl.Sum})
+		require.NoError(t, err)
+
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("checks out git repos, failing with the sum if it doesn't match", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		src := filepath.Join(filepath.Dir(build), "src")
+
+		repo, err := git.PlainInit(src, false)
+		require.NoError(t, err)
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, "main.c"), []byte("int main() {}\n"), 0644))
+
+		wt, err := repo.Worktree()
+		require.NoError(t, err)
+
+		_, err = wt.Add("main.c")
+		require.NoError(t, err)
+
+		_, err = wt.Commit("initial", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		require.NoError(t, err)
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		co := &GitCheckout{URL: src, Rev: "master", Dir: "src"}
+
+		err = ev.Eval(co)
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, gitfetch.ErrBadSum))
+
+		sum, herr := gitfetch.HashTree(filepath.Join(build, "src"))
+		require.NoError(t, herr)
+
+		assert.Contains(t, err.Error(), "has sum "+sum)
+
+		require.NoError(t, os.RemoveAll(filepath.Join(build, "src")))
+
+		co.Sum = sum
+
+		require.NoError(t, ev.Eval(co))
+	})
+
+	t.Run("names downloads missing from the cache when offline", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Cache:      dlcache.New(filepath.Join(filepath.Dir(build), "cache")),
+			Offline:    true,
+		})
+
+		h := sha256.Sum256([]byte("source"))
+
+		dl := &Download{
+			URL:  "http://example.com/src.tar.gz",
+			Path: "src.tar.gz",
+			Sum:  &KnownSum{Type: "sha256", Value: hex.EncodeToString(h[:])},
+		}
+
+		err := ev.Eval(&Statements{Statements: []EVTNode{dl}})
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, dlcache.ErrOffline))
+		assert.Contains(t, err.Error(), "http://example.com/src.tar.gz (sha256:"+hex.EncodeToString(h[:])+")")
+	})
+
+	t.Run("runs phases from and until the given ones", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, os.MkdirAll(filepath.Join(build, "src", "pkg-1.0"), 0755))
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&Phase{Name: "unpack", Body: &Statements{
+					Statements: []EVTNode{
+						&MakeDir{Dir: "unpacked"},
+						&SetRoot{Dir: "src"},
+						&SetEnv{Key: "STAGE", Value: "unpack"},
+					},
+				}},
+				&Phase{Name: "configure", Body: &Statements{
+					Statements: []EVTNode{
+						&Shell{Code: "echo $STAGE > configured"},
+					},
+				}},
+				&Phase{Name: "build", Body: &Statements{
+					Statements: []EVTNode{
+						&Shell{Code: "touch built"},
+					},
+				}},
+			},
+		}
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			FromPhase:  "configure",
+			UntilPhase: "configure",
+		})
+
+		require.NoError(t, ev.Eval(work))
+
+		_, err := os.Stat(filepath.Join(build, "unpacked"))
+		assert.True(t, os.IsNotExist(err))
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "src", "pkg-1.0", "configured"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "unpack\n", string(data))
+
+		_, err = os.Stat(filepath.Join(build, "src", "pkg-1.0", "built"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("manipulates files within chdir, glob and exists blocks", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, os.MkdirAll(filepath.Join(build, "src", "lib"), 0755))
+
+		for _, name := range []string{"liba.so", "libb.so", "liba.a"} {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(build, "src", "lib", name), []byte(name), 0644))
+		}
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&ChangeDir{Dir: "src", Body: &Statements{
+					Statements: []EVTNode{
+						&Copy{Source: "lib/*.so", Target: Prefix + "/lib"},
+						&Move{Source: "lib/liba.a", Target: Prefix + "/lib"},
+						&Glob{Pattern: Prefix + "/lib/*.so", Body: &Statements{
+							Statements: []EVTNode{
+								&Chmod{Path: Match, Mode: 0755},
+							},
+						}},
+						&Symlink{Target: "liba.so", Link: Prefix + "/lib/liba.so.1"},
+						&IfExists{Path: "missing", Body: &Statements{
+							Statements: []EVTNode{
+								&MakeDir{Dir: Prefix + "/missing"},
+							},
+						}},
+						&IfExists{Path: "lib", Body: &Statements{
+							Statements: []EVTNode{
+								&RemoveGlob{Pattern: "lib/*.so"},
+							},
+						}},
+					},
+				}},
+			},
+		}
+
+		require.NoError(t, ev.Eval(work))
+
+		fi, err := os.Stat(filepath.Join(out, "lib", "libb.so"))
+		require.NoError(t, err)
+
+		assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+		data, err := ioutil.ReadFile(filepath.Join(out, "lib", "liba.a"))
+		require.NoError(t, err)
+		assert.Equal(t, "liba.a", string(data))
+
+		target, err := os.Readlink(filepath.Join(out, "lib", "liba.so.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "liba.so", target)
+
+		_, err = os.Stat(filepath.Join(out, "missing"))
+		assert.True(t, os.IsNotExist(err))
+
+		left, err := ioutil.ReadDir(filepath.Join(build, "src", "lib"))
+		require.NoError(t, err)
+		assert.Len(t, left, 0)
+
+		err = ev.Eval(&Copy{Source: "nothing/*.h", Target: Prefix + "/include"})
+		assert.Error(t, err)
+	})
+
+	t.Run("refuses paths outside the work and output dirs", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(build, "a"), []byte("a"), 0644))
+		require.NoError(t, os.Mkdir(out+"-other", 0755))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		for _, stmt := range []EVTNode{
+			&Copy{Source: "a", Target: FSPath(out + "-other/a")},
+			&Copy{Source: "../a", Target: "b"},
+			&WriteFile{Target: "../out-other/c", Data: []byte("c")},
+		} {
+			err := ev.Eval(&Statements{Statements: []EVTNode{stmt}})
+			require.Error(t, err)
+
+			assert.True(t, errors.Is(err, ErrOutsidePath), err.Error())
+		}
+
+		_, err := os.Stat(filepath.Join(out+"-other", "a"))
+		assert.True(t, os.IsNotExist(err))
+
+		require.NoError(t, ev.Eval(&Copy{Source: "a", Target: FSPath(filepath.Join(out, "a"))}))
+	})
+
+	t.Run("copies links as links", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		lib := filepath.Join(build, "lib")
+
+		require.NoError(t, os.Mkdir(lib, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(lib, "libfoo.so.1"), []byte("foo"), 0644))
+		require.NoError(t, os.Symlink("libfoo.so.1", filepath.Join(lib, "libfoo.so")))
+		require.NoError(t, os.Symlink("missing", filepath.Join(lib, "dangling")))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		require.NoError(t, ev.Eval(&Copy{Source: "lib", Target: Prefix + "/lib"}))
+		require.NoError(t, ev.Eval(&Copy{Source: "lib/dangling", Target: Prefix + "/dangling"}))
+
+		target, err := os.Readlink(filepath.Join(out, "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		for _, path := range []string{"lib/dangling", "dangling"} {
+			target, err = os.Readlink(filepath.Join(out, path))
+			require.NoError(t, err)
+			assert.Equal(t, "missing", target)
+		}
+	})
+
+	t.Run("doesn't follow links out of the work and output dirs", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		host := filepath.Join(filepath.Dir(build), "host")
+		secret := filepath.Join(host, "secret")
+
+		require.NoError(t, os.Mkdir(host, 0755))
+		require.NoError(t, ioutil.WriteFile(secret, []byte("secret"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(build, "a"), []byte("a"), 0644))
+		require.NoError(t, os.Symlink(host, filepath.Join(build, "x")))
+		require.NoError(t, os.Symlink(secret, filepath.Join(build, "y")))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		for _, stmt := range []EVTNode{
+			&Copy{Source: "x/secret", Target: Prefix + "/secret"},
+			&Copy{Source: "x/*", Target: Prefix + "/host"},
+			&Copy{Source: "a", Target: "x/a"},
+			&Move{Source: "x/secret", Target: Prefix + "/secret"},
+			&Chmod{Path: "x/secret", Mode: 0777},
+			&Chmod{Path: "y", Mode: 0777},
+			&RemoveGlob{Pattern: "x/*"},
+		} {
+			err := ev.Eval(&Statements{Statements: []EVTNode{stmt}})
+			require.Error(t, err)
+
+			assert.True(t, errors.Is(err, ErrOutsidePath), err.Error())
+		}
+
+		fi, err := os.Stat(secret)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+		entries, err := ioutil.ReadDir(host)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		entries, err = ioutil.ReadDir(out)
+		require.NoError(t, err)
+		assert.Len(t, entries, 0)
+
+		require.NoError(t, ev.Eval(&Copy{Source: "y", Target: Prefix + "/y"}))
+
+		target, err := os.Readlink(filepath.Join(out, "y"))
+		require.NoError(t, err)
+		assert.Equal(t, secret, target)
+	})
+
+	t.Run("substitutes placeholders and wraps programs", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, os.MkdirAll(filepath.Join(out, "bin"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(out, "bin", "tool"), []byte("#!/bin/sh\necho \"$TOOL_DATA $PATH\"\n"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(build, "tool.conf"), []byte("prefix=@prefix@\n"), 0644))
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+		})
+
+		work := &Statements{
+			Statements: []EVTNode{
+				&Substitute{File: "tool.conf", Vars: map[string]string{"prefix": Prefix}},
+				&WrapProgram{
+					Program:    Prefix + "/bin/tool",
+					SetEnv:     map[string]string{"TOOL_DATA": Prefix + "/share/it's"},
+					PrefixPath: []string{Prefix + "/libexec"},
+				},
+			},
+		}
+
+		require.NoError(t, ev.Eval(work))
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "tool.conf"))
+		require.NoError(t, err)
+		assert.Equal(t, "prefix="+out+"\n", string(data))
+
+		cmd := exec.Command(filepath.Join(out, "bin", "tool"))
+		cmd.Env = []string{"PATH=/bin"}
+
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		assert.Equal(t, out+"/share/it's "+out+"/libexec:/bin\n", string(output))
+
+		err = ev.Eval(&Substitute{File: "tool.conf", Vars: map[string]string{"prefix": Prefix}})
+		assert.Error(t, err)
+
+		err = ev.Eval(&WrapProgram{Program: Prefix + "/bin/tool"})
+		assert.Error(t, err)
+	})
+
+	t.Run("terminates the process group when cancelled", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Context:    ctx,
+		})
+
+		start := time.Now()
+
+		err := ev.Eval(&Statements{
+			Statements: []EVTNode{
+				&Shell{Code: "sleep 30 & echo $! > child; wait"},
+				&MakeDir{Dir: "never"},
+			},
+		})
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.True(t, time.Since(start) < 10*time.Second)
+
+		data, err := ioutil.ReadFile(filepath.Join(build, "child"))
+		require.NoError(t, err)
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool { return processGone(pid) }, 5*time.Second, 50*time.Millisecond)
+
+		_, err = os.Stat(filepath.Join(build, "never"))
+		assert.Error(t, err)
+	})
+
+	t.Run("kills commands that ignore SIGTERM after the grace period", func(t *testing.T) {
+		build, out, cleanup := setup(t)
+		defer cleanup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: build,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin"},
+			Context:    ctx,
+			KillGrace:  100 * time.Millisecond,
+		})
+
+		start := time.Now()
+
+		err := ev.Eval(&Statements{
+			Statements: []EVTNode{
+				&Shell{Code: "trap '' TERM; sleep 30"},
+			},
+		})
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.True(t, time.Since(start) < 10*time.Second)
+	})
+}
+
+// processGone returns true if pid has exited, including if it's a zombie
+// waiting to be reaped by init.
+func processGone(pid int) bool {
+	if syscall.Kill(pid, 0) == syscall.ESRCH {
+		return true
+	}
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(data), ") Z ")
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := []string{"HOME=/home", "PATH=/bin"}
+
+	env = ApplyEnv(env, &SetEnv{Prepend: true, Key: "PATH", Value: "/a/bin"})
+	env = ApplyEnv(env, &SetEnv{Append: true, Key: "PATH", Value: "/usr/bin"})
+	env = ApplyEnv(env, &SetEnv{Key: "HOME", Value: "/other"})
+	env = ApplyEnv(env, &SetEnv{Append: true, Key: "CPATH", Value: "/a/include"})
+
+	assert.Equal(t, []string{"HOME=/other", "PATH=/a/bin:/bin:/usr/bin", "CPATH=/a/include"}, env)
+}
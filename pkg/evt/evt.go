@@ -1,12 +1,41 @@
 package evt
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
 	"regexp"
 	"strings"
+
+	"github.com/lab47/chell/pkg/dlcache"
 )
 
 type FSPath string
 
+// Placeholders used in place of the real directories when a work tree is
+// calculated. They keep the tree (and so the package signature) independent
+// of where a build happens to run, and are expanded by the Evaluator.
+const (
+	TopDir   = "$top"
+	BuildDir = "$build"
+	Prefix   = "$prefix"
+)
+
+// Jobs is the placeholder for the number of jobs commands should run in
+// parallel, which depends on the machine a package is built on.
+const Jobs = "$jobs"
+
+// Match is the placeholder for the path matched by the Glob a statement is
+// within.
+const Match = "$match"
+
+// Output returns the placeholder for the store dir of the named output of
+// a package, other than it's main one which is Prefix.
+func Output(name string) string {
+	return "$output(" + name + ")"
+}
+
 type EVTNode interface {
 	evtNode()
 }
@@ -74,10 +103,25 @@ type KnownSum struct {
 	Value string
 }
 
+// String returns the sum as it was declared, as type:value.
+func (k *KnownSum) String() string {
+	return k.Type + ":" + k.Value
+}
+
+// Decode returns the sum used to verify the download and look it up in a
+// download cache.
+func (k *KnownSum) Decode() (dlcache.Sum, error) {
+	return dlcache.ParseSum(k.Type, k.Value)
+}
+
 type Download struct {
 	URL  string
 	Path FSPath
 	Sum  *KnownSum
+
+	// Other URLs to try in turn if URL fails. They're not part of the
+	// hash, as where a file comes from doesn't change what it is.
+	Mirrors []string `hash:"ignore"`
 }
 
 type InstallFiles struct {
@@ -91,6 +135,79 @@ type WriteFile struct {
 	Data   []byte
 }
 
+// GitCheckout writes the tree of Rev in the git repo at URL to Dir, without
+// the git metadata, failing unless the tree's sum is Sum.
+type GitCheckout struct {
+	URL string
+	Rev string
+	Dir FSPath
+	Sum string
+}
+
+// Copy copies Source to Target, recursively for dirs. Source may be a glob
+// pattern, in which case the matches are copied into the Target dir.
+type Copy struct {
+	Source FSPath
+	Target FSPath
+}
+
+// Move moves Source to Target, or into Target if it's a dir.
+type Move struct {
+	Source FSPath
+	Target FSPath
+}
+
+type Chmod struct {
+	Path FSPath
+	Mode os.FileMode
+}
+
+// Symlink creates a symlink at Link pointing to Target. Target is used as
+// is, so it may be relative to Link's dir.
+type Symlink struct {
+	Target string
+	Link   FSPath
+}
+
+type RemoveGlob struct {
+	Pattern FSPath
+}
+
+// IfExists runs Body only if Path exists.
+type IfExists struct {
+	Path FSPath
+	Body EVTNode
+}
+
+// Glob runs Body once for each path matching Pattern, with Match expanded
+// to the path.
+type Glob struct {
+	Pattern FSPath
+	Body    EVTNode
+}
+
+// Substitute replaces each @name@ in File with the value of name in Vars.
+type Substitute struct {
+	File FSPath
+	Vars map[string]string
+}
+
+// WrapProgram moves Program aside and replaces it with a script that sets
+// the variables in SetEnv and adds PrefixPath to the front of PATH before
+// running it.
+type WrapProgram struct {
+	Program    FSPath
+	SetEnv     map[string]string
+	PrefixPath []string
+}
+
+// Phase is a named part of a build, such as configure, that can be stopped
+// after or resumed from.
+type Phase struct {
+	Name string
+	Body *Statements
+}
+
 func (s *Statements) evtNode()   {}
 func (s *System) evtNode()       {}
 func (s *SetRoot) evtNode()      {}
@@ -106,3 +223,168 @@ func (s *Unpack) evtNode()       {}
 func (s *Download) evtNode()     {}
 func (s *InstallFiles) evtNode() {}
 func (s *WriteFile) evtNode()    {}
+func (s *Phase) evtNode()        {}
+func (s *GitCheckout) evtNode()  {}
+func (s *Copy) evtNode()         {}
+func (s *Move) evtNode()         {}
+func (s *Chmod) evtNode()        {}
+func (s *Symlink) evtNode()      {}
+func (s *RemoveGlob) evtNode()   {}
+func (s *IfExists) evtNode()     {}
+func (s *Glob) evtNode()         {}
+func (s *Substitute) evtNode()   {}
+func (s *WrapProgram) evtNode()  {}
+
+// Downloads returns all the Download statements within n.
+func Downloads(n EVTNode) []*Download {
+	switch n := n.(type) {
+	case *Download:
+		return []*Download{n}
+	case *Statements:
+		var dls []*Download
+
+		for _, stmt := range n.Statements {
+			dls = append(dls, Downloads(stmt)...)
+		}
+
+		return dls
+	case *Phase:
+		return Downloads(n.Body)
+	case *ChangeDir:
+		return Downloads(n.Body)
+	case *IfExists:
+		return Downloads(n.Body)
+	case *Glob:
+		return Downloads(n.Body)
+	}
+
+	return nil
+}
+
+// Describe returns a short, single line summary of n, suitable for showing
+// to users as progress.
+func Describe(n EVTNode) string {
+	switch n := n.(type) {
+	case *Statements:
+		return fmt.Sprintf("%d statements", len(n.Statements))
+	case *System:
+		return "system: " + strings.Join(n.Arguments, " ")
+	case *Shell:
+		code := strings.TrimSpace(n.Code)
+		if idx := strings.IndexByte(code, '\n'); idx != -1 {
+			code = code[:idx] + " ..."
+		}
+		return "shell: " + code
+	case *SetRoot:
+		return "set_root: " + string(n.Dir)
+	case *ChangeDir:
+		return "chdir: " + string(n.Dir)
+	case *MakeDir:
+		return "mkdir: " + string(n.Dir)
+	case *Patch:
+		return "apply_patch"
+	case *Replace:
+		return "inreplace: " + string(n.File)
+	case *Rmrf:
+		return "rm_rf: " + n.Target
+	case *SetEnv:
+		return "set_env: " + n.Key
+	case *Link:
+		return fmt.Sprintf("link: %s => %s", n.Original, n.Target)
+	case *Unpack:
+		return "unpack: " + string(n.Path)
+	case *Download:
+		return "download: " + n.URL
+	case *InstallFiles:
+		return fmt.Sprintf("install_files: %s => %s", n.Pattern, n.Target)
+	case *WriteFile:
+		return "write_file: " + string(n.Target)
+	case *Phase:
+		return "phase: " + n.Name
+	case *GitCheckout:
+		return fmt.Sprintf("git: %s at %s", n.URL, n.Rev)
+	case *Copy:
+		return fmt.Sprintf("copy: %s => %s", n.Source, n.Target)
+	case *Move:
+		return fmt.Sprintf("move: %s => %s", n.Source, n.Target)
+	case *Chmod:
+		return fmt.Sprintf("chmod: %s %o", n.Path, n.Mode)
+	case *Symlink:
+		return fmt.Sprintf("symlink: %s => %s", n.Link, n.Target)
+	case *RemoveGlob:
+		return "remove_glob: " + string(n.Pattern)
+	case *IfExists:
+		return "exists: " + string(n.Path)
+	case *Glob:
+		return "glob: " + string(n.Pattern)
+	case *Substitute:
+		return "substitute: " + string(n.File)
+	case *WrapProgram:
+		return "wrap_program: " + string(n.Program)
+	default:
+		return fmt.Sprintf("%T", n)
+	}
+}
+
+// Flatten returns a line for each statement within n, giving it's type and
+// the fields that are hashed, so that trees can be compared line by line.
+// The statements in the body of a block, such as a chdir, follow it's line
+// and are indented below it.
+func Flatten(n EVTNode) []string {
+	return flatten(nil, n, "")
+}
+
+func flatten(lines []string, n EVTNode, indent string) []string {
+	if st, ok := n.(*Statements); ok {
+		if st == nil {
+			return lines
+		}
+
+		for _, stmt := range st.Statements {
+			lines = flatten(lines, stmt, indent)
+		}
+
+		return lines
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(n))
+	if !v.IsValid() {
+		return lines
+	}
+
+	t := v.Type()
+
+	var (
+		fields = make(map[string]interface{})
+		bodies []EVTNode
+	)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("hash") == "ignore" {
+			continue
+		}
+
+		fv := v.Field(i).Interface()
+
+		if body, ok := fv.(EVTNode); ok {
+			bodies = append(bodies, body)
+			continue
+		}
+
+		fields[f.Name] = fv
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		data = []byte(fmt.Sprintf("%v", fields))
+	}
+
+	lines = append(lines, indent+t.Name()+" "+string(data))
+
+	for _, body := range bodies {
+		lines = flatten(lines, body, indent+"  ")
+	}
+
+	return lines
+}
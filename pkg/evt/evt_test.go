@@ -0,0 +1,26 @@
+package evt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatten(t *testing.T) {
+	lines := Flatten(&Statements{
+		Statements: []EVTNode{
+			&System{Arguments: []string{"make"}},
+			&ChangeDir{Dir: "src", Body: &Statements{
+				Statements: []EVTNode{
+					&Download{URL: "http://example.com/a", Path: "a", Mirrors: []string{"http://mirror/a"}},
+				},
+			}},
+		},
+	})
+
+	assert.Equal(t, []string{
+		`System {"Arguments":["make"],"Dir":""}`,
+		`ChangeDir {"Dir":"src"}`,
+		`  Download {"Path":"a","Sum":null,"URL":"http://example.com/a"}`,
+	}, lines)
+}
@@ -92,6 +92,16 @@ func TestHash(t *testing.T) {
 		assertDiff(t, a{"name": "bar", "age": 12}, a{"name": "bar", "age": 120})
 	})
 
+	t.Run("statements with the same fields differ by type", func(t *testing.T) {
+		assertDiff(t, &Copy{Source: "a", Target: "b"}, &Move{Source: "a", Target: "b"})
+		assertDiff(t, &Chmod{Path: "a", Mode: 0755}, &Chmod{Path: "a", Mode: 0644})
+
+		assertDiff(t,
+			&Glob{Pattern: "*.so", Body: &Statements{Statements: []EVTNode{&Chmod{Path: Match, Mode: 0755}}}},
+			&Glob{Pattern: "*.so", Body: &Statements{Statements: []EVTNode{&Chmod{Path: Match, Mode: 0555}}}},
+		)
+	})
+
 	t.Run("slices are not a set", func(t *testing.T) {
 		assertSame(t, []string{"foo", "bar"}, []string{"foo", "bar"})
 		assertDiff(t, []string{"foo", "bar"}, []string{"bar", "foo"})
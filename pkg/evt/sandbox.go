@@ -0,0 +1,71 @@
+package evt
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSandboxUnsupported = errors.New("build sandbox not supported on this platform")
+	ErrNoUserNamespaces   = errors.New("unprivileged user namespaces are unavailable")
+)
+
+// SandboxFailed is the exit status of an isolated command when the sandbox
+// or network couldn't be setup for it.
+const SandboxFailed = 125
+
+// Sandbox restricts what a command run by the Evaluator can see of the
+// filesystem. Only the top dir, the output dir and Paths are visible to the
+// command, so anything used by the build that wasn't declared fails rather
+// than being picked up from the host.
+type Sandbox struct {
+	// Paths made visible read-only, usually the store dirs of the
+	// build dependencies.
+	Paths []string
+
+	// A shell on the host to make available as /bin/sh. When set, it's
+	// also used to run shell statements.
+	Shell string
+}
+
+// sandboxConfig is passed from the Evaluator to the isolated child process
+// so it can setup the filesystem and network before running the actual
+// command. Root and Binds are empty when only the network is isolated.
+type sandboxConfig struct {
+	Root           string        `json:"root"`
+	Binds          []sandboxBind `json:"binds"`
+	IsolateNetwork bool          `json:"isolate_network"`
+	Dir            string        `json:"dir"`
+	Path           string        `json:"path"`
+	Args           []string      `json:"args"`
+	Env            []string      `json:"env"`
+}
+
+type sandboxBind struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// binds returns the mounts that make up the sandbox for an evaluator with
+// the given top and output dirs.
+func (s *Sandbox) binds(top string, outdirs ...string) []sandboxBind {
+	binds := []sandboxBind{
+		{Source: "/dev", Target: "/dev"},
+		{Source: "/proc", Target: "/proc"},
+		{Source: top, Target: top},
+	}
+
+	for _, dir := range outdirs {
+		binds = append(binds, sandboxBind{Source: dir, Target: dir})
+	}
+
+	for _, path := range s.Paths {
+		binds = append(binds, sandboxBind{Source: path, Target: path, ReadOnly: true})
+	}
+
+	if s.Shell != "" {
+		binds = append(binds, sandboxBind{Source: s.Shell, Target: "/bin/sh", ReadOnly: true})
+	}
+
+	return binds
+}
@@ -0,0 +1,312 @@
+package evt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sandboxArg0 = "chell-sandbox"
+	sandboxEnv  = "_CHELL_SANDBOX"
+)
+
+// isolate changes cmd to run inside the sandbox and/or without network
+// access. The command is started as a copy of the current executable in new
+// namespaces, which SandboxInit picks up to setup the mounts and network
+// before running the original command. The returned function should be
+// called once cmd has finished.
+func (e *Evaluator) isolate(cmd *exec.Cmd) (func(), error) {
+	err := checkUserNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := sandboxConfig{
+		IsolateNetwork: e.isolateNetwork,
+		Dir:            cmd.Dir,
+		Path:           cmd.Path,
+		Args:           cmd.Args,
+		Env:            cmd.Env,
+	}
+
+	flags := syscall.CLONE_NEWUSER
+	cleanup := func() {}
+
+	if e.sandbox != nil {
+		root, err := ioutil.TempDir("", "chell-sandbox")
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Root = root
+		cfg.Binds = e.sandbox.binds(e.top, append([]string{e.outdir}, e.outputs...)...)
+
+		flags |= syscall.CLONE_NEWNS
+		cleanup = func() { os.Remove(root) }
+	}
+
+	if e.isolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	data, err := json.Marshal(&cfg)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{sandboxArg0}
+	cmd.Env = []string{sandboxEnv + "=" + string(data)}
+	// The child runs as root in the namespace so it's able to mount, while
+	// being the calling user outside of it. setgroups must be denied for an
+	// unprivileged user to write the gid mapping.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: uintptr(flags),
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+	}
+
+	return cleanup, nil
+}
+
+// checkUserNamespaces returns ErrNoUserNamespaces if the kernel settings
+// stop the current user creating a user namespace, so that isolate fails
+// with a clear error rather than the command failing to start.
+func checkUserNamespaces() error {
+	if os.Getuid() != 0 && readSysctl("kernel/unprivileged_userns_clone") == "0" {
+		return errors.Wrapf(ErrNoUserNamespaces, "kernel.unprivileged_userns_clone is 0")
+	}
+
+	if readSysctl("user/max_user_namespaces") == "0" {
+		return errors.Wrapf(ErrNoUserNamespaces, "user.max_user_namespaces is 0")
+	}
+
+	return nil
+}
+
+// readSysctl returns the value of the sysctl name, or an empty string if
+// it's not available.
+func readSysctl(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// startError explains err from starting an isolated command. The kernel
+// refuses to create the namespaces with EPERM, or EINVAL and ENOSPC when
+// user namespaces are disabled or limited, for reasons checkUserNamespaces
+// can't detect, such as a seccomp policy.
+func startError(err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+
+	switch errno {
+	case syscall.EPERM, syscall.EINVAL, syscall.ENOSPC, syscall.EUSERS:
+		return errors.Wrapf(ErrNoUserNamespaces, "%s", err)
+	default:
+		return err
+	}
+}
+
+// SandboxInit must be called at the start of main. When the process was
+// started to run an isolated command, it sets up the sandbox and network
+// and runs the command in place of the current process, never returning.
+// Failing to setup the sandbox exits with SandboxFailed, while failing to
+// run the command exits with 127, as a shell does.
+func SandboxInit() {
+	if len(os.Args) == 0 || os.Args[0] != sandboxArg0 {
+		return
+	}
+
+	cfg, err := setupSandbox()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chell sandbox: %s\n", err)
+		os.Exit(SandboxFailed)
+	}
+
+	err = syscall.Exec(cfg.Path, cfg.Args, cfg.Env)
+
+	fmt.Fprintf(os.Stderr, "chell sandbox: unable to exec %s: %s\n", cfg.Path, err)
+	os.Exit(127)
+}
+
+func setupSandbox() (*sandboxConfig, error) {
+	var cfg sandboxConfig
+
+	err := json.Unmarshal([]byte(os.Getenv(sandboxEnv)), &cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode sandbox config")
+	}
+
+	if cfg.Root != "" {
+		err = setupFilesystem(&cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.IsolateNetwork {
+		err = loopbackUp()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to setup loopback")
+		}
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "/"
+	}
+
+	err = syscall.Chdir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to change to %s", dir)
+	}
+
+	return &cfg, nil
+}
+
+func setupFilesystem(cfg *sandboxConfig) error {
+	// Keep the mounts below from propagating back to the host.
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return errors.Wrapf(err, "unable to make mounts private")
+	}
+
+	err = syscall.Mount("tmpfs", cfg.Root, "tmpfs", 0, "mode=0755")
+	if err != nil {
+		return errors.Wrapf(err, "unable to mount sandbox root")
+	}
+
+	// Mounted before the binds, as the build dir usually lives in /tmp.
+	tmp := filepath.Join(cfg.Root, "tmp")
+
+	err = os.MkdirAll(tmp, 0777)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount("tmpfs", tmp, "tmpfs", 0, "mode=1777")
+	if err != nil {
+		return errors.Wrapf(err, "unable to mount /tmp")
+	}
+
+	for _, b := range cfg.Binds {
+		err = bindMount(cfg.Root, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = syscall.Chroot(cfg.Root)
+	if err != nil {
+		return errors.Wrapf(err, "unable to chroot")
+	}
+
+	return nil
+}
+
+// Flags that a read-only remount must keep, as they're locked on mounts
+// inherited from the parent namespace.
+const lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+func bindMount(root string, b sandboxBind) error {
+	fi, err := os.Stat(b.Source)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, b.Target)
+
+	if fi.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(target, nil, 0755)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount(b.Source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return errors.Wrapf(err, "unable to mount %s", b.Source)
+	}
+
+	if !b.ReadOnly {
+		return nil
+	}
+
+	var st syscall.Statfs_t
+
+	err = syscall.Statfs(b.Source, &st)
+	if err != nil {
+		return err
+	}
+
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY |
+		(uintptr(st.Flags) & lockedMountFlags)
+
+	err = syscall.Mount("", target, "", flags, "")
+	if err != nil {
+		return errors.Wrapf(err, "unable to make %s read-only", b.Source)
+	}
+
+	return nil
+}
+
+// loopbackUp brings up the loopback interface, the only one present in a
+// new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+
+	copy(ifr.name[:], "lo")
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+
+	ifr.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
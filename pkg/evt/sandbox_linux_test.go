@@ -0,0 +1,204 @@
+package evt
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	SandboxInit()
+
+	// Run by the sandbox tests as the sandboxed command.
+	if out := os.Getenv("EVT_SANDBOX_HELPER"); out != "" {
+		if _, err := os.Stat("/usr/bin"); err == nil {
+			os.Exit(2)
+		}
+
+		err := ioutil.WriteFile(filepath.Join(out, "ok"), []byte("ok"), 0644)
+		if err != nil {
+			os.Exit(3)
+		}
+
+		os.Exit(0)
+	}
+
+	if os.Getenv("EVT_NETWORK_HELPER") != "" {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			os.Exit(2)
+		}
+
+		if len(ifaces) != 1 || ifaces[0].Name != "lo" || ifaces[0].Flags&net.FlagUp == 0 {
+			os.Exit(3)
+		}
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestSandbox(t *testing.T) {
+	setup := func(t *testing.T, paths ...string) (*Evaluator, string, *bytes.Buffer) {
+		top, err := ioutil.TempDir("", "evt")
+		require.NoError(t, err)
+
+		t.Cleanup(func() { os.RemoveAll(top) })
+
+		out := filepath.Join(top, "out")
+		require.NoError(t, os.Mkdir(out, 0755))
+
+		dep, err := ioutil.TempDir("", "evt-dep")
+		require.NoError(t, err)
+
+		t.Cleanup(func() { os.RemoveAll(dep) })
+
+		var log bytes.Buffer
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir: top,
+			OutputDir:  out,
+			Environ:    []string{"PATH=/bin:/usr/bin", "EVT_SANDBOX_HELPER=" + out},
+			Log:        &log,
+			Sandbox: &Sandbox{
+				Paths: append(append([]string{dep}, libDirs(t)...), paths...),
+				Shell: "/bin/sh",
+			},
+		})
+
+		return ev, out, &log
+	}
+
+	t.Run("hides paths that weren't declared", func(t *testing.T) {
+		ev, _, log := setup(t)
+
+		err := ev.Eval(&System{Arguments: []string{"/usr/bin/env"}})
+		require.Error(t, err)
+
+		skipUnsupported(t, err)
+
+		assert.Equal(t, 127, ExitStatus(err))
+		assert.Contains(t, log.String(), "chell sandbox: unable to exec /usr/bin/env")
+	})
+
+	t.Run("exposes the build and output dirs", func(t *testing.T) {
+		ev, out, log := setup(t)
+
+		err := ev.Eval(&System{Arguments: []string{"/proc/self/exe"}})
+		skipUnsupported(t, err)
+
+		require.NoError(t, err, log.String())
+
+		data, err := ioutil.ReadFile(filepath.Join(out, "ok"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "ok", string(data))
+	})
+
+	t.Run("runs shell statements with the declared shell", func(t *testing.T) {
+		ev, out, log := setup(t)
+
+		err := ev.Eval(&Shell{Code: "test ! -e /usr/bin && echo ok > " + out + "/sh"})
+		skipUnsupported(t, err)
+
+		require.NoError(t, err, log.String())
+
+		data, err := ioutil.ReadFile(filepath.Join(out, "sh"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "ok\n", string(data))
+	})
+
+	t.Run("exits with SandboxFailed when it can't be setup", func(t *testing.T) {
+		ev, _, log := setup(t, "/does/not/exist")
+
+		err := ev.Eval(&System{Arguments: []string{"/proc/self/exe"}})
+		require.Error(t, err)
+
+		skipUnsupported(t, err)
+
+		assert.Equal(t, SandboxFailed, ExitStatus(err))
+		assert.Contains(t, log.String(), "chell sandbox: ")
+	})
+
+	t.Run("reports when user namespaces are unavailable", func(t *testing.T) {
+		err := startError(&os.PathError{Op: "fork/exec", Path: "/proc/self/exe", Err: syscall.EPERM})
+		assert.True(t, errors.Is(err, ErrNoUserNamespaces))
+
+		err = startError(&os.PathError{Op: "fork/exec", Path: "/proc/self/exe", Err: syscall.ENOENT})
+		assert.False(t, errors.Is(err, ErrNoUserNamespaces))
+	})
+
+	t.Run("runs commands with only loopback", func(t *testing.T) {
+		top, err := ioutil.TempDir("", "evt")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(top)
+
+		ev := NewEvaluator(hclog.L(), EvaluatorEnv{
+			WorkingDir:     top,
+			OutputDir:      top,
+			Environ:        []string{"EVT_NETWORK_HELPER=1"},
+			IsolateNetwork: true,
+		})
+
+		err = ev.Eval(&System{Arguments: []string{"/proc/self/exe"}})
+		skipUnsupported(t, err)
+
+		require.NoError(t, err)
+	})
+}
+
+func skipUnsupported(t *testing.T, err error) {
+	if errors.Is(err, ErrNoUserNamespaces) {
+		t.Skipf("unable to create namespaces: %s", err)
+	}
+}
+
+// libDirs returns the dirs the dynamic loader and shared libraries of the
+// test binary and /bin/sh are usually in, so they're able to run in the
+// sandbox.
+func libDirs(t *testing.T) []string {
+	dirs := []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"}
+
+	f, err := elf.Open("/proc/self/exe")
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(p.Open())
+		require.NoError(t, err)
+
+		dirs = append(dirs, filepath.Dir(strings.TrimRight(string(data), "\x00")))
+	}
+
+	var found []string
+
+	seen := make(map[string]bool)
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil && !seen[dir] {
+			seen[dir] = true
+			found = append(found, dir)
+		}
+	}
+
+	return found
+}
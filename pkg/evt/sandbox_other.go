@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package evt
+
+import "os/exec"
+
+// isolate only supports the sandbox on Linux. Network isolation isn't
+// available either, so commands run with the network as usual.
+func (e *Evaluator) isolate(cmd *exec.Cmd) (func(), error) {
+	if e.sandbox != nil {
+		return nil, ErrSandboxUnsupported
+	}
+
+	return func() {}, nil
+}
+
+func startError(err error) error {
+	return err
+}
+
+// SandboxInit must be called at the start of main. The sandbox is only
+// available on Linux, so there is nothing to do here.
+func SandboxInit() {}
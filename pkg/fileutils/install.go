@@ -23,7 +23,7 @@ func (i *Install) Install() error {
 		i.L = hclog.L()
 	}
 
-	_, err := os.Stat(i.Pattern)
+	_, err := os.Lstat(i.Pattern)
 	if err == nil {
 		os.MkdirAll(filepath.Dir(i.Dest), 0755)
 		if i.Linked {
@@ -90,18 +90,28 @@ func (i *Install) Install() error {
 func (i *Install) copyEntry(from, to string) error {
 	i.L.Debug("copy entry", "from", from, "to", to)
 
-	f, err := os.Open(from)
+	// Links are copied as links, rather than what they point to.
+	fi, err := os.Lstat(from)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
 
-	fi, err := f.Stat()
+		return os.Symlink(link, to)
+	}
+
+	f, err := os.Open(from)
 	if err != nil {
 		return err
 	}
 
+	defer f.Close()
+
 	defer func() {
 		// fix the times
 		os.Chtimes(to, time.Time{}, fi.ModTime())
@@ -153,14 +163,6 @@ func (i *Install) copyEntry(from, to string) error {
 				return err
 			}
 		}
-
-	case os.ModeSymlink:
-		link, err := os.Readlink(from)
-		if err != nil {
-			return err
-		}
-
-		return os.Symlink(link, to)
 	}
 
 	return nil
@@ -176,4 +176,31 @@ func TestInstall(t *testing.T) {
 		assertFile(t, "b/nf", "this is a file")
 	})
 
+	t.Run("copies links as links", func(t *testing.T) {
+		defer cleanup()
+
+		wf("a/lib/libfoo.so.1", "this is a lib")
+
+		require.NoError(t, os.Symlink("libfoo.so.1", filepath.Join(tmpdira, "lib", "libfoo.so")))
+		require.NoError(t, os.Symlink("missing", filepath.Join(tmpdira, "lib", "dangling")))
+
+		in := &Install{
+			L:       L,
+			Pattern: filepath.Join(tmpdira, "lib"),
+			Dest:    filepath.Join(tmpdirb, "lib"),
+		}
+
+		err := in.Install()
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(tmpdirb, "lib", "libfoo.so"))
+		require.NoError(t, err)
+		assert.Equal(t, "libfoo.so.1", target)
+
+		target, err = os.Readlink(filepath.Join(tmpdirb, "lib", "dangling"))
+		require.NoError(t, err)
+		assert.Equal(t, "missing", target)
+
+		assertFile(t, "b/lib/libfoo.so.1", "this is a lib")
+	})
 }
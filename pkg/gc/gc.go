@@ -222,6 +222,7 @@ func (c *Collector) removePackage(name string, sr *SweepResult) error {
 	})
 
 	os.Remove(root + ".json")
+	os.Remove(filepath.Join(c.dataDir, "sigs", name+".json"))
 
 	return os.RemoveAll(root)
 }
@@ -0,0 +1,360 @@
+package gitfetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/mr-tron/base58"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	ErrBadSum     = errors.New("git checkout doesn't match sum")
+	ErrNotFetched = errors.New("revision has not been fetched")
+)
+
+// Fetcher checks out revisions of git repos, keeping a bare clone of each
+// repo so that fetching it again only transfers the new objects.
+type Fetcher struct {
+	// Directory to keep the clones in. If empty, repos are cloned into a
+	// temporary dir that's removed afterwards.
+	Dir string
+
+	// Only use revisions that have already been fetched, failing with
+	// ErrNotFetched for any others.
+	NoFetch bool
+}
+
+var refSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// Checkout writes the tree of rev, a commit, branch or tag, in the repo at
+// url to dest, without any of the git metadata. It returns the hash of the
+// commit checked out.
+func (f *Fetcher) Checkout(ctx context.Context, url, rev, dest string) (string, error) {
+	dir := f.Dir
+
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "chell-git")
+		if err != nil {
+			return "", err
+		}
+
+		defer os.RemoveAll(tmp)
+
+		dir = tmp
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := repoPath(dir, url)
+
+	// Packages built in parallel, by this process or others, may fetch
+	// different revisions of the same repo.
+	lock, err := lockRepo(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	defer unlockRepo(lock)
+
+	repo, err := f.open(path, url)
+	if err != nil {
+		return "", err
+	}
+
+	var commit *object.Commit
+
+	// Branches and tags can move, so they're fetched again unless NoFetch
+	// is set, whereas a commit is only fetched if it's not in the clone.
+	if f.NoFetch || commitRe.MatchString(rev) {
+		commit, err = resolve(repo, rev)
+		if err != nil && f.NoFetch {
+			return "", errors.Wrapf(ErrNotFetched, "%s at %s", url, rev)
+		}
+	}
+
+	if commit == nil {
+		err = repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: "origin",
+			RefSpecs:   refSpecs,
+			Tags:       git.AllTags,
+			Force:      true,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return "", errors.Wrapf(err, "unable to fetch %s", url)
+		}
+
+		commit, err = resolve(repo, rev)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to find %s in %s", rev, url)
+		}
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	err = export(repo, tree, dest)
+	if err != nil {
+		return "", err
+	}
+
+	return commit.Hash.String(), nil
+}
+
+const repoLockPoll = 100 * time.Millisecond
+
+// lockRepo locks the clone at path, waiting until whoever else is using it
+// is done.
+func lockRepo(ctx context.Context, path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrapf(err, "unable to lock %s", path)
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(repoLockPoll):
+		}
+	}
+}
+
+func unlockRepo(f *os.File) error {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return f.Close()
+}
+
+func repoPath(dir, url string) string {
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte(url))
+
+	return filepath.Join(dir, base58.Encode(h.Sum(nil)))
+}
+
+// open opens the clone of url at path, creating it if there isn't one yet.
+func (f *Fetcher) open(path, url string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(path)
+	if err == nil {
+		return repo, nil
+	}
+
+	if err != git.ErrRepositoryNotExists {
+		return nil, err
+	}
+
+	repo, err = git.PlainInit(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{url},
+		Fetch: refSpecs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolve returns the commit that rev refers to, peeling annotated tags.
+func resolve(repo *git.Repository, rev string) (*object.Commit, error) {
+	var hash plumbing.Hash
+
+	if commitRe.MatchString(rev) {
+		hash = plumbing.NewHash(rev)
+	} else {
+		h, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, err
+		}
+
+		hash = *h
+	}
+
+	if tag, err := repo.TagObject(hash); err == nil {
+		return tag.Commit()
+	}
+
+	return repo.CommitObject(hash)
+}
+
+// export writes the files in tree to dest. Submodules aren't fetched, so
+// they're left as empty dirs.
+func export(repo *git.Repository, tree *object.Tree, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, name)
+
+		switch entry.Mode {
+		case filemode.Dir, filemode.Submodule:
+			err = os.MkdirAll(path, 0755)
+		case filemode.Symlink:
+			err = exportSymlink(repo, entry.Hash, path)
+		case filemode.Executable:
+			err = exportFile(repo, entry.Hash, path, 0755)
+		default:
+			err = exportFile(repo, entry.Hash, path, 0644)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "unable to export %s", name)
+		}
+	}
+}
+
+func exportFile(repo *git.Repository, hash plumbing.Hash, path string, perm os.FileMode) error {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func exportSymlink(repo *git.Repository, hash plumbing.Hash, path string) error {
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	target, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(string(target), path)
+}
+
+// HashTree returns the sum of the files under dir. Only their paths
+// relative to dir, contents, whether they're executable and the targets of
+// symlinks are hashed, so the sum is the same wherever the tree is.
+func HashTree(dir string) (string, error) {
+	h, _ := blake2b.New256(nil)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(h, "link: %s %s\n", rel, target)
+		case info.IsDir():
+			fmt.Fprintf(h, "dir: %s\n", rel)
+		case info.Mode().IsRegular():
+			fmt.Fprintf(h, "file: %s %t %d\n", rel, info.Mode()&0111 != 0, info.Size())
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			_, err = io.Copy(h, f)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return base58.Encode(h.Sum(nil)), nil
+}
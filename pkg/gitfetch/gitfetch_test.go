@@ -0,0 +1,153 @@
+package gitfetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func commitFiles(t *testing.T, repo *git.Repository, dir string, files map[string]string) string {
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+		_, err = wt.Add(name)
+		require.NoError(t, err)
+	}
+
+	h, err := wt.Commit("update", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+
+	return h.String()
+}
+
+func TestFetcher(t *testing.T) {
+	top, err := ioutil.TempDir("", "gitfetch")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	src := filepath.Join(top, "src")
+
+	repo, err := git.PlainInit(src, false)
+	require.NoError(t, err)
+
+	first := commitFiles(t, repo, src, map[string]string{
+		"README":     "hello\n",
+		"lib/code.c": "int main() {}\n",
+	})
+
+	f := &Fetcher{Dir: filepath.Join(top, "cache")}
+
+	t.Run("checks out a revision without the git metadata", func(t *testing.T) {
+		dest := filepath.Join(top, "a")
+
+		commit, err := f.Checkout(context.Background(), src, first, dest)
+		require.NoError(t, err)
+
+		assert.Equal(t, first, commit)
+
+		data, err := ioutil.ReadFile(filepath.Join(dest, "lib", "code.c"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "int main() {}\n", string(data))
+
+		_, err = os.Stat(filepath.Join(dest, ".git"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("hashes the tree the same wherever it is", func(t *testing.T) {
+		dest := filepath.Join(top, "b")
+
+		_, err := f.Checkout(context.Background(), src, "master", dest)
+		require.NoError(t, err)
+
+		a, err := HashTree(filepath.Join(top, "a"))
+		require.NoError(t, err)
+
+		b, err := HashTree(dest)
+		require.NoError(t, err)
+
+		assert.Equal(t, a, b)
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "README"), []byte("changed\n"), 0644))
+
+		c, err := HashTree(dest)
+		require.NoError(t, err)
+
+		assert.NotEqual(t, a, c)
+	})
+
+	t.Run("fetches new revisions into the existing clone", func(t *testing.T) {
+		second := commitFiles(t, repo, src, map[string]string{"NEWS": "more\n"})
+
+		nf := &Fetcher{Dir: f.Dir, NoFetch: true}
+
+		_, err := nf.Checkout(context.Background(), src, second, filepath.Join(top, "c"))
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrNotFetched))
+
+		_, err = f.Checkout(context.Background(), src, second, filepath.Join(top, "d"))
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(top, "d", "NEWS"))
+		require.NoError(t, err)
+
+		// Now that it's been fetched, it can be checked out without network
+		// access.
+		_, err = nf.Checkout(context.Background(), src, second, filepath.Join(top, "e"))
+		require.NoError(t, err)
+	})
+
+	t.Run("fetches branches again as they move", func(t *testing.T) {
+		second, err := f.Checkout(context.Background(), src, "master", filepath.Join(top, "f"))
+		require.NoError(t, err)
+
+		third := commitFiles(t, repo, src, map[string]string{"NEWS": "even more\n"})
+
+		nf := &Fetcher{Dir: f.Dir, NoFetch: true}
+
+		commit, err := nf.Checkout(context.Background(), src, "master", filepath.Join(top, "g"))
+		require.NoError(t, err)
+
+		assert.Equal(t, second, commit)
+
+		commit, err = f.Checkout(context.Background(), src, "master", filepath.Join(top, "h"))
+		require.NoError(t, err)
+
+		assert.Equal(t, third, commit)
+	})
+
+	t.Run("waits for others using the clone", func(t *testing.T) {
+		lock, err := lockRepo(context.Background(), repoPath(f.Dir, src))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*repoLockPoll)
+		defer cancel()
+
+		_, err = f.Checkout(ctx, src, "master", filepath.Join(top, "i"))
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		require.NoError(t, unlockRepo(lock))
+
+		_, err = f.Checkout(context.Background(), src, "master", filepath.Join(top, "i"))
+		require.NoError(t, err)
+	})
+}
@@ -1,17 +1,130 @@
 package hashdetect
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"hash"
+	"strings"
 
+	"github.com/mr-tron/base58"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/blake2b"
 )
 
+var ErrMismatch = errors.New("sum mismatch")
+
 func Hasher(algo string) (hash.Hash, error) {
 	switch algo {
 	case "b2":
 		return blake2b.New256(nil)
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
 	default:
 		return nil, fmt.Errorf("unknown algo: %s", algo)
 	}
 }
+
+// Known returns true if algo is supported by Hasher.
+func Known(algo string) bool {
+	_, err := Hasher(algo)
+	return err == nil
+}
+
+// Weak returns true if algo is no longer collision resistant, so a sum made
+// with it doesn't guarantee what a file contains.
+func Weak(algo string) bool {
+	return algo == "sha1" || algo == "md5"
+}
+
+// ParseSRI splits an integrity string such as sha256-<base64>, as used by
+// npm and Nix, into the algo and the encoded sum. A colon may be used in
+// place of the dash.
+func ParseSRI(str string) (algo, value string, ok bool) {
+	idx := strings.IndexAny(str, "-:")
+	if idx == -1 || !Known(str[:idx]) {
+		return "", "", false
+	}
+
+	return str[:idx], str[idx+1:], true
+}
+
+// Decode returns the sum in value, made with algo. The sum may be encoded
+// as hex, base64 or base58, optionally with an SRI style algo- prefix.
+func Decode(algo, value string) ([]byte, error) {
+	h, err := Hasher(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	if a, v, ok := ParseSRI(value); ok {
+		if a != algo {
+			return nil, fmt.Errorf("%s sum given as %s: %s", algo, a, value)
+		}
+
+		value = v
+	}
+
+	size := h.Size()
+
+	// Only padded base64 is accepted, which always ends in = for the sizes
+	// of these sums, as the unpadded alphabet overlaps with base58's.
+	decoders := []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base58.Decode,
+	}
+
+	for _, dec := range decoders {
+		b, err := dec(value)
+		if err == nil && len(b) == size {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid %s sum, expected %d bytes in hex, base64 or base58: %s", algo, size, value)
+}
+
+// Verifier checks that the data written to it has a given sum.
+type Verifier struct {
+	algo string
+	sum  []byte
+	h    hash.Hash
+}
+
+func NewVerifier(algo string, sum []byte) (*Verifier, error) {
+	h, err := Hasher(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{algo: algo, sum: sum, h: h}, nil
+}
+
+func (v *Verifier) Write(b []byte) (int, error) {
+	return v.h.Write(b)
+}
+
+// Verify returns an error wrapping ErrMismatch if the data written doesn't
+// have the expected sum.
+func (v *Verifier) Verify() error {
+	actual := v.h.Sum(nil)
+
+	if !bytes.Equal(v.sum, actual) {
+		return errors.Wrapf(ErrMismatch, "expected %s:%s, got %s:%s",
+			v.algo, hex.EncodeToString(v.sum), v.algo, hex.EncodeToString(actual))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package hashdetect
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mr-tron/base58"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	h := sha256.Sum256([]byte("hello"))
+	sum := h[:]
+
+	t.Run("accepts hex, base64 and base58", func(t *testing.T) {
+		for _, enc := range []string{
+			hex.EncodeToString(sum),
+			base64.StdEncoding.EncodeToString(sum),
+			base58.Encode(sum),
+		} {
+			b, err := Decode("sha256", enc)
+			require.NoError(t, err, enc)
+
+			assert.Equal(t, sum, b, enc)
+		}
+	})
+
+	t.Run("accepts SRI style sums", func(t *testing.T) {
+		h := sha512.Sum512([]byte("hello"))
+		sri := "sha512-" + base64.StdEncoding.EncodeToString(h[:])
+
+		algo, value, ok := ParseSRI(sri)
+		require.True(t, ok)
+
+		assert.Equal(t, "sha512", algo)
+
+		b, err := Decode(algo, value)
+		require.NoError(t, err)
+		assert.Equal(t, h[:], b)
+
+		b, err = Decode("sha512", sri)
+		require.NoError(t, err)
+		assert.Equal(t, h[:], b)
+
+		_, err = Decode("sha256", sri)
+		assert.Error(t, err)
+
+		_, _, ok = ParseSRI("abc-def")
+		assert.False(t, ok)
+	})
+
+	t.Run("rejects sums of the wrong size", func(t *testing.T) {
+		_, err := Decode("sha512", hex.EncodeToString(sum))
+		assert.Error(t, err)
+
+		_, err = Decode("crc32", hex.EncodeToString(sum))
+		assert.Error(t, err)
+	})
+
+	t.Run("marks sha1 and md5 as weak", func(t *testing.T) {
+		assert.True(t, Weak("sha1"))
+		assert.True(t, Weak("md5"))
+		assert.False(t, Weak("sha256"))
+		assert.False(t, Weak("b2"))
+	})
+}
+
+func TestVerifier(t *testing.T) {
+	h := sha256.Sum256([]byte("hello"))
+
+	v, err := NewVerifier("sha256", h[:])
+	require.NoError(t, err)
+
+	v.Write([]byte("hello"))
+
+	assert.NoError(t, v.Verify())
+
+	v, err = NewVerifier("sha256", h[:])
+	require.NoError(t, err)
+
+	v.Write([]byte("goodbye"))
+
+	err = v.Verify()
+	require.Error(t, err)
+
+	assert.True(t, errors.Is(err, ErrMismatch))
+}
@@ -3,12 +3,14 @@ package ops
 import (
 	"crypto/ed25519"
 	"os"
+	"path/filepath"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/hashicorp/go-hclog"
 	"github.com/lab47/chell/pkg/config"
+	"github.com/lab47/chell/pkg/dlcache"
 )
 
 type Ops struct {
@@ -16,10 +18,14 @@ type Ops struct {
 
 	path     []string
 	storeDir string
+	logDir   string
+	sigDir   string
 
 	pub  ed25519.PublicKey
 	priv ed25519.PrivateKey
 
+	mirrors dlcache.Mirrors
+
 	cfg *Config
 }
 
@@ -28,8 +34,11 @@ func NewOps(logger hclog.Logger, cfg *config.Config) (*Ops, error) {
 		logger:   logger,
 		path:     cfg.LoadPath(),
 		storeDir: cfg.StorePath(),
+		logDir:   cfg.LogsPath(),
+		sigDir:   cfg.SigsPath(),
 		priv:     cfg.Private(),
 		pub:      cfg.Public(),
+		mirrors:  cfg.Mirrors,
 	}
 
 	err := o.findConfig()
@@ -53,6 +62,23 @@ func (o *Ops) findConfig() error {
 	return nil
 }
 
+// Mirrors returns the mirrors defined by the mirrors.json at the top of each
+// repo in the load path, followed by those in the global config.
+func (o *Ops) Mirrors() (dlcache.Mirrors, error) {
+	var mirrors dlcache.Mirrors
+
+	for _, dir := range o.path {
+		m, err := dlcache.ReadMirrors(filepath.Join(dir, "mirrors.json"))
+		if err != nil {
+			return nil, err
+		}
+
+		mirrors = mirrors.Merge(m)
+	}
+
+	return mirrors.Merge(o.mirrors), nil
+}
+
 func (o *Ops) ProjectLoad() *ConfigLoad {
 	var cl ConfigLoad
 	cl.load = o.ScriptLoad()
@@ -96,6 +122,42 @@ func (o *Ops) PackagesInstall(ienv *InstallEnv) *PackagesInstall {
 	return pi
 }
 
+func (o *Ops) PackageFetch(ienv *InstallEnv) *PackageFetch {
+	pf := &PackageFetch{ienv: ienv}
+
+	pf.SetLogger(o.logger.Named("package-fetch"))
+
+	return pf
+}
+
+func (o *Ops) PackageWhyRebuild() *PackageWhyRebuild {
+	pw := &PackageWhyRebuild{storeDir: o.storeDir, sigDir: o.sigDir}
+
+	pw.SetLogger(o.logger.Named("package-why-rebuild"))
+
+	return pw
+}
+
+func (o *Ops) PackageCheck(ienv *InstallEnv) *PackageCheck {
+	pc := &PackageCheck{ienv: ienv}
+
+	pc.SetLogger(o.logger.Named("package-check"))
+
+	return pc
+}
+
+func (o *Ops) PackageTest(ienv *InstallEnv) *PackageTest {
+	pt := &PackageTest{ienv: ienv}
+
+	pt.SetLogger(o.logger.Named("package-test"))
+
+	return pt
+}
+
+func (o *Ops) PackageBuildLog() *PackageBuildLog {
+	return &PackageBuildLog{logDir: o.logDir}
+}
+
 func (o *Ops) StoreToCar(output string) *StoreToCar {
 	var stc StoreToCar
 	stc.storePath = o.storeDir
@@ -138,3 +200,11 @@ func (o *Ops) ScriptAllDeps() *ScriptCalcDeps {
 		storeDir: o.storeDir,
 	}
 }
+
+func (o *Ops) EnvCompose() *EnvCompose {
+	ec := &EnvCompose{storeDir: o.storeDir}
+
+	ec.SetLogger(o.logger.Named("env-compose"))
+
+	return ec
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 )
 
@@ -14,14 +16,71 @@ type PackageDetectLibs struct {
 type DetectedLibs struct {
 	ChellLibs  []string
 	SystemLibs []string
+
+	// Libraries that couldn't be found where the dynamic loader would look.
+	Missing []string
+
+	// The binaries, relative to the package's store dir, that use each
+	// library.
+	UsedBy map[string][]string
+}
+
+func (d *DetectedLibs) add(storeDir, lib, binary string, missing bool) {
+	if d.UsedBy == nil {
+		d.UsedBy = make(map[string][]string)
+	}
+
+	users, seen := d.UsedBy[lib]
+
+	for _, u := range users {
+		if u == binary {
+			return
+		}
+	}
+
+	d.UsedBy[lib] = append(users, binary)
+
+	if seen {
+		return
+	}
+
+	switch {
+	case missing:
+		d.Missing = append(d.Missing, lib)
+	case strings.HasPrefix(lib, storeDir):
+		d.ChellLibs = append(d.ChellLibs, lib)
+	default:
+		d.SystemLibs = append(d.SystemLibs, lib)
+	}
 }
 
 func (p *PackageDetectLibs) Detect(id string) (*DetectedLibs, error) {
-	var dl DetectedLibs
+	var (
+		dl  DetectedLibs
+		err error
+	)
+
+	root := filepath.Join(p.storeDir, id)
 
-	seen := map[string]struct{}{}
+	if runtime.GOOS == "darwin" {
+		err = p.detectMachO(root, &dl)
+	} else {
+		err = p.detectELF(root, &dl)
+	}
+
+	if err != nil {
+		return nil, err
+	}
 
-	err := filepath.Walk(filepath.Join(p.storeDir, id), func(path string, info os.FileInfo, err error) error {
+	for _, users := range dl.UsedBy {
+		sort.Strings(users)
+	}
+
+	return &dl, nil
+}
+
+func (p *PackageDetectLibs) detectMachO(root string, dl *DetectedLibs) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if !info.Mode().IsRegular() {
 			return nil
 		}
@@ -35,6 +94,11 @@ func (p *PackageDetectLibs) Detect(id string) (*DetectedLibs, error) {
 				return err
 			}
 
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
 			lines := strings.Split(string(data), "\n")
 
 			for _, line := range lines[1:] {
@@ -45,24 +109,9 @@ func (p *PackageDetectLibs) Detect(id string) (*DetectedLibs, error) {
 
 				lib := strings.TrimSpace(line[:idx])
 
-				if _, ok := seen[lib]; ok {
-					continue
-				}
-
-				seen[lib] = struct{}{}
-
-				if strings.HasPrefix(lib, p.storeDir) {
-					dl.ChellLibs = append(dl.ChellLibs, lib)
-				} else {
-					dl.SystemLibs = append(dl.SystemLibs, lib)
-				}
+				dl.add(p.storeDir, lib, rel, false)
 			}
 		}
 		return nil
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &dl, nil
 }
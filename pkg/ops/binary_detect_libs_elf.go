@@ -0,0 +1,231 @@
+package ops
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dirs the dynamic loader searches after the runpath, before those in
+// /etc/ld.so.conf are added.
+var defaultLibDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+func (p *PackageDetectLibs) detectELF(root string, dl *DetectedLibs) error {
+	sysDirs := append(readLdSoConf("/etc/ld.so.conf", map[string]bool{}), defaultLibDirs...)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || !isELF(path) {
+			return nil
+		}
+
+		ef, err := elf.Open(path)
+		if err != nil {
+			return nil
+		}
+
+		defer ef.Close()
+
+		if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		r := elfResolver{
+			sysDirs: sysDirs,
+			class:   ef.Class,
+			machine: ef.Machine,
+			seen:    make(map[string]bool),
+		}
+
+		r.resolve(path, ef, func(lib string, missing bool) {
+			dl.add(p.storeDir, lib, rel, missing)
+		})
+
+		return nil
+	})
+}
+
+func isELF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	magic := make([]byte, len(elfMagic))
+
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, elfMagic)
+}
+
+// elfResolver finds the libraries a binary needs the same way the dynamic
+// loader does, including the libraries those need in turn.
+type elfResolver struct {
+	sysDirs []string
+	class   elf.Class
+	machine elf.Machine
+
+	seen map[string]bool
+}
+
+func (r *elfResolver) resolve(path string, ef *elf.File, found func(lib string, missing bool)) {
+	needed, err := ef.ImportedLibraries()
+	if err != nil {
+		return
+	}
+
+	var dirs []string
+
+	runpath, _ := ef.DynString(elf.DT_RUNPATH)
+
+	// DT_RPATH is ignored when there is a DT_RUNPATH.
+	if len(runpath) == 0 {
+		rpath, _ := ef.DynString(elf.DT_RPATH)
+		dirs = append(dirs, expandOrigin(path, rpath)...)
+	} else {
+		dirs = append(dirs, expandOrigin(path, runpath)...)
+	}
+
+	dirs = append(dirs, r.sysDirs...)
+
+	for _, name := range needed {
+		lib, lef := r.find(name, dirs)
+		if lef == nil {
+			if !r.seen[name] {
+				r.seen[name] = true
+				found(name, true)
+			}
+
+			continue
+		}
+
+		if r.seen[lib] {
+			lef.Close()
+			continue
+		}
+
+		r.seen[lib] = true
+		found(lib, false)
+
+		r.resolve(lib, lef, found)
+
+		lef.Close()
+	}
+}
+
+// find returns the first library called name in dirs that is compatible
+// with the binary being resolved.
+func (r *elfResolver) find(name string, dirs []string) (string, *elf.File) {
+	candidates := []string{name}
+
+	if !strings.Contains(name, "/") {
+		candidates = nil
+
+		for _, dir := range dirs {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+
+	for _, path := range candidates {
+		ef, err := elf.Open(path)
+		if err != nil {
+			continue
+		}
+
+		if ef.Class != r.class || ef.Machine != r.machine {
+			ef.Close()
+			continue
+		}
+
+		return path, ef
+	}
+
+	return "", nil
+}
+
+// expandOrigin splits the runpath entries in paths and replaces $ORIGIN
+// with the dir of the binary at path.
+func expandOrigin(path string, paths []string) []string {
+	origin := filepath.Dir(path)
+
+	var dirs []string
+
+	for _, p := range paths {
+		for _, dir := range filepath.SplitList(p) {
+			if dir == "" {
+				continue
+			}
+
+			dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+			dir = strings.Replace(dir, "$ORIGIN", origin, -1)
+
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// readLdSoConf returns the lib dirs listed in the ld.so.conf at path,
+// following includes.
+func readLdSoConf(path string, visited map[string]bool) []string {
+	if visited[path] {
+		return nil
+	}
+
+	visited[path] = true
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	var dirs []string
+
+	br := bufio.NewScanner(f)
+	for br.Scan() {
+		line := br.Text()
+
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "include") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include"))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				dirs = append(dirs, readLdSoConf(m, visited)...)
+			}
+
+			continue
+		}
+
+		dirs = append(dirs, line)
+	}
+
+	return dirs
+}
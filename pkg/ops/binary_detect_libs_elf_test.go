@@ -0,0 +1,85 @@
+package ops
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageDetectLibsELF(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ELF binaries are only built on linux")
+	}
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	store := filepath.Join(top, "store")
+	fooLib := filepath.Join(store, "abc-foo-1.0", "lib")
+	out := filepath.Join(store, "abc-test-1.0")
+
+	for _, dir := range []string{fooLib, filepath.Join(out, "bin"), filepath.Join(out, "lib")} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+
+	src := filepath.Join(top, "src")
+	require.NoError(t, os.Mkdir(src, 0755))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "foo.c"), []byte("int foo() { return 42; }\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "gone.c"), []byte("int gone() { return 1; }\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "main.c"), []byte("int foo();\nint main() { return foo(); }\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "other.c"), []byte("int gone();\nint main() { return gone(); }\n"), 0644))
+
+	run := func(args ...string) {
+		cmd := exec.Command(cc, args...)
+		cmd.Dir = src
+
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+
+	run("-shared", "-fPIC", "-o", filepath.Join(fooLib, "libfoo.so"), "foo.c")
+	run("-shared", "-fPIC", "-o", filepath.Join(src, "libgone.so"), "gone.c")
+
+	run("-o", filepath.Join(out, "bin", "main"), "main.c", "-L"+fooLib, "-lfoo", "-Wl,-rpath,"+fooLib)
+	run("-o", filepath.Join(out, "bin", "other"), "other.c", "-L"+src, "-lgone")
+
+	pdl := PackageDetectLibs{storeDir: store}
+
+	libs, err := pdl.Detect("abc-test-1.0")
+	require.NoError(t, err)
+
+	libfoo := filepath.Join(fooLib, "libfoo.so")
+
+	assert.Equal(t, []string{libfoo}, libs.ChellLibs)
+	assert.Equal(t, []string{"bin/main"}, libs.UsedBy[libfoo])
+
+	assert.Equal(t, []string{"libgone.so"}, libs.Missing)
+	assert.Equal(t, []string{"bin/other"}, libs.UsedBy["libgone.so"])
+
+	require.NotEmpty(t, libs.SystemLibs)
+
+	var libc string
+
+	for _, lib := range libs.SystemLibs {
+		if filepath.Base(lib) == "libc.so.6" {
+			libc = lib
+		}
+	}
+
+	require.NotEqual(t, "", libc)
+	assert.Equal(t, []string{"bin/main", "bin/other"}, libs.UsedBy[libc])
+}
@@ -0,0 +1,252 @@
+package ops
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/lab47/exprcore/exprcore"
+)
+
+// The helpers for common build systems add the statements that configure,
+// build and install the package in the current dir, so that they're part
+// of the package's work tree like any others. Commands build with $jobs
+// jobs, and find dependencies through the search paths, such as
+// PKG_CONFIG_PATH and CMAKE_PREFIX_PATH, set by EnvCompose.
+
+// cmakeBuildDir and mesonBuildDir are relative to the source dir, as both
+// build out of tree.
+const (
+	cmakeBuildDir = "_build"
+	mesonBuildDir = "_build"
+)
+
+func autotoolsFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		flags, makeFlags *exprcore.List
+		configure        = "./configure"
+	)
+
+	if err := exprcore.UnpackArgs(
+		"autotools", args, kwargs,
+		"flags?", &flags,
+		"make_flags?", &makeFlags,
+		"configure?", &configure,
+	); err != nil {
+		return nil, err
+	}
+
+	fl, err := stringList("flags", flags)
+	if err != nil {
+		return nil, err
+	}
+
+	mfl, err := stringList("make_flags", makeFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkPath(configure)
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	env.system(append([]string{configure, "--prefix=" + env.installDir}, fl...)...)
+	env.system(append([]string{"make", "-j" + evt.Jobs}, mfl...)...)
+	env.system(append([]string{"make", "install"}, mfl...)...)
+
+	return exprcore.None, nil
+}
+
+func cmakeFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		defines   *exprcore.Dict
+		buildType = "Release"
+	)
+
+	if err := exprcore.UnpackArgs(
+		"cmake", args, kwargs,
+		"defines?", &defines,
+		"build_type?", &buildType,
+	); err != nil {
+		return nil, err
+	}
+
+	dm, err := optionalStringDict(defines)
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	configure := []string{
+		"cmake", "-S", ".", "-B", cmakeBuildDir,
+		"-DCMAKE_INSTALL_PREFIX=" + env.installDir,
+		"-DCMAKE_INSTALL_LIBDIR=lib",
+		"-DCMAKE_BUILD_TYPE=" + buildType,
+	}
+
+	for _, k := range sortedKeys(dm) {
+		configure = append(configure, fmt.Sprintf("-D%s=%s", k, dm[k]))
+	}
+
+	env.system(configure...)
+	env.system("cmake", "--build", cmakeBuildDir, "--parallel", evt.Jobs)
+	env.system("cmake", "--install", cmakeBuildDir)
+
+	return exprcore.None, nil
+}
+
+func mesonFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		options   *exprcore.Dict
+		buildType = "release"
+	)
+
+	if err := exprcore.UnpackArgs(
+		"meson", args, kwargs,
+		"options?", &options,
+		"build_type?", &buildType,
+	); err != nil {
+		return nil, err
+	}
+
+	om, err := optionalStringDict(options)
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	setup := []string{
+		"meson", "setup", mesonBuildDir,
+		"--prefix=" + env.installDir,
+		"--libdir=lib",
+		"--buildtype=" + buildType,
+	}
+
+	for _, k := range sortedKeys(om) {
+		setup = append(setup, fmt.Sprintf("-D%s=%s", k, om[k]))
+	}
+
+	env.system(setup...)
+	env.system("meson", "compile", "-C", mesonBuildDir, "-j", evt.Jobs)
+	env.system("meson", "install", "-C", mesonBuildDir)
+
+	return exprcore.None, nil
+}
+
+// goBuildFn builds a go module. Install statements don't have network
+// access unless the package declares it needs it, so rather than failing
+// to resolve the module proxy, module lookups are turned off. A module's
+// dependencies have to be vendored, or come from a fetch() instance via
+// GOMODCACHE.
+func goBuildFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		pkg     = "."
+		ldflags string
+		tags    *exprcore.List
+	)
+
+	if err := exprcore.UnpackArgs(
+		"go_build", args, kwargs,
+		"pkg?", &pkg,
+		"ldflags?", &ldflags,
+		"tags?", &tags,
+	); err != nil {
+		return nil, err
+	}
+
+	tl, err := stringList("tags", tags)
+	if err != nil {
+		return nil, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	bin := env.installDir + "/bin"
+
+	// Keep go's caches in the build dir rather than the home dir, which
+	// the sandbox may not allow writing to.
+	env.stmt(&evt.SetEnv{Key: "GOCACHE", Value: env.buildDir + "/.cache/go-build"})
+	env.stmt(&evt.SetEnv{Key: "GOPATH", Value: env.buildDir + "/.cache/go"})
+	env.stmt(&evt.SetEnv{Key: "GOPROXY", Value: "off"})
+	env.stmt(&evt.MakeDir{Dir: evt.FSPath(bin)})
+
+	// The module cache is read-only by default, which would stop the build
+	// dir being removed.
+	build := []string{"go", "build", "-p", evt.Jobs, "-trimpath", "-modcacherw", "-o", bin + "/"}
+
+	if ldflags != "" {
+		build = append(build, "-ldflags", ldflags)
+	}
+
+	if len(tl) > 0 {
+		build = append(build, "-tags", strings.Join(tl, ","))
+	}
+
+	env.system(append(build, pkg)...)
+
+	return exprcore.None, nil
+}
+
+// system adds a statement that runs args as a command, in the current dir.
+func (r *RunCtx) system(args ...string) {
+	r.stmt(&evt.System{
+		Arguments: args,
+	})
+}
+
+func stringList(name string, l *exprcore.List) ([]string, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	var strs []string
+
+	for i := 0; i < l.Len(); i++ {
+		str, ok := l.Index(i).(exprcore.String)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of strings, got a %s", name, l.Index(i).Type())
+		}
+
+		strs = append(strs, string(str))
+	}
+
+	return strs, nil
+}
+
+func optionalStringDict(d *exprcore.Dict) (map[string]string, error) {
+	if d == nil {
+		return nil, nil
+	}
+
+	return stringDict(d)
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
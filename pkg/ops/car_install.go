@@ -1,9 +1,12 @@
 package ops
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/pkg/errors"
 )
 
 type CarInstall struct {
@@ -11,9 +14,11 @@ type CarInstall struct {
 	Dir    string
 }
 
-func (c *CarInstall) Install(set []*CarToInstall) error {
+// Install installs each car in set into Dir. Waiting for another process
+// that's installing the same car stops if ctx is cancelled.
+func (c *CarInstall) Install(ctx context.Context, set []*CarToInstall) error {
 	for _, car := range set {
-		err := c.installCar(car)
+		err := c.installCar(ctx, car)
 		if err != nil {
 			return err
 		}
@@ -22,7 +27,23 @@ func (c *CarInstall) Install(set []*CarToInstall) error {
 	return nil
 }
 
-func (c *CarInstall) installCar(car *CarToInstall) error {
+func (c *CarInstall) installCar(ctx context.Context, car *CarToInstall) error {
+	lock, err := lockStore(ctx, c.Dir, car.ID, nil)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	installed, err := storeInstalled(c.Dir, car.ID)
+	if err != nil {
+		return err
+	}
+
+	if installed {
+		return nil
+	}
+
 	r, err := car.Data.Open()
 	if err != nil {
 		return err
@@ -32,17 +53,33 @@ func (c *CarInstall) installCar(car *CarToInstall) error {
 
 	var up CarUnpack
 
-	tg := filepath.Join(c.Dir, car.ID)
+	// Unpack next to the store dir and only move it into place once the
+	// car has been verified.
+	tmp := storeTempDir(c.Dir, car.ID)
+
+	// Cleanup after an install that was interrupted, which may have left
+	// a frozen dir behind.
+	err = removeFrozen(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "unable to remove %s", tmp)
+	}
 
-	err = up.Install(r, tg)
+	err = up.Install(r, tmp)
 	if err != nil {
+		removeFrozen(tmp)
 		return err
 	}
 
 	if up.Info.Signer != car.Signer {
-		os.RemoveAll(tg)
+		removeFrozen(tmp)
 		return fmt.Errorf("car signer not the same as indicated in the dependency entry: %s != %s", up.Info.Signer, car.Signer)
 	}
 
+	err = os.Rename(tmp, filepath.Join(c.Dir, car.ID))
+	if err != nil {
+		removeFrozen(tmp)
+		return err
+	}
+
 	return nil
 }
@@ -1,6 +1,7 @@
 package ops
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
@@ -112,7 +113,7 @@ func TestCarInstall(t *testing.T) {
 		var ci CarInstall
 		ci.Dir = dir2
 
-		err = ci.Install(toInstall)
+		err = ci.Install(context.Background(), toInstall)
 		require.NoError(t, err)
 
 		testData, err := ioutil.ReadFile(filepath.Join(dir2, fake+"-blah-1.0/bin/test"))
@@ -206,10 +207,137 @@ func TestCarInstall(t *testing.T) {
 		var ci CarInstall
 		ci.Dir = dir2
 
-		err = ci.Install(toInstall)
+		err = ci.Install(context.Background(), toInstall)
 		require.Error(t, err)
 
 		_, err = ioutil.ReadFile(filepath.Join(dir2, fake+"-blah-1.0/bin/test"))
 		require.Error(t, err)
+
+		_, err = os.Stat(storeTempDir(dir2, fake+"-blah-1.0"))
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("replaces a frozen dir left by an interrupted install", func(t *testing.T) {
+		require.NoError(t, os.Mkdir(dir, 0755))
+		defer os.RemoveAll(dir)
+
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "b/bin"), 0755))
+
+		err := ioutil.WriteFile(filepath.Join(dir, "b/bin/test"), echoBin, 0644)
+		require.NoError(t, err)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		var (
+			cp    CarPack
+			cinfo data.CarInfo
+			sr    staticReader
+		)
+
+		cp.PrivateKey = priv
+		cp.PublicKey = pub
+
+		cinfo.ID = fake + "-blah-1.0"
+
+		err = cp.Pack(&cinfo, dir+"/b", &sr.buf)
+		require.NoError(t, err)
+
+		sr.info = &cinfo
+
+		var cl CarLookup
+
+		cl.overrides = map[string]CarReader{
+			"qux.com/pkg": &sr,
+		}
+
+		dir2 := filepath.Join(topdir, "i")
+		require.NoError(t, os.Mkdir(dir2, 0755))
+		defer removeFrozen(dir2)
+
+		leftover := filepath.Join(storeTempDir(dir2, cinfo.ID), "bin")
+		require.NoError(t, os.MkdirAll(leftover, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(leftover, "stale"), nil, 0444))
+		require.NoError(t, os.Chmod(leftover, 0555))
+
+		var cc CarCalcSet
+		cc.Lookup = &cl
+
+		toInstall, err := cc.Calculate("qux.com/pkg", cinfo.ID)
+		require.NoError(t, err)
+
+		var ci CarInstall
+		ci.Dir = dir2
+
+		require.NoError(t, ci.Install(context.Background(), toInstall))
+
+		_, err = os.Stat(filepath.Join(dir2, cinfo.ID, "bin", "stale"))
+		assert.True(t, os.IsNotExist(err))
+
+		testData, err := ioutil.ReadFile(filepath.Join(dir2, cinfo.ID, "bin/test"))
+		require.NoError(t, err)
+
+		assert.Equal(t, echoBin, testData)
+	})
+
+	t.Run("stops waiting for another install when cancelled", func(t *testing.T) {
+		require.NoError(t, os.Mkdir(dir, 0755))
+		defer os.RemoveAll(dir)
+
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "b/bin"), 0755))
+
+		err := ioutil.WriteFile(filepath.Join(dir, "b/bin/test"), echoBin, 0644)
+		require.NoError(t, err)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		var (
+			cp    CarPack
+			cinfo data.CarInfo
+			sr    staticReader
+		)
+
+		cp.PrivateKey = priv
+		cp.PublicKey = pub
+
+		cinfo.ID = fake + "-blah-1.0"
+
+		err = cp.Pack(&cinfo, dir+"/b", &sr.buf)
+		require.NoError(t, err)
+
+		sr.info = &cinfo
+
+		var cl CarLookup
+
+		cl.overrides = map[string]CarReader{
+			"qux.com/pkg": &sr,
+		}
+
+		dir2 := filepath.Join(topdir, "i")
+		require.NoError(t, os.Mkdir(dir2, 0755))
+		defer os.RemoveAll(dir2)
+
+		var cc CarCalcSet
+		cc.Lookup = &cl
+
+		toInstall, err := cc.Calculate("qux.com/pkg", cinfo.ID)
+		require.NoError(t, err)
+
+		lock, err := lockStore(context.Background(), dir2, cinfo.ID, nil)
+		require.NoError(t, err)
+
+		defer lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*storeLockPoll)
+		defer cancel()
+
+		var ci CarInstall
+		ci.Dir = dir2
+
+		err = ci.Install(ctx, toInstall)
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		_, err = os.Stat(filepath.Join(dir2, cinfo.ID))
+		assert.True(t, os.IsNotExist(err))
 	})
 }
@@ -90,11 +90,17 @@ func (c *CarPack) Pack(cinfo *data.CarInfo, dir string, w io.Writer) error {
 					return err
 				}
 
-				if !strings.HasPrefix(link, dir) {
+				switch {
+				case strings.HasPrefix(link, dir+"/"):
+					link = link[len(dir)+1:]
+				case deps != nil && strings.HasPrefix(link, c.DepRootDir+"/"):
+					// Links into other store dirs, such as to another output
+					// of the same package, are kept absolute and count as a
+					// reference to it.
+					deps[idHash(link[len(c.DepRootDir)+1:])] = struct{}{}
+				default:
 					return fmt.Errorf("link points outside of root dir: %s", link)
 				}
-
-				link = link[len(dir)+1:]
 			}
 
 			hdr, err := tar.FileInfoHeader(fi, link)
@@ -14,6 +14,11 @@ type depDetect struct {
 	state        int
 	restOfPrefix []byte
 	hashParts    []byte
+
+	// When set, match is called with the offset of each occurance of prefix
+	// instead of collecting the hashes that follow it.
+	match  func(offset int64)
+	offset int64
 }
 
 const (
@@ -34,7 +39,11 @@ func (d *depDetect) findIn(src []byte) {
 		prefix = d.restOfPrefix
 	}
 
-	for _, b := range src {
+	defer func() {
+		d.offset += int64(len(src))
+	}()
+
+	for i, b := range src {
 		switch d.state {
 		case detectStart:
 			if prefix[0] == b {
@@ -48,7 +57,13 @@ func (d *depDetect) findIn(src []byte) {
 				d.buf.WriteByte(b)
 				prefix = prefix[1:]
 
-				if len(prefix) == 0 {
+				if len(prefix) == 0 && d.match != nil {
+					d.match(d.offset + int64(i+1-len(d.prefix)))
+
+					prefix = d.prefix
+					d.state = detectStart
+					d.buf.Reset()
+				} else if len(prefix) == 0 {
 					d.state = detectHash
 					d.hashParts = nil
 					d.buf.Reset()
@@ -57,6 +72,14 @@ func (d *depDetect) findIn(src []byte) {
 				prefix = d.prefix
 				d.state = detectStart
 				d.buf.Reset()
+
+				// The byte that broke the match might start a new one.
+				if prefix[0] == b {
+					prefix = prefix[1:]
+					d.buf.WriteByte(b)
+
+					d.state = detectPrefix
+				}
 			}
 		case detectHash:
 			_, found := validHashChars[b]
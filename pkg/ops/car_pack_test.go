@@ -100,6 +100,39 @@ func TestCarPack(t *testing.T) {
 		assert.Equal(t, fake, cp.Dependencies[0])
 	})
 
+	t.Run("detects dependencies right after a partial match", func(t *testing.T) {
+		require.NoError(t, os.Mkdir(dir, 0755))
+		defer os.RemoveAll(dir)
+
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "bin"), 0755))
+
+		// The / that stops the first, partial, match starts the real one.
+		partial := []byte(fmt.Sprintf("#!/bin/sh\ncat %s%s/%s-blah-1.0/whatever\n", filepath.Dir(dir)+"/", dir, fake))
+
+		err := ioutil.WriteFile(filepath.Join(dir, "bin/test"), partial, 0644)
+		require.NoError(t, err)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		var (
+			cp    CarPack
+			buf   bytes.Buffer
+			cinfo data.CarInfo
+		)
+
+		cp.PrivateKey = priv
+		cp.PublicKey = pub
+		cp.DepRootDir = dir
+
+		err = cp.Pack(&cinfo, dir, &buf)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(cp.Dependencies))
+
+		assert.Equal(t, fake, cp.Dependencies[0])
+	})
+
 	t.Run("can map dependenices", func(t *testing.T) {
 		require.NoError(t, os.Mkdir(dir, 0755))
 		defer os.RemoveAll(dir)
@@ -107,7 +107,12 @@ top:
 			fmt.Fprintf(dh, hdr.Linkname)
 			dh.Write([]byte{0})
 
-			err = os.Symlink(filepath.Join(path, hdr.Linkname), path)
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(path, target)
+			}
+
+			err = os.Symlink(target, path)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,122 @@
+package ops
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/lab47/exprcore/exprcore"
+	"github.com/pkg/errors"
+)
+
+// EnvCompose calculates the environment provided by a set of installed
+// packages. Each package contributes the standard variables for the dirs
+// it contains, followed by whatever it's hook sets with set_env and co.
+type EnvCompose struct {
+	common
+
+	storeDir string
+
+	// Returns the IDs of the outputs of dep to use. Defaults to all of
+	// them.
+	outputs func(dep *ScriptPackage) []string
+}
+
+// The variables derived from the dirs of each package, in the order
+// they're applied.
+var standardEnvDirs = []struct {
+	key, dir string
+}{
+	{"PATH", "bin"},
+	{"MANPATH", "share/man"},
+	{"PKG_CONFIG_PATH", "share/pkgconfig"},
+	{"PKG_CONFIG_PATH", "lib/pkgconfig"},
+	{"CPATH", "include"},
+	{"LIBRARY_PATH", "lib"},
+
+	// The package itself, which CMake and Meson search for the config
+	// files of dependencies.
+	{"CMAKE_PREFIX_PATH", ""},
+}
+
+// Compose applies the environment of deps to base, a list of KEY=value
+// pairs. Packages are applied in dependency order, so a package's hook
+// sees the changes made by the packages it depends on and dirs of
+// dependent packages come first in search paths.
+func (e *EnvCompose) Compose(ctx context.Context, base []string, deps []*ScriptPackage) ([]string, error) {
+	env := append([]string(nil), base...)
+
+	var scd ScriptCalcDeps
+	scd.storeDir = e.storeDir
+
+	for _, dep := range scd.TopoSort(deps) {
+		ids := dep.OutputIDs()
+		if e.outputs != nil {
+			ids = e.outputs(dep)
+		}
+
+		for _, id := range ids {
+			for _, sd := range standardEnvDirs {
+				dir := filepath.Join(e.storeDir, id, sd.dir)
+
+				if _, err := os.Stat(dir); err == nil {
+					env = evt.ApplyEnv(env, &evt.SetEnv{Prepend: true, Key: sd.key, Value: dir})
+				}
+			}
+		}
+
+		changes, err := e.hookEnv(ctx, dep)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to run hook of %s", dep.ID())
+		}
+
+		for _, n := range changes {
+			env = evt.ApplyEnv(env, n)
+		}
+	}
+
+	return env, nil
+}
+
+// hookEnv runs the hook of pkg, returning the environment changes it makes.
+// Any other statements in the hook are ignored.
+func (e *EnvCompose) hookEnv(ctx context.Context, pkg *ScriptPackage) ([]*evt.SetEnv, error) {
+	hook := pkg.cs.Hook
+	if hook == nil {
+		return nil, nil
+	}
+
+	var rc RunCtx
+	rc.ctx = ctx
+	rc.L = e.L()
+	rc.attrs = RunCtxFunctions
+	rc.installDir = filepath.Join(e.storeDir, pkg.ID())
+	rc.outputs = make(map[string]string)
+
+	for _, name := range pkg.Outputs()[1:] {
+		rc.outputs[name] = filepath.Join(e.storeDir, pkg.OutputID(name))
+	}
+
+	var top evt.Statements
+	rc.top = &top
+
+	var thread exprcore.Thread
+
+	_, err := exprcore.Call(&thread, hook, exprcore.Tuple{&rc}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*evt.SetEnv
+
+	for _, n := range top.Statements {
+		if se, ok := n.(*evt.SetEnv); ok {
+			changes = append(changes, se)
+		} else {
+			e.L().Debug("ignoring statement in hook", "package", pkg.ID(), "statement", evt.Describe(n))
+		}
+	}
+
+	return changes, nil
+}
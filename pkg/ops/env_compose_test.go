@@ -0,0 +1,52 @@
+package ops
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvCompose(t *testing.T) {
+	store, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(store)
+
+	base := &ScriptPackage{id: "abc-base-1.0", name: "base"}
+	tool := &ScriptPackage{id: "def-tool-1.0", name: "tool"}
+	tool.cs.Dependencies = []*ScriptPackage{base}
+
+	for _, dir := range []string{
+		"abc-base-1.0/bin",
+		"abc-base-1.0/lib/pkgconfig",
+		"abc-base-1.0/include",
+		"def-tool-1.0/bin",
+		"def-tool-1.0/share/man",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(store, dir), 0755))
+	}
+
+	ec := EnvCompose{storeDir: store}
+
+	// Passed with the dependent package first, as EvalDeps returns them.
+	env, err := ec.Compose(context.Background(), []string{"PATH=/bin"}, []*ScriptPackage{tool, base})
+	require.NoError(t, err)
+
+	join := func(id, dir string) string {
+		return filepath.Join(store, id, dir)
+	}
+
+	assert.Equal(t, []string{
+		"PATH=" + join("def-tool-1.0", "bin") + ":" + join("abc-base-1.0", "bin") + ":/bin",
+		"PKG_CONFIG_PATH=" + join("abc-base-1.0", "lib/pkgconfig"),
+		"CPATH=" + join("abc-base-1.0", "include"),
+		"LIBRARY_PATH=" + join("abc-base-1.0", "lib"),
+		"CMAKE_PREFIX_PATH=" + join("def-tool-1.0", "") + ":" + join("abc-base-1.0", ""),
+		"MANPATH=" + join("def-tool-1.0", "share/man"),
+	}, env)
+}
@@ -1,5 +1,7 @@
 package ops
 
+import "github.com/lab47/chell/pkg/dlcache"
+
 type InstallEnv struct {
 	// Directory to create build dirs in
 	BuildDir string
@@ -9,4 +11,69 @@ type InstallEnv struct {
 
 	// Start a shell
 	StartShell bool
+
+	// Directory to write build logs to. No logs are written if empty.
+	LogDir string
+
+	// Directory to keep the signature records of installed packages in,
+	// for why-rebuild. No records are kept if empty.
+	SigDir string
+
+	// Directory to cache downloads in, by their sum. Downloads aren't
+	// cached if empty.
+	CacheDir string
+
+	// Directory to keep clones of the repos used by git() in, so that
+	// fetching new revisions is incremental. Repos are cloned into a
+	// temporary dir if empty.
+	GitCacheDir string
+
+	// Base URLs of the mirrors that mirror://name/ URLs are downloaded
+	// from, by name.
+	Mirrors dlcache.Mirrors
+
+	// Don't access the network. Downloads must already be in CacheDir and
+	// fetch() instances in StoreDir, otherwise the install fails with an
+	// error wrapping dlcache.ErrOffline that names the missing one.
+	Offline bool
+
+	// Directory to move the build and output dirs of failed builds into.
+	// They're removed if empty.
+	FailedDir string
+
+	// Start a shell where a build failed, with the same environment the
+	// failing statement ran with.
+	ShellOnFailure bool
+
+	// Run the build inside a sandbox that only exposes the declared
+	// dependencies. Only supported on Linux.
+	Sandbox bool
+
+	// Shell on the host to expose as /bin/sh inside the sandbox.
+	SandboxShell string
+
+	// Run builds and tests with the host's network. Otherwise only
+	// packages that declare they need the network get it, as isolating
+	// it requires user namespaces.
+	NoIsolateNetwork bool
+
+	// What to do when a package's output refers to the build dir, the temp
+	// dir or ImpurityPaths. One of ImpurityWarn (the default), ImpurityFail
+	// or ImpurityIgnore.
+	ImpurityPolicy string
+
+	// Host paths, such as $HOME, that packages must not refer to.
+	ImpurityPaths []string
+
+	// Run the tests of each package after it's built, failing the build
+	// if they fail.
+	RunTests bool
+
+	// Only run some of the phases of the package with the id PhaseID.
+	// It's build dir is kept under PhaseDir between runs, rather than
+	// being created in BuildDir.
+	PhaseID    string
+	FromPhase  string
+	UntilPhase string
+	PhaseDir   string
 }
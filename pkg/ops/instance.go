@@ -18,6 +18,10 @@ type Instance struct {
 	Fn           exprcore.Callable
 	Dependencies []*ScriptPackage
 
+	// Set for instances created by fetch(). As their output is checked
+	// against a declared hash, they're the only ones given network access.
+	Fetch bool
+
 	Work *evt.Statements
 }
 
@@ -0,0 +1,16 @@
+package ops
+
+import (
+	"os"
+	"testing"
+
+	"github.com/lab47/chell/pkg/evt"
+)
+
+// Install statements run isolated by re-executing the current binary, which
+// for tests is the test binary.
+func TestMain(m *testing.M) {
+	evt.SandboxInit()
+
+	os.Exit(m.Run())
+}
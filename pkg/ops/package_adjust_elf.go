@@ -0,0 +1,389 @@
+package ops
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNoRoom = errors.New("not enough room in the binary")
+
+// elfFile is an ELF binary opened for rewriting it's dynamic section in
+// place. Nothing is ever moved or grown, so this only works when the linker
+// left enough room, which is why builds are linked with an rpath containing
+// every dependency's lib dir. Those are then pruned down here to the ones
+// that are actually needed.
+type elfFile struct {
+	f  *os.File
+	ef *elf.File
+
+	dynOff  int64
+	entSize int64
+	dyn     []elfDyn
+
+	strOff int64
+	strtab []byte
+}
+
+type elfDyn struct {
+	tag elf.DynTag
+	val uint64
+}
+
+func openELF(path string) (*elfFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+
+	e := &elfFile{f: f, ef: ef}
+
+	if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+		e.Close()
+		return nil, nil
+	}
+
+	err = e.readDynamic()
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *elfFile) Close() error {
+	e.ef.Close()
+	return e.f.Close()
+}
+
+func (e *elfFile) readDynamic() error {
+	var dynProg *elf.Prog
+
+	for _, p := range e.ef.Progs {
+		if p.Type == elf.PT_DYNAMIC {
+			dynProg = p
+			break
+		}
+	}
+
+	// Statically linked
+	if dynProg == nil {
+		return nil
+	}
+
+	e.entSize = 16
+	if e.ef.Class == elf.ELFCLASS32 {
+		e.entSize = 8
+	}
+
+	data := make([]byte, dynProg.Filesz)
+
+	_, err := e.f.ReadAt(data, int64(dynProg.Off))
+	if err != nil {
+		return err
+	}
+
+	e.dynOff = int64(dynProg.Off)
+
+	var (
+		strAddr uint64
+		strSize uint64
+	)
+
+	bo := e.ef.ByteOrder
+
+loop:
+	for i := 0; i+int(e.entSize) <= len(data); i += int(e.entSize) {
+		var d elfDyn
+
+		if e.ef.Class == elf.ELFCLASS32 {
+			d.tag = elf.DynTag(int32(bo.Uint32(data[i:])))
+			d.val = uint64(bo.Uint32(data[i+4:]))
+		} else {
+			d.tag = elf.DynTag(int64(bo.Uint64(data[i:])))
+			d.val = bo.Uint64(data[i+8:])
+		}
+
+		e.dyn = append(e.dyn, d)
+
+		switch d.tag {
+		case elf.DT_NULL:
+			break loop
+		case elf.DT_STRTAB:
+			strAddr = d.val
+		case elf.DT_STRSZ:
+			strSize = d.val
+		}
+	}
+
+	if strAddr == 0 {
+		return fmt.Errorf("dynamic section without a string table")
+	}
+
+	off, ok := e.fileOffset(strAddr)
+	if !ok {
+		return fmt.Errorf("string table at unmapped address %x", strAddr)
+	}
+
+	e.strOff = off
+	e.strtab = make([]byte, strSize)
+
+	_, err = e.f.ReadAt(e.strtab, off)
+	return err
+}
+
+// fileOffset converts a virtual address to it's offset in the file.
+func (e *elfFile) fileOffset(addr uint64) (int64, bool) {
+	for _, p := range e.ef.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+
+		if addr >= p.Vaddr && addr < p.Vaddr+p.Filesz {
+			return int64(addr - p.Vaddr + p.Off), true
+		}
+	}
+
+	return 0, false
+}
+
+func (e *elfFile) str(off uint64) string {
+	if off >= uint64(len(e.strtab)) {
+		return ""
+	}
+
+	end := bytes.IndexByte(e.strtab[off:], 0)
+	if end == -1 {
+		return ""
+	}
+
+	return string(e.strtab[off : off+uint64(end)])
+}
+
+func (e *elfFile) needed() []string {
+	var libs []string
+
+	for _, d := range e.dyn {
+		if d.tag == elf.DT_NEEDED {
+			libs = append(libs, e.str(d.val))
+		}
+	}
+
+	return libs
+}
+
+// runpath returns the index of the DT_RUNPATH, or failing that DT_RPATH,
+// entry and it's value. The index is -1 if there is neither.
+func (e *elfFile) runpath() (int, string) {
+	idx := -1
+
+	for i, d := range e.dyn {
+		switch d.tag {
+		case elf.DT_RUNPATH:
+			return i, e.str(d.val)
+		case elf.DT_RPATH:
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		return -1, ""
+	}
+
+	return idx, e.str(e.dyn[idx].val)
+}
+
+// sharesString returns true if any other string in the dynamic string table
+// starts inside the string at off, as linkers merge strings that are a
+// suffix of another.
+func (e *elfFile) sharesString(off uint64, size int) bool {
+	inside := func(o uint64) bool {
+		return o > off && o <= off+uint64(size)
+	}
+
+	for _, d := range e.dyn {
+		switch d.tag {
+		case elf.DT_NEEDED, elf.DT_SONAME, elf.DT_RPATH, elf.DT_RUNPATH,
+			elf.DT_AUXILIARY, elf.DT_FILTER, elf.DT_CONFIG, elf.DT_DEPAUDIT, elf.DT_AUDIT:
+			if inside(d.val) {
+				return true
+			}
+		}
+	}
+
+	sec := e.ef.Section(".dynsym")
+	if sec == nil {
+		return false
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return true
+	}
+
+	symSize := 24
+	if e.ef.Class == elf.ELFCLASS32 {
+		symSize = 16
+	}
+
+	for i := 0; i+symSize <= len(data); i += symSize {
+		if inside(uint64(e.ef.ByteOrder.Uint32(data[i:]))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setRunpath replaces the DT_RUNPATH (or DT_RPATH, which is turned into a
+// DT_RUNPATH) string with path.
+func (e *elfFile) setRunpath(path string) error {
+	idx, cur := e.runpath()
+	if idx == -1 {
+		return errors.Wrapf(ErrNoRoom, "no existing runpath")
+	}
+
+	if len(path) > len(cur) {
+		return errors.Wrapf(ErrNoRoom, "runpath is %d bytes, need %d", len(cur), len(path))
+	}
+
+	off := e.dyn[idx].val
+
+	if e.sharesString(off, len(cur)) {
+		return errors.Wrapf(ErrNoRoom, "runpath shares it's string")
+	}
+
+	buf := make([]byte, len(cur))
+	copy(buf, path)
+
+	_, err := e.f.WriteAt(buf, e.strOff+int64(off))
+	if err != nil {
+		return err
+	}
+
+	if e.dyn[idx].tag == elf.DT_RUNPATH {
+		return nil
+	}
+
+	e.dyn[idx].tag = elf.DT_RUNPATH
+
+	tag := make([]byte, e.entSize/2)
+
+	if e.ef.Class == elf.ELFCLASS32 {
+		e.ef.ByteOrder.PutUint32(tag, uint32(elf.DT_RUNPATH))
+	} else {
+		e.ef.ByteOrder.PutUint64(tag, uint64(elf.DT_RUNPATH))
+	}
+
+	_, err = e.f.WriteAt(tag, e.dynOff+int64(idx)*e.entSize)
+	return err
+}
+
+// interp returns the PT_INTERP program header, if there is one.
+func (e *elfFile) interp() *elf.Prog {
+	for _, p := range e.ef.Progs {
+		if p.Type == elf.PT_INTERP {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// setInterp points PT_INTERP at path.
+func (e *elfFile) setInterp(path string) error {
+	p := e.interp()
+	if p == nil {
+		return nil
+	}
+
+	if uint64(len(path)+1) > p.Filesz {
+		return errors.Wrapf(ErrNoRoom, "interpreter is %d bytes, need %d", p.Filesz, len(path)+1)
+	}
+
+	buf := make([]byte, p.Filesz)
+	copy(buf, path)
+
+	_, err := e.f.WriteAt(buf, int64(p.Off))
+	return err
+}
+
+// adjustELF sets the runpath of the ELF binary at path to the dirs in
+// libDirs that provide it's DT_NEEDED libraries, keeping any $ORIGIN
+// relative and non-store entries. If interp is set, the binary is also
+// pointed at it as the dynamic loader.
+func (p *PackageAdjustNames) adjustELF(path string) error {
+	e, err := openELF(path)
+	if err != nil || e == nil {
+		return err
+	}
+
+	defer e.Close()
+
+	if len(e.dyn) == 0 {
+		return nil
+	}
+
+	_, cur := e.runpath()
+
+	var (
+		dirs []string
+		seen = map[string]bool{}
+	)
+
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, lib := range e.needed() {
+		for _, dir := range p.libDirs {
+			if _, err := os.Stat(filepath.Join(dir, lib)); err == nil {
+				add(dir)
+				break
+			}
+		}
+	}
+
+	for _, dir := range filepath.SplitList(cur) {
+		if dir == "" {
+			continue
+		}
+
+		if strings.HasPrefix(dir, "$ORIGIN") || !strings.HasPrefix(dir, p.storeDir+"/") {
+			add(dir)
+		}
+	}
+
+	runpath := strings.Join(dirs, ":")
+
+	if runpath != cur {
+		err = e.setRunpath(runpath)
+		if err != nil {
+			return errors.Wrapf(err, "unable to set runpath to %s", runpath)
+		}
+	}
+
+	if p.interpreter != "" {
+		err = e.setInterp(p.interpreter)
+		if err != nil {
+			return errors.Wrapf(err, "unable to set interpreter to %s", p.interpreter)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package ops
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageAdjustELF(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ELF binaries are only built on linux")
+	}
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	store := filepath.Join(top, "store")
+	fooLib := filepath.Join(store, "abc-foo-1.0", "lib")
+	barLib := filepath.Join(store, "abc-bar-1.0", "lib")
+	out := filepath.Join(store, "abc-test-1.0", "bin")
+
+	for _, dir := range []string{fooLib, barLib, out} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+
+	src := filepath.Join(top, "src")
+	require.NoError(t, os.Mkdir(src, 0755))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "foo.c"), []byte("int foo() { return 42; }\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "main.c"), []byte("int foo();\nint main() { return foo() == 42 ? 0 : 1; }\n"), 0644))
+
+	run := func(args ...string) {
+		cmd := exec.Command(cc, args...)
+		cmd.Dir = src
+
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+
+	run("-shared", "-fPIC", "-o", filepath.Join(fooLib, "libfoo.so"), "foo.c")
+
+	runpath := func(path string) string {
+		ef, err := elf.Open(path)
+		require.NoError(t, err)
+
+		defer ef.Close()
+
+		vals, err := ef.DynString(elf.DT_RUNPATH)
+		require.NoError(t, err)
+
+		if len(vals) == 0 {
+			return ""
+		}
+
+		return vals[0]
+	}
+
+	t.Run("prunes the runpath to the dirs of needed libraries", func(t *testing.T) {
+		bin := filepath.Join(out, "test")
+
+		run("-o", bin, "main.c", "-L"+fooLib, "-lfoo",
+			"-Wl,--disable-new-dtags",
+			"-Wl,-rpath,"+barLib+":"+fooLib+":$ORIGIN/../lib")
+
+		pan := PackageAdjustNames{
+			storeDir: store,
+			libDirs:  []string{barLib, fooLib},
+		}
+
+		require.NoError(t, pan.Adjust(filepath.Join(store, "abc-test-1.0")))
+
+		assert.Equal(t, fooLib+":$ORIGIN/../lib", runpath(bin))
+
+		require.NoError(t, exec.Command(bin).Run())
+	})
+
+	t.Run("reports when there is no room for the runpath", func(t *testing.T) {
+		bin := filepath.Join(out, "test2")
+
+		run("-o", bin, "main.c", "-L"+fooLib, "-lfoo")
+
+		pan := PackageAdjustNames{
+			storeDir: store,
+			libDirs:  []string{fooLib},
+		}
+
+		err := pan.adjustELF(bin)
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrNoRoom))
+	})
+}
@@ -1,7 +1,9 @@
 package ops
 
 import (
+	"bytes"
 	"debug/macho"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,9 +11,28 @@ import (
 )
 
 type PackageAdjustNames struct {
+	common
+
+	storeDir string
+
+	// Lib dirs of the package and it's dependencies, searched in order for
+	// the libraries ELF binaries need.
+	libDirs []string
+
+	// Dynamic loader to point ELF executables at. Left alone if empty.
+	interpreter string
 }
 
 func (p *PackageAdjustNames) Adjust(dir string) error {
+	err := p.adjustMachO(dir)
+	if err != nil {
+		return err
+	}
+
+	return p.adjustELFs(dir)
+}
+
+func (p *PackageAdjustNames) adjustMachO(dir string) error {
 	path, err := exec.LookPath("install_name_tool")
 	if err != nil || path == "" {
 		return nil
@@ -60,3 +81,48 @@ func (p *PackageAdjustNames) Adjust(dir string) error {
 
 	return nil
 }
+
+var elfMagic = []byte("\x7fELF")
+
+func (p *PackageAdjustNames) adjustELFs(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || info.Size() < int64(len(elfMagic)) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		magic := make([]byte, len(elfMagic))
+		_, err = io.ReadFull(f, magic)
+		f.Close()
+
+		if err != nil || !bytes.Equal(magic, elfMagic) {
+			return nil
+		}
+
+		if perm := info.Mode().Perm(); perm&0200 == 0 {
+			err = os.Chmod(path, perm|0200)
+			if err != nil {
+				return err
+			}
+
+			defer os.Chmod(path, perm)
+		}
+
+		// A binary that can't be adjusted shouldn't stop the others from
+		// being adjusted.
+		err = p.adjustELF(path)
+		if err != nil {
+			p.L().Warn("unable to adjust ELF binary", "path", path, "error", err)
+		}
+
+		return nil
+	})
+}
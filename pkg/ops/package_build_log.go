@@ -0,0 +1,196 @@
+package ops
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PackageBuildLog manages the logs of package builds. Each build writes
+// it's log to <id>.log while running, which is compressed once the build
+// finishes, into <id>.log.gz or <id>.failed.log.gz depending on the outcome.
+type PackageBuildLog struct {
+	logDir string
+}
+
+const (
+	logSuffix       = ".log.gz"
+	failedLogSuffix = ".failed.log.gz"
+)
+
+type BuildLogWriter struct {
+	mu sync.Mutex
+
+	dir string
+	id  string
+	f   *os.File
+}
+
+// Create starts a new log for building id.
+func (p *PackageBuildLog) Create(id string) (*BuildLogWriter, error) {
+	err := os.MkdirAll(p.logDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(filepath.Join(p.logDir, id+".log"))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(f, "build of %s started at %s\n", id, time.Now().Format(time.RFC3339))
+
+	return &BuildLogWriter{dir: p.logDir, id: id, f: f}, nil
+}
+
+func (b *BuildLogWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.f.Write(p)
+}
+
+// Finish records the outcome of the build and compresses the log.
+func (b *BuildLogWriter) Finish(buildErr error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	suffix := logSuffix
+
+	switch {
+	case buildErr == nil:
+		fmt.Fprintf(b.f, "build finished\n")
+	case errors.Is(buildErr, ErrBuildStopped):
+		// Stopped after the UntilPhase of the InstallEnv, which isn't a failure.
+		fmt.Fprintf(b.f, "build stopped: %s\n", buildErr)
+	default:
+		fmt.Fprintf(b.f, "build failed: %s\n", buildErr)
+		suffix = failedLogSuffix
+	}
+
+	path := b.f.Name()
+
+	_, err := b.f.Seek(0, io.SeekStart)
+	if err != nil {
+		b.f.Close()
+		return err
+	}
+
+	defer os.Remove(path)
+	defer b.f.Close()
+
+	// A previous build might have left a log with the other outcome.
+	os.Remove(filepath.Join(b.dir, b.id+logSuffix))
+	os.Remove(filepath.Join(b.dir, b.id+failedLogSuffix))
+
+	out, err := ioutil.TempFile(b.dir, b.id+".gz")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+
+	_, err = io.Copy(gw, b.f)
+	if err != nil {
+		return err
+	}
+
+	err = gw.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), filepath.Join(b.dir, b.id+suffix))
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Open returns the log for the last build of id. The log of a build that is
+// still running is returned as is.
+func (p *PackageBuildLog) Open(id string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(p.logDir, id+".log"))
+	if err == nil {
+		return f, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, suffix := range []string{logSuffix, failedLogSuffix} {
+		f, err := os.Open(filepath.Join(p.logDir, id+suffix))
+		if err != nil {
+			continue
+		}
+
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "corrupt log for %s", id)
+		}
+
+		return &gzipReadCloser{Reader: gr, f: f}, nil
+	}
+
+	return nil, errors.Wrapf(ErrNotFound, "no build log for %s", id)
+}
+
+type FailedBuild struct {
+	Id   string
+	Time time.Time
+}
+
+// Failed returns up to limit of the most recent failed builds, newest first.
+func (p *PackageBuildLog) Failed(limit int) ([]FailedBuild, error) {
+	entries, err := ioutil.ReadDir(p.logDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var failed []FailedBuild
+
+	for _, ent := range entries {
+		if !strings.HasSuffix(ent.Name(), failedLogSuffix) {
+			continue
+		}
+
+		failed = append(failed, FailedBuild{
+			Id:   strings.TrimSuffix(ent.Name(), failedLogSuffix),
+			Time: ent.ModTime(),
+		})
+	}
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Time.After(failed[j].Time)
+	})
+
+	if limit > 0 && len(failed) > limit {
+		failed = failed[:limit]
+	}
+
+	return failed, nil
+}
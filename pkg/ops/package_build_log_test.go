@@ -0,0 +1,175 @@
+package ops
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageBuildLog(t *testing.T) {
+	t.Run("compresses the log once the build finishes", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		var pbl PackageBuildLog
+		pbl.logDir = filepath.Join(dir, "logs")
+
+		w, err := pbl.Create("abc-test-1.0")
+		require.NoError(t, err)
+
+		fmt.Fprintln(w, "compiling stuff")
+
+		r, err := pbl.Open("abc-test-1.0")
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		r.Close()
+
+		assert.Contains(t, string(data), "compiling stuff")
+
+		require.NoError(t, w.Finish(nil))
+
+		_, err = os.Stat(filepath.Join(pbl.logDir, "abc-test-1.0.log"))
+		assert.True(t, os.IsNotExist(err))
+
+		r, err = pbl.Open("abc-test-1.0")
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		data, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(data), "compiling stuff\nbuild finished\n")
+
+		failed, err := pbl.Failed(0)
+		require.NoError(t, err)
+
+		assert.Empty(t, failed)
+	})
+
+	t.Run("lists failed builds", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		var pbl PackageBuildLog
+		pbl.logDir = dir
+
+		w, err := pbl.Create("abc-test-1.0")
+		require.NoError(t, err)
+
+		fmt.Fprintln(w, "compiling stuff")
+
+		require.NoError(t, w.Finish(io.EOF))
+
+		r, err := pbl.Open("abc-test-1.0")
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(data), "build failed: EOF")
+
+		failed, err := pbl.Failed(0)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(failed))
+		assert.Equal(t, "abc-test-1.0", failed[0].Id)
+	})
+
+	t.Run("doesn't count a stopped build as failed", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		var pbl PackageBuildLog
+		pbl.logDir = dir
+
+		w, err := pbl.Create("abc-test-1.0")
+		require.NoError(t, err)
+
+		require.NoError(t, w.Finish(errors.Wrapf(ErrBuildStopped, "stopped after build")))
+
+		r, err := pbl.Open("abc-test-1.0")
+		require.NoError(t, err)
+
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		assert.Contains(t, string(data), "build stopped: stopped after build")
+
+		_, err = os.Stat(filepath.Join(dir, "abc-test-1.0"+logSuffix))
+		require.NoError(t, err)
+
+		failed, err := pbl.Failed(0)
+		require.NoError(t, err)
+
+		assert.Empty(t, failed)
+	})
+
+	t.Run("returns the log of a rebuild that is still running", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		var pbl PackageBuildLog
+		pbl.logDir = dir
+
+		w, err := pbl.Create("abc-test-1.0")
+		require.NoError(t, err)
+
+		fmt.Fprintln(w, "first build")
+
+		require.NoError(t, w.Finish(io.EOF))
+
+		w, err = pbl.Create("abc-test-1.0")
+		require.NoError(t, err)
+
+		fmt.Fprintln(w, "second build")
+
+		r, err := pbl.Open("abc-test-1.0")
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		r.Close()
+
+		assert.Contains(t, string(data), "second build")
+		assert.NotContains(t, string(data), "first build")
+
+		require.NoError(t, w.Finish(nil))
+	})
+
+	t.Run("errors when there is no log", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		var pbl PackageBuildLog
+		pbl.logDir = dir
+
+		_, err = pbl.Open("abc-test-1.0")
+		assert.Error(t, err)
+	})
+}
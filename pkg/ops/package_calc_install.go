@@ -3,8 +3,6 @@ package ops
 import (
 	"context"
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/lab47/chell/pkg/data"
 	"github.com/pkg/errors"
@@ -50,22 +48,7 @@ func (p *PackageCalcInstall) isInstalled(id string) (bool, error) {
 		return false, nil
 	}
 
-	path := filepath.Join(p.StoreDir, id)
-
-	fi, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-
-		return false, err
-	}
-
-	if fi.IsDir() {
-		return true, nil
-	}
-
-	return false, errors.Wrapf(ErrCorruption, "store path not a dir: %s", path)
+	return storeInstalled(p.StoreDir, id)
 }
 
 func (p *PackageCalcInstall) consider(
@@ -157,7 +140,8 @@ func (p *PackageCalcInstall) consider(
 		seen[dep.ID()] = 1
 
 		sp := &ScriptPackage{
-			id: dep.ID(),
+			id:      dep.ID(),
+			network: dep.Fetch,
 		}
 
 		sp.cs.Dependencies = dep.Dependencies
@@ -0,0 +1,245 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lab47/chell/pkg/data"
+	"github.com/pkg/errors"
+)
+
+// PackageCheck rebuilds an installed package and compares the result to
+// what is installed, to verify that the build is reproducible.
+type PackageCheck struct {
+	common
+
+	ienv *InstallEnv
+}
+
+type CheckResult struct {
+	Differences []TreeDifference
+}
+
+func (c *CheckResult) Reproducible() bool {
+	return len(c.Differences) == 0
+}
+
+const pkgInfoFile = ".pkg-info.json"
+
+// Check rebuilds pkg and diffs the output against the installed copy,
+// recording the result in the package info.
+//
+// The installed copy is never touched, so the rebuild happens in a scratch
+// store next to the real one, with the rest of the store linked into it.
+// Paths of the scratch store are the same length as the real one, so they
+// can be swapped back in when comparing the outputs.
+func (p *PackageCheck) Check(ctx context.Context, pkg *ScriptPackage) (*CheckResult, error) {
+	storeDir := p.ienv.StoreDir
+	id := pkg.ID()
+
+	lock, err := lockStore(ctx, storeDir, id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer lock.Unlock()
+
+	installed, err := storeInstalled(storeDir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !installed {
+		return nil, errors.Wrapf(ErrNotFound, "%s is not installed", id)
+	}
+
+	scratch, err := checkStoreDir(storeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer removeFrozen(scratch)
+
+	err = linkStore(storeDir, scratch, pkg.OutputIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	ienv := *p.ienv
+	ienv.StoreDir = scratch
+
+	si := &ScriptInstall{common: p.common, pkg: pkg}
+
+	err = si.Install(ctx, &ienv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to rebuild %s", id)
+	}
+
+	sd := StoreDiff{
+		ignore:      map[string]struct{}{pkgInfoFile: {}},
+		rewriteFrom: scratch,
+		rewriteTo:   storeDir,
+	}
+
+	var diffs []TreeDifference
+
+	for _, name := range pkg.Outputs() {
+		oid := pkg.OutputID(name)
+
+		od, err := sd.Diff(filepath.Join(storeDir, oid), filepath.Join(scratch, oid))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range od {
+			if name != MainOutput {
+				d.Path = name + ":" + d.Path
+			}
+
+			diffs = append(diffs, d)
+		}
+	}
+
+	res := &CheckResult{Differences: diffs}
+
+	pc := &data.PackageCheck{
+		Time:         time.Now(),
+		Reproducible: res.Reproducible(),
+	}
+
+	for _, d := range diffs {
+		pc.Differences = append(pc.Differences, d.String())
+	}
+
+	err = p.record(pkg, pc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to record check of %s", id)
+	}
+
+	return res, nil
+}
+
+// checkStoreDir creates an empty scratch store next to storeDir to rebuild
+// packages in. It's path is the same length as storeDir, so replacing one
+// with the other in a file doesn't move anything else in it.
+func checkStoreDir(storeDir string) (string, error) {
+	base := filepath.Base(storeDir)
+
+	name := "." + base[1:]
+	if base[0] == '.' {
+		name = "_" + base[1:]
+	}
+
+	dir := filepath.Join(filepath.Dir(storeDir), name)
+
+	// Cleanup after a check that was interrupted.
+	err := removeFrozen(dir)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// linkStore links everything installed in storeDir, other than the outputs
+// being rebuilt, into scratch so that the dependencies of the rebuild are
+// found there.
+func linkStore(storeDir, scratch string, rebuild []string) error {
+	skip := make(map[string]bool)
+	for _, id := range rebuild {
+		skip[id] = true
+	}
+
+	entries, err := ioutil.ReadDir(storeDir)
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range entries {
+		if skip[ent.Name()] || strings.HasPrefix(ent.Name(), ".") || !ent.IsDir() {
+			continue
+		}
+
+		err = os.Symlink(filepath.Join(storeDir, ent.Name()), filepath.Join(scratch, ent.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// record adds pc to the package info of the installed package. The store
+// dir is frozen, so it's made writable just long enough to update it.
+func (p *PackageCheck) record(pkg *ScriptPackage, pc *data.PackageCheck) error {
+	// Read the info of the installed copy rather than the rebuild.
+	pkg.infoMu.Lock()
+	pkg.PackageInfo = nil
+	pkg.infoMu.Unlock()
+
+	var pri PackageReadInfo
+	pri.storeDir = p.ienv.StoreDir
+
+	pi, err := pri.Read(pkg)
+	if err != nil {
+		return err
+	}
+
+	pi.Check = pc
+
+	dir := filepath.Join(p.ienv.StoreDir, pkg.ID())
+	path := filepath.Join(dir, pkgInfoFile)
+
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	defer os.Chmod(dir, 0555)
+
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	err = json.NewEncoder(f).Encode(pi)
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp, 0444)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// removeFrozen removes a store dir that was frozen by StoreFreeze.
+func removeFrozen(dir string) error {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0755)
+		}
+
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
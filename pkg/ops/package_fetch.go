@@ -0,0 +1,190 @@
+package ops
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lab47/chell/pkg/dlcache"
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/pkg/errors"
+)
+
+// PackageFetch downloads everything that installing a set of packages
+// needs from the network, so that they can later be installed with
+// InstallEnv.Offline set.
+type PackageFetch struct {
+	common
+
+	ienv *InstallEnv
+
+	// Maximum number of fetch() instances to build at the same time.
+	Jobs int
+
+	// The downloads that were added to the cache and the fetch() instances
+	// that were built.
+	Downloaded []string
+	Instances  []string
+
+	// Downloads that can't be cached, as they have no sum or only an etag.
+	// They're downloaded again by each build that uses them.
+	Uncacheable []string
+}
+
+// Fetch adds the file() inputs and download statements of the packages in
+// toInstall to the download cache, and builds their fetch() instances along
+// with whatever they depend on.
+func (p *PackageFetch) Fetch(ctx context.Context, toInstall *PackagesToInstall) error {
+	if p.ienv.CacheDir == "" {
+		return fmt.Errorf("no download cache configured")
+	}
+
+	cache := dlcache.New(p.ienv.CacheDir)
+
+	var instances []string
+
+	for _, id := range toInstall.InstallOrder {
+		pkg, ok := toInstall.Scripts[id]
+		if !ok {
+			continue
+		}
+
+		if pkg.network {
+			instances = append(instances, id)
+			continue
+		}
+
+		for _, in := range pkg.cs.Inputs {
+			if in.Instance != nil || in.Data.dir != "" || in.Data.data != nil {
+				continue
+			}
+
+			if _, _, ok := in.Data.Sum(); !ok {
+				return fmt.Errorf("missing sum: %s", in.Data.path)
+			}
+
+			err := p.fetch(ctx, cache, in.Data.URLs(), in.Data.knownSum())
+			if err != nil {
+				return err
+			}
+		}
+
+		if pkg.cs.Work == nil {
+			continue
+		}
+
+		for _, dl := range evt.Downloads(pkg.cs.Work) {
+			if dl.Sum == nil {
+				p.Uncacheable = append(p.Uncacheable, dl.URL)
+				continue
+			}
+
+			err := p.fetch(ctx, cache, append([]string{dl.URL}, dl.Mirrors...), dl.Sum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(instances) == 0 {
+		return nil
+	}
+
+	pi := &PackagesInstall{ienv: p.ienv, Jobs: p.Jobs}
+	pi.SetLogger(p.L())
+
+	err := pi.Install(ctx, instanceSet(toInstall, instances))
+	if err != nil {
+		return err
+	}
+
+	p.Instances = instances
+
+	return nil
+}
+
+// fetch adds the file at urls, the first of which names it, to the cache if
+// it isn't there yet. ks is the sum it was declared with.
+func (p *PackageFetch) fetch(ctx context.Context, cache *dlcache.Cache, urls []string, ks *evt.KnownSum) error {
+	sum, err := ks.Decode()
+	if err != nil {
+		return errors.Wrapf(err, "bad sum for %s", urls[0])
+	}
+
+	if !sum.Cacheable() {
+		p.Uncacheable = append(p.Uncacheable, urls[0])
+		return nil
+	}
+
+	if cache.Has(sum) {
+		return nil
+	}
+
+	if p.ienv.Offline {
+		return evt.OfflineError(urls[0], ks)
+	}
+
+	expanded, err := p.ienv.Mirrors.Expand(urls)
+	if err != nil {
+		return err
+	}
+
+	GetUI(ctx).DownloadInput(urls[0], sum.Type, sum.Value)
+
+	_, err = dlcache.TryEach(expanded, func(url string) error {
+		return cache.Fetch(ctx, url, sum)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.Downloaded = append(p.Downloaded, urls[0])
+
+	return nil
+}
+
+// instanceSet returns the subset of toInstall needed to build the packages
+// in ids, which is them and everything they depend on.
+func instanceSet(toInstall *PackagesToInstall, ids []string) *PackagesToInstall {
+	needed := make(map[string]bool)
+
+	var mark func(id string)
+
+	mark = func(id string) {
+		if needed[id] {
+			return
+		}
+
+		needed[id] = true
+
+		for _, dep := range toInstall.Dependencies[id] {
+			mark(dep)
+		}
+	}
+
+	for _, id := range ids {
+		mark(id)
+	}
+
+	sub := &PackagesToInstall{
+		Installers:   make(map[string]PackageInstaller),
+		Dependencies: toInstall.Dependencies,
+		Scripts:      make(map[string]*ScriptPackage),
+		Installed:    toInstall.Installed,
+	}
+
+	for _, id := range toInstall.InstallOrder {
+		if !needed[id] {
+			continue
+		}
+
+		sub.PackageIDs = append(sub.PackageIDs, id)
+		sub.InstallOrder = append(sub.InstallOrder, id)
+		sub.Installers[id] = toInstall.Installers[id]
+
+		if pkg, ok := toInstall.Scripts[id]; ok {
+			sub.Scripts[id] = pkg
+		}
+	}
+
+	return sub
+}
@@ -0,0 +1,98 @@
+package ops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lab47/chell/pkg/dlcache"
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageFetch(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	var requests int
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	defer serv.Close()
+
+	sum := func(str string) string {
+		h := sha256.Sum256([]byte(str))
+		return hex.EncodeToString(h[:])
+	}
+
+	pkg := &ScriptPackage{id: "abc-pkg-1.0", name: "pkg"}
+	pkg.cs.Inputs = []ScriptInput{
+		{
+			Name: "src",
+			Data: &ScriptFile{path: serv.URL + "/src.tar.gz", sumType: "sha256", sumValue: sum("/src.tar.gz")},
+		},
+	}
+	pkg.cs.Work = &evt.Statements{
+		Statements: []evt.EVTNode{
+			&evt.Phase{Name: "fetch", Body: &evt.Statements{
+				Statements: []evt.EVTNode{
+					&evt.Download{
+						URL:  serv.URL + "/patch.diff",
+						Path: "patch.diff",
+						Sum:  &evt.KnownSum{Type: "sha256", Value: sum("/patch.diff")},
+					},
+					&evt.Download{URL: serv.URL + "/latest", Path: "latest"},
+				},
+			}},
+		},
+	}
+
+	var pti PackagesToInstall
+	pti.InstallOrder = []string{pkg.ID()}
+	pti.Scripts = map[string]*ScriptPackage{pkg.ID(): pkg}
+
+	ienv := &InstallEnv{CacheDir: filepath.Join(top, "cache")}
+
+	t.Run("reports downloads missing from the cache when offline", func(t *testing.T) {
+		pf := &PackageFetch{ienv: &InstallEnv{CacheDir: ienv.CacheDir, Offline: true}}
+
+		err := pf.Fetch(context.Background(), &pti)
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, dlcache.ErrOffline))
+		assert.Contains(t, err.Error(), serv.URL+"/src.tar.gz (sha256:"+sum("/src.tar.gz")+")")
+		assert.Equal(t, 0, requests)
+	})
+
+	t.Run("adds inputs and downloads to the cache", func(t *testing.T) {
+		pf := &PackageFetch{ienv: ienv}
+
+		require.NoError(t, pf.Fetch(context.Background(), &pti))
+
+		assert.Equal(t, []string{serv.URL + "/src.tar.gz", serv.URL + "/patch.diff"}, pf.Downloaded)
+		assert.Equal(t, []string{serv.URL + "/latest"}, pf.Uncacheable)
+
+		h, _ := hex.DecodeString(sum("/patch.diff"))
+		assert.True(t, dlcache.New(ienv.CacheDir).Has(dlcache.Sum{Type: "sha256", Value: h}))
+
+		pf = &PackageFetch{ienv: &InstallEnv{CacheDir: ienv.CacheDir, Offline: true}}
+
+		require.NoError(t, pf.Fetch(context.Background(), &pti))
+
+		assert.Empty(t, pf.Downloaded)
+		assert.Equal(t, 2, requests)
+	})
+}
@@ -13,11 +13,14 @@ type PackageReadInfo struct {
 }
 
 func (p *PackageReadInfo) Read(pkg *ScriptPackage) (*data.PackageInfo, error) {
+	pkg.infoMu.Lock()
+	defer pkg.infoMu.Unlock()
+
 	if pkg.PackageInfo != nil {
 		return pkg.PackageInfo, nil
 	}
 
-	path := filepath.Join(p.storeDir, pkg.ID(), ".pkg-info.json")
+	path := filepath.Join(p.storeDir, pkg.ID(), pkgInfoFile)
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,108 @@
+package ops
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/pkg/errors"
+)
+
+var ErrNoTests = errors.New("package has no test function")
+
+// PackageTest runs the test function of installed packages.
+type PackageTest struct {
+	common
+
+	ienv *InstallEnv
+}
+
+// Test runs the tests of pkg against it's installed store dir.
+func (p *PackageTest) Test(ctx context.Context, pkg *ScriptPackage) error {
+	if pkg.cs.Test == nil {
+		return errors.Wrapf(ErrNoTests, "unable to test %s", pkg.ID())
+	}
+
+	installed, err := storeInstalled(p.ienv.StoreDir, pkg.ID())
+	if err != nil {
+		return err
+	}
+
+	if !installed {
+		return errors.Wrapf(ErrNotFound, "%s is not installed", pkg.ID())
+	}
+
+	return p.run(ctx, pkg)
+}
+
+// run runs the tests of pkg with only the package and it's runtime deps
+// on the PATH. Tests have no network access and can't change the package,
+// as it's store dir is frozen.
+func (p *PackageTest) run(ctx context.Context, pkg *ScriptPackage) error {
+	ui := GetUI(ctx)
+
+	ui.RunTests(pkg)
+
+	work, err := pkg.cs.calcWork(pkg.cs.Test)
+	if err != nil {
+		return err
+	}
+
+	var pri PackageReadInfo
+	pri.storeDir = p.ienv.StoreDir
+
+	pi, err := pri.Read(pkg)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read info of %s", pkg.ID())
+	}
+
+	dirs := append([]string{pkg.ID()}, pi.RuntimeDeps...)
+
+	var (
+		path    []string
+		sandbox *evt.Sandbox
+	)
+
+	if p.ienv.Sandbox {
+		sandbox = &evt.Sandbox{Shell: p.ienv.SandboxShell}
+	}
+
+	for _, id := range dirs {
+		dir := filepath.Join(p.ienv.StoreDir, id)
+
+		path = append(path, filepath.Join(dir, "bin"))
+
+		if sandbox != nil {
+			sandbox.Paths = append(sandbox.Paths, dir)
+		}
+	}
+
+	testDir, err := ioutil.TempDir(p.ienv.BuildDir, "test-"+pkg.ID())
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(testDir)
+
+	ev := evt.NewEvaluator(p.L(), evt.EvaluatorEnv{
+		Context:      ctx,
+		WorkingDir:   testDir,
+		OutputDir:    filepath.Join(p.ienv.StoreDir, pkg.ID()),
+		OutputPrefix: pkg.Name() + " test",
+		Environ:      []string{"HOME=/nonexistant", "PATH=" + strings.Join(path, ":")},
+		Observer:     &installObserver{ui: ui, pkg: pkg},
+		Sandbox:      sandbox,
+
+		IsolateNetwork: !p.ienv.NoIsolateNetwork,
+	})
+
+	err = ev.Eval(work)
+	if err != nil {
+		return errors.Wrapf(err, "tests of %s failed", pkg.ID())
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lab47/chell/pkg/evt"
+	"github.com/pkg/errors"
+)
+
+var ErrNoPreviousBuild = errors.New("no previous build installed")
+
+// SigRecord is everything a package's signature is calculated from, in a
+// form that's kept while the package is installed so that it can be compared
+// with the package as it evaluates later.
+type SigRecord struct {
+	Id           string            `json:"id"`
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Constraints  map[string]string `json:"constraints,omitempty"`
+	Instances    []string          `json:"instances,omitempty"`
+	Work         []string          `json:"work,omitempty"`
+	Dependencies []string          `json:"dependencies,omitempty"`
+	Outputs      []string          `json:"outputs,omitempty"`
+	Inputs       []string          `json:"inputs,omitempty"`
+}
+
+// SigChange is a difference between two SigRecords. Old is empty for
+// something added and New for something removed.
+type SigChange struct {
+	Field string
+	Old   string
+	New   string
+
+	// For a dependency that changed, the changes to it, if the record of
+	// the previous build of it is installed.
+	Changes []*SigChange
+}
+
+// PackageWhyRebuild explains why a package has a different ID than the last
+// build of it that was installed.
+type PackageWhyRebuild struct {
+	common
+
+	storeDir string
+	sigDir   string
+}
+
+// Explain compares pkg to the most recently installed build of a package
+// with the same name, returning the ID of that build and what changed. It
+// returns ErrNoPreviousBuild if there isn't one.
+func (p *PackageWhyRebuild) Explain(pkg *ScriptPackage) (string, []*SigChange, error) {
+	if pkg.cs.Record == nil {
+		return "", nil, fmt.Errorf("no signature record calculated for %s", pkg.ID())
+	}
+
+	prev, err := p.latest(pkg.Name(), pkg.ID())
+	if err != nil {
+		return "", nil, err
+	}
+
+	return prev.Id, p.diff(prev, pkg.cs.Record, pkg.Dependencies()), nil
+}
+
+// latest returns the record of the most recently installed build named name,
+// other than id.
+func (p *PackageWhyRebuild) latest(name, id string) (*SigRecord, error) {
+	entries, err := ioutil.ReadDir(p.sigDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrapf(ErrNoPreviousBuild, "%s", name)
+		}
+
+		return nil, err
+	}
+
+	var (
+		best     *SigRecord
+		bestTime int64
+	)
+
+	for _, ent := range entries {
+		entId := strings.TrimSuffix(ent.Name(), ".json")
+
+		if entId == id || !strings.Contains(entId, "-"+name+"-") {
+			continue
+		}
+
+		// Records outlive the packages they're for until the next gc.
+		if _, err := os.Stat(filepath.Join(p.storeDir, entId)); err != nil {
+			continue
+		}
+
+		path := filepath.Join(p.sigDir, ent.Name())
+
+		rec, err := readSigRecord(path)
+		if err != nil {
+			p.L().Warn("unable to read signature record", "path", path, "error", err)
+			continue
+		}
+
+		if rec.Name != name {
+			continue
+		}
+
+		if best == nil || ent.ModTime().UnixNano() > bestTime {
+			best = rec
+			bestTime = ent.ModTime().UnixNano()
+		}
+	}
+
+	if best == nil {
+		return nil, errors.Wrapf(ErrNoPreviousBuild, "%s", name)
+	}
+
+	return best, nil
+}
+
+func (p *PackageWhyRebuild) record(id string) *SigRecord {
+	rec, err := readSigRecord(sigRecordPath(p.sigDir, id))
+	if err != nil {
+		return nil
+	}
+
+	return rec
+}
+
+func (p *PackageWhyRebuild) diff(old, cur *SigRecord, deps []*ScriptPackage) []*SigChange {
+	var changes []*SigChange
+
+	if old.Name != cur.Name {
+		changes = append(changes, &SigChange{Field: "name", Old: old.Name, New: cur.Name})
+	}
+
+	if old.Version != cur.Version {
+		changes = append(changes, &SigChange{Field: "version", Old: old.Version, New: cur.Version})
+	}
+
+	changes = append(changes, diffLines("constraint", mapLines(old.Constraints), mapLines(cur.Constraints))...)
+	changes = append(changes, diffLines("instance", old.Instances, cur.Instances)...)
+	changes = append(changes, diffLines("input", old.Inputs, cur.Inputs)...)
+	changes = append(changes, diffLines("output", old.Outputs, cur.Outputs)...)
+	changes = append(changes, diffLines("work", old.Work, cur.Work)...)
+
+	return append(changes, p.diffDeps(old.Dependencies, cur.Dependencies, deps)...)
+}
+
+// diffDeps matches up dependencies by their name and version, as that's
+// what their IDs have after the signature, explaining the changes to those
+// that have a different ID.
+func (p *PackageWhyRebuild) diffDeps(old, cur []string, deps []*ScriptPackage) []*SigChange {
+	key := func(id string) string {
+		if idx := strings.IndexByte(id, '-'); idx != -1 {
+			return id[idx+1:]
+		}
+
+		return id
+	}
+
+	oldIds := make(map[string]string)
+	for _, id := range old {
+		oldIds[key(id)] = id
+	}
+
+	curIds := make(map[string]string)
+	for _, id := range cur {
+		curIds[key(id)] = id
+	}
+
+	var changes []*SigChange
+
+	for _, id := range old {
+		if _, ok := curIds[key(id)]; !ok {
+			changes = append(changes, &SigChange{Field: "dependency", Old: id})
+		}
+	}
+
+	for _, id := range cur {
+		oldId, ok := oldIds[key(id)]
+		if !ok {
+			changes = append(changes, &SigChange{Field: "dependency", New: id})
+			continue
+		}
+
+		if oldId == id {
+			continue
+		}
+
+		change := &SigChange{Field: "dependency", Old: oldId, New: id}
+
+		for _, dep := range deps {
+			if !dep.ownsID(id) || dep.cs.Record == nil {
+				continue
+			}
+
+			if prev := p.record(oldId); prev != nil {
+				change.Changes = p.diff(prev, dep.cs.Record, dep.Dependencies())
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// sigRecordPath returns the path that the signature record of the package
+// id is kept at in sigDir.
+func sigRecordPath(sigDir, id string) string {
+	return filepath.Join(sigDir, id+".json")
+}
+
+func readSigRecord(path string) (*SigRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec SigRecord
+
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func mapLines(m map[string]string) []string {
+	var lines []string
+
+	for k, v := range m {
+		lines = append(lines, k+"="+v)
+	}
+
+	sort.Strings(lines)
+
+	return lines
+}
+
+// diffLines returns the lines removed from old and added in cur, in the
+// order they appear, using the longest common subsequence of the two so
+// that a changed line in a long list is reported on it's own.
+func diffLines(field string, old, cur []string) []*SigChange {
+	// lcs[i][j] is the length of the LCS of old[i:] and cur[j:].
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(cur)+1)
+	}
+
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(cur) - 1; j >= 0; j-- {
+			switch {
+			case old[i] == cur[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var (
+		changes []*SigChange
+		i, j    int
+	)
+
+	for i < len(old) || j < len(cur) {
+		switch {
+		case i < len(old) && j < len(cur) && old[i] == cur[j]:
+			i++
+			j++
+		case j == len(cur) || (i < len(old) && lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, &SigChange{Field: field, Old: old[i]})
+			i++
+		default:
+			changes = append(changes, &SigChange{Field: field, New: cur[j]})
+			j++
+		}
+	}
+
+	return changes
+}
+
+// newSigRecord returns the record of what sd and the extras hashed after
+// it, the outputs and downloaded inputs, contain.
+func newSigRecord(sd *sigData, outputs, inputs []string) *SigRecord {
+	rec := &SigRecord{
+		Name:        sd.Name,
+		Version:     sd.Version,
+		Constraints: sd.Constraints,
+		Outputs:     outputs,
+		Inputs:      inputs,
+	}
+
+	for _, i := range sd.Instances {
+		rec.Instances = append(rec.Instances, fmt.Sprintf("%s-%s %s", i.Name, i.Version, i.Signature))
+	}
+
+	if sd.Work != nil {
+		rec.Work = evt.Flatten(sd.Work)
+	}
+
+	for id := range sd.Dependencies {
+		rec.Dependencies = append(rec.Dependencies, id)
+	}
+
+	sort.Strings(rec.Dependencies)
+
+	return rec
+}
@@ -0,0 +1,115 @@
+package ops
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageWhyRebuild(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	store := filepath.Join(top, "store")
+	sigs := filepath.Join(top, "sigs")
+
+	install := func(rec *SigRecord) {
+		require.NoError(t, os.MkdirAll(filepath.Join(store, rec.Id), 0755))
+
+		pwi := PackageWriteInfo{storeDir: store, sigDir: sigs}
+		require.NoError(t, pwi.writeSigRecord(rec.Id, rec))
+	}
+
+	install(&SigRecord{
+		Id:      "aaa-zlib-1.2",
+		Name:    "zlib",
+		Version: "1.2",
+		Work:    []string{`System {"Arguments":["./configure"],"Dir":""}`},
+	})
+
+	install(&SigRecord{
+		Id:           "bbb-tool-1.0",
+		Name:         "tool",
+		Version:      "1.0",
+		Dependencies: []string{"aaa-zlib-1.2"},
+		Work: []string{
+			`System {"Arguments":["make"],"Dir":""}`,
+			`System {"Arguments":["make","install"],"Dir":""}`,
+		},
+	})
+
+	zlib := &ScriptPackage{id: "ccc-zlib-1.2", name: "zlib"}
+	zlib.cs.Record = &SigRecord{
+		Id:      "ccc-zlib-1.2",
+		Name:    "zlib",
+		Version: "1.2",
+		Work:    []string{`System {"Arguments":["./configure","--static"],"Dir":""}`},
+	}
+
+	tool := &ScriptPackage{id: "ddd-tool-1.0", name: "tool"}
+	tool.cs.Dependencies = []*ScriptPackage{zlib}
+	tool.cs.Record = &SigRecord{
+		Id:           "ddd-tool-1.0",
+		Name:         "tool",
+		Version:      "1.0",
+		Constraints:  map[string]string{"os": "linux"},
+		Dependencies: []string{"ccc-zlib-1.2"},
+		Work: []string{
+			`System {"Arguments":["make"],"Dir":""}`,
+			`System {"Arguments":["make","install"],"Dir":""}`,
+		},
+	}
+
+	pw := PackageWhyRebuild{storeDir: store, sigDir: sigs}
+
+	t.Run("points at what changed, within dependencies too", func(t *testing.T) {
+		prev, changes, err := pw.Explain(tool)
+		require.NoError(t, err)
+
+		assert.Equal(t, "bbb-tool-1.0", prev)
+
+		assert.Equal(t, []*SigChange{
+			{Field: "constraint", New: "os=linux"},
+			{Field: "dependency", Old: "aaa-zlib-1.2", New: "ccc-zlib-1.2", Changes: []*SigChange{
+				{Field: "work", Old: `System {"Arguments":["./configure"],"Dir":""}`},
+				{Field: "work", New: `System {"Arguments":["./configure","--static"],"Dir":""}`},
+			}},
+		}, changes)
+	})
+
+	t.Run("reports when there's no previous build", func(t *testing.T) {
+		other := &ScriptPackage{id: "eee-other-1.0", name: "other"}
+		other.cs.Record = &SigRecord{Id: other.id, Name: "other"}
+
+		_, _, err := pw.Explain(other)
+		assert.True(t, errors.Is(err, ErrNoPreviousBuild))
+	})
+
+	t.Run("skips the records of builds that were removed", func(t *testing.T) {
+		install(&SigRecord{Id: "fff-gone-1.0", Name: "gone"})
+		require.NoError(t, os.RemoveAll(filepath.Join(store, "fff-gone-1.0")))
+
+		gone := &ScriptPackage{id: "ggg-gone-1.0", name: "gone"}
+		gone.cs.Record = &SigRecord{Id: gone.id, Name: "gone"}
+
+		_, _, err := pw.Explain(gone)
+		assert.True(t, errors.Is(err, ErrNoPreviousBuild))
+	})
+}
+
+func TestDiffLines(t *testing.T) {
+	changes := diffLines("work", []string{"a", "b", "c", "d"}, []string{"a", "x", "c", "d", "e"})
+
+	assert.Equal(t, []*SigChange{
+		{Field: "work", Old: "b"},
+		{Field: "work", New: "x"},
+		{Field: "work", New: "e"},
+	}, changes)
+}
@@ -11,18 +11,14 @@ import (
 
 type PackageWriteInfo struct {
 	storeDir string
+	sigDir   string
 }
 
+// Write writes the info of each output of pkg into it's store dir, returning
+// the info of the main output. The signature record of pkg is written into
+// sigDir, if set, rather than the store dir, as it names the build deps and
+// would otherwise make them runtime deps.
 func (p *PackageWriteInfo) Write(pkg *ScriptPackage) (*data.PackageInfo, error) {
-	path := filepath.Join(p.storeDir, pkg.ID(), ".pkg-info.json")
-
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, err
-	}
-
-	defer f.Close()
-
 	var sfd StoreFindDeps
 	sfd.storeDir = p.storeDir
 
@@ -33,21 +29,20 @@ func (p *PackageWriteInfo) Write(pkg *ScriptPackage) (*data.PackageInfo, error)
 		return nil, err
 	}
 
-	runtimeDeps, err := sfd.PruneDeps(pkg.ID(), allDeps)
-	if err != nil {
-		return nil, errors.Wrapf(err, "unable to prune deps")
-	}
-
-	var depIds []string
-	for _, dep := range runtimeDeps {
-		depIds = append(depIds, dep.ID())
-	}
+	// An output can reference any output of the build deps, as well as the
+	// other outputs of the package.
+	var (
+		buildDeps  []string
+		candidates []string
+	)
 
-	var buildDeps []string
 	for _, dep := range allDeps {
 		buildDeps = append(buildDeps, dep.ID())
+		candidates = append(candidates, dep.OutputIDs()...)
 	}
 
+	candidates = append(candidates, pkg.OutputIDs()...)
+
 	var inputs []*data.PackageInput
 
 	for _, input := range pkg.cs.Inputs {
@@ -73,20 +68,79 @@ func (p *PackageWriteInfo) Write(pkg *ScriptPackage) (*data.PackageInfo, error)
 		inputs = append(inputs, d)
 	}
 
-	pi := &data.PackageInfo{
-		Id:          pkg.ID(),
-		Name:        pkg.Name(),
-		Version:     pkg.Version(),
-		Repo:        pkg.Repo(),
-		RuntimeDeps: depIds,
-		BuildDeps:   buildDeps,
-		Constraints: pkg.Constraints(),
-		Inputs:      inputs,
+	var main *data.PackageInfo
+
+	for _, name := range pkg.Outputs() {
+		id := pkg.OutputID(name)
+
+		pi := &data.PackageInfo{
+			Id:          id,
+			Name:        pkg.Name(),
+			Version:     pkg.Version(),
+			Repo:        pkg.Repo(),
+			RuntimeDeps: sfd.FindRefs(id, candidates),
+			BuildDeps:   buildDeps,
+			Constraints: pkg.Constraints(),
+			Inputs:      inputs,
+		}
+
+		if name == MainOutput {
+			main = pi
+
+			for _, other := range pkg.Outputs()[1:] {
+				if pi.Outputs == nil {
+					pi.Outputs = make(map[string]string)
+				}
+
+				pi.Outputs[other] = pkg.OutputID(other)
+			}
+		} else {
+			pi.Output = name
+		}
+
+		err = p.writeInfo(id, pi)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write info of %s", id)
+		}
+	}
+
+	if pkg.cs.Record != nil && p.sigDir != "" {
+		err = p.writeSigRecord(pkg.ID(), pkg.cs.Record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to write signature record of %s", pkg.ID())
+		}
+	}
+
+	pkg.infoMu.Lock()
+	pkg.PackageInfo = main
+	pkg.infoMu.Unlock()
+
+	return main, nil
+}
+
+func (p *PackageWriteInfo) writeInfo(id string, pi *data.PackageInfo) error {
+	f, err := os.Create(filepath.Join(p.storeDir, id, pkgInfoFile))
+	if err != nil {
+		return err
 	}
 
-	err = json.NewEncoder(f).Encode(&pi)
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(pi)
+}
+
+func (p *PackageWriteInfo) writeSigRecord(id string, rec *SigRecord) error {
+	err := os.MkdirAll(p.sigDir, 0755)
+	if err != nil {
+		return err
+	}
 
-	pkg.PackageInfo = pi
+	f, err := os.Create(sigRecordPath(p.sigDir, id))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
 
-	return pi, err
+	return json.NewEncoder(f).Encode(rec)
 }
@@ -0,0 +1,85 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lab47/chell/pkg/data"
+	"github.com/mr-tron/base58"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestPackageWriteInfo(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	store := filepath.Join(top, "store")
+	sigs := filepath.Join(top, "sigs")
+
+	id := func(name string) string {
+		sum := blake2b.Sum256([]byte(name))
+		return base58.Encode(sum[:]) + "-" + name + "-1.0"
+	}
+
+	t.Run("keeps build deps named in the work out of the output", func(t *testing.T) {
+		tool := &ScriptPackage{id: id("tool"), name: "tool"}
+		tool.PackageInfo = &data.PackageInfo{Id: tool.id}
+
+		pkg := &ScriptPackage{id: id("app"), name: "app"}
+		pkg.cs.Dependencies = []*ScriptPackage{tool}
+		pkg.cs.Record = &SigRecord{
+			Id:           pkg.id,
+			Name:         "app",
+			Dependencies: []string{tool.id},
+			Work: []string{
+				fmt.Sprintf(`System {"Arguments":["%s/%s/bin/tool"],"Dir":""}`, store, tool.id),
+			},
+		}
+
+		dir := filepath.Join(store, pkg.id)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.MkdirAll(filepath.Join(store, tool.id), 0755))
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app"), []byte("app"), 0644))
+
+		pwi := PackageWriteInfo{storeDir: store, sigDir: sigs}
+
+		pi, err := pwi.Write(pkg)
+		require.NoError(t, err)
+
+		assert.Empty(t, pi.RuntimeDeps)
+
+		rec, err := readSigRecord(sigRecordPath(sigs, pkg.id))
+		require.NoError(t, err)
+
+		assert.Equal(t, pkg.cs.Record, rec)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		var (
+			cp    CarPack
+			buf   bytes.Buffer
+			cinfo data.CarInfo
+		)
+
+		cp.PrivateKey = priv
+		cp.PublicKey = pub
+		cp.DepRootDir = store
+
+		err = cp.Pack(&cinfo, dir, &buf)
+		require.NoError(t, err)
+
+		assert.Empty(t, cp.Dependencies)
+	})
+}
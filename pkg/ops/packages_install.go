@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/pkg/errors"
 )
@@ -15,33 +16,192 @@ type PackagesInstall struct {
 
 	ienv *InstallEnv
 
+	// Maximum number of packages to install at the same time. Values less
+	// than 1 are treated as 1.
+	Jobs int
+
 	Installed []string
 	Failed    string
+
+	// A package whose build was stopped before installing it, by the
+	// UntilPhase of the InstallEnv. It's not a failure, but nothing that
+	// depends on it is installed.
+	Stopped string
+}
+
+type installResult struct {
+	id  string
+	err error
 }
 
+// Install runs the installers for toInstall. A package is started as soon
+// as all of it's dependencies have been installed, with up to Jobs packages
+// running at once. The first failure cancels any packages still running
+// and no new ones are started. A package stopping with ErrBuildStopped
+// doesn't, though it's error is returned once the others have finished.
 func (p *PackagesInstall) Install(ctx context.Context, toInstall *PackagesToInstall) error {
+	jobs := p.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	order := make(map[string]int, len(toInstall.InstallOrder))
+	for i, id := range toInstall.InstallOrder {
+		order[id] = i
+	}
+
+	// Only dependencies that are themselves waiting to be installed need
+	// to be waited on, anything else is already available.
+	waiting := make(map[string]int)
+	dependents := make(map[string][]string)
+
 	for _, id := range toInstall.InstallOrder {
-		storeDir := filepath.Join(p.ienv.StoreDir, id)
-		if _, err := os.Stat(storeDir); err == nil {
-			continue
+		for _, dep := range toInstall.Dependencies[id] {
+			if _, ok := order[dep]; !ok {
+				continue
+			}
+
+			waiting[id]++
+			dependents[dep] = append(dependents[dep], id)
+		}
+	}
+
+	var ready []string
+
+	for _, id := range toInstall.InstallOrder {
+		if waiting[id] == 0 {
+			ready = append(ready, id)
 		}
+	}
+
+	// Mark a package as done, moving any dependents that were only waiting
+	// on it into ready. ready is kept in install order so that running
+	// with a single job installs in exactly InstallOrder.
+	finished := func(id string) {
+		for _, dep := range dependents[id] {
+			waiting[dep]--
 
-		fn, ok := toInstall.Installers[id]
-		if !ok {
-			return errors.Wrapf(ErrInstallError, "missing installer for %s", id)
+			if waiting[dep] == 0 {
+				ready = append(ready, dep)
+			}
 		}
 
-		p.L().Debug("running installer", "id", id)
+		sort.Slice(ready, func(i, j int) bool {
+			return order[ready[i]] < order[ready[j]]
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan installResult)
+
+	var (
+		running  int
+		firstErr error
+		stopErr  error
+	)
+
+	for {
+		for firstErr == nil && running < jobs && len(ready) > 0 {
+			id := ready[0]
+			ready = ready[1:]
+
+			installed, err := storeInstalled(p.ienv.StoreDir, id)
+			if err != nil {
+				firstErr = err
+				cancel()
+				break
+			}
+
+			if installed {
+				finished(id)
+				continue
+			}
+
+			fn, ok := toInstall.Installers[id]
+			if !ok {
+				firstErr = errors.Wrapf(ErrInstallError, "missing installer for %s", id)
+				cancel()
+				break
+			}
+
+			p.L().Debug("running installer", "id", id)
+
+			running++
 
-		err := fn.Install(ctx, p.ienv)
-		if err != nil {
-			p.Failed = id
-			os.RemoveAll(storeDir)
-			return err
+			go func(id string, fn PackageInstaller) {
+				results <- installResult{id: id, err: p.installOne(ctx, id, fn)}
+			}(id, fn)
 		}
 
-		p.Installed = append(p.Installed, id)
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+
+		if res.err != nil && errors.Is(res.err, ErrBuildStopped) {
+			p.L().Debug("installer stopped", "id", res.id)
+
+			p.Stopped = res.id
+			stopErr = res.err
+
+			continue
+		}
+
+		if res.err != nil {
+			if firstErr == nil {
+				p.L().Debug("installer failed, canceling remaining installs", "id", res.id, "error", res.err)
+
+				p.Failed = res.id
+				firstErr = res.err
+				cancel()
+			}
+
+			continue
+		}
+
+		p.Installed = append(p.Installed, res.id)
+
+		finished(res.id)
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return stopErr
+}
+
+// installOne runs the installer for id while holding the store lock for it.
+// If another process installed it while we were waiting on the lock, that
+// install is used instead.
+func (p *PackagesInstall) installOne(ctx context.Context, id string, fn PackageInstaller) error {
+	lock, err := lockStore(ctx, p.ienv.StoreDir, id, func() {
+		p.L().Info("waiting for another process installing package", "id", id)
+	})
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	installed, err := storeInstalled(p.ienv.StoreDir, id)
+	if err != nil {
+		return err
+	}
+
+	if installed {
+		p.L().Debug("package installed by another process", "id", id)
+		return nil
+	}
+
+	err = fn.Install(ctx, p.ienv)
+	if err != nil {
+		os.RemoveAll(filepath.Join(p.ienv.StoreDir, id))
 	}
 
-	return nil
+	return err
 }
@@ -6,8 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,8 +25,13 @@ func TestPackagesInstall(t *testing.T) {
 	t.Run("runs install functions", func(t *testing.T) {
 		var ti PackagesToInstall
 
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
 		testEnv := &InstallEnv{
-			StoreDir: "/nonexistant",
+			StoreDir: dir,
 			BuildDir: "/also-nonexistant",
 		}
 
@@ -43,7 +51,7 @@ func TestPackagesInstall(t *testing.T) {
 		var pkginst PackagesInstall
 		pkginst.ienv = testEnv
 
-		err := pkginst.Install(context.TODO(), &ti)
+		err = pkginst.Install(context.TODO(), &ti)
 		require.NoError(t, err)
 
 		assert.True(t, called)
@@ -135,4 +143,242 @@ func TestPackagesInstall(t *testing.T) {
 		_, err = os.Stat(filepath.Join(dir, "xyz-a-1.0"))
 		assert.Error(t, err)
 	})
+
+	t.Run("installs independent packages at the same time", func(t *testing.T) {
+		var ti PackagesToInstall
+
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		testEnv := &InstallEnv{
+			StoreDir: dir,
+			BuildDir: "/also-nonexistant",
+		}
+
+		var (
+			wg    sync.WaitGroup
+			order []string
+			mu    sync.Mutex
+		)
+
+		wg.Add(2)
+
+		leaf := func(id string) funcPkgInstaller {
+			return func(ctx context.Context, ienv *InstallEnv) error {
+				// Both leaves have to be running for either to finish.
+				wg.Done()
+				wg.Wait()
+
+				mu.Lock()
+				order = append(order, id)
+				mu.Unlock()
+
+				return nil
+			}
+		}
+
+		top := func(ctx context.Context, ienv *InstallEnv) error {
+			mu.Lock()
+			order = append(order, "xyz-c-1.0")
+			mu.Unlock()
+			return nil
+		}
+
+		ti.InstallOrder = []string{"xyz-a-1.0", "xyz-b-1.0", "xyz-c-1.0"}
+		ti.Dependencies = map[string][]string{
+			"xyz-c-1.0": {"xyz-a-1.0", "xyz-b-1.0"},
+		}
+		ti.Installers = map[string]PackageInstaller{
+			"xyz-a-1.0": leaf("xyz-a-1.0"),
+			"xyz-b-1.0": leaf("xyz-b-1.0"),
+			"xyz-c-1.0": funcPkgInstaller(top),
+		}
+
+		var pkginst PackagesInstall
+		pkginst.ienv = testEnv
+		pkginst.Jobs = 2
+
+		err = pkginst.Install(context.TODO(), &ti)
+		require.NoError(t, err)
+
+		assert.Equal(t, "xyz-c-1.0", order[2])
+		assert.ElementsMatch(t, ti.InstallOrder, pkginst.Installed)
+	})
+
+	t.Run("cancels running packages when one fails", func(t *testing.T) {
+		var ti PackagesToInstall
+
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		testEnv := &InstallEnv{
+			StoreDir: dir,
+			BuildDir: "/also-nonexistant",
+		}
+
+		started := make(chan struct{})
+
+		var canceled, dependentCalled bool
+
+		slow := func(ctx context.Context, ienv *InstallEnv) error {
+			close(started)
+			<-ctx.Done()
+			canceled = true
+			return ctx.Err()
+		}
+
+		failing := func(ctx context.Context, ienv *InstallEnv) error {
+			<-started
+			return io.EOF
+		}
+
+		dependent := func(ctx context.Context, ienv *InstallEnv) error {
+			dependentCalled = true
+			return nil
+		}
+
+		ti.InstallOrder = []string{"xyz-a-1.0", "xyz-b-1.0", "xyz-c-1.0"}
+		ti.Dependencies = map[string][]string{
+			"xyz-c-1.0": {"xyz-a-1.0", "xyz-b-1.0"},
+		}
+		ti.Installers = map[string]PackageInstaller{
+			"xyz-a-1.0": funcPkgInstaller(slow),
+			"xyz-b-1.0": funcPkgInstaller(failing),
+			"xyz-c-1.0": funcPkgInstaller(dependent),
+		}
+
+		var pkginst PackagesInstall
+		pkginst.ienv = testEnv
+		pkginst.Jobs = 4
+
+		err = pkginst.Install(context.TODO(), &ti)
+		assert.Equal(t, io.EOF, err)
+
+		assert.True(t, canceled)
+		assert.False(t, dependentCalled)
+
+		assert.Nil(t, pkginst.Installed)
+		assert.Equal(t, "xyz-b-1.0", pkginst.Failed)
+	})
+
+	t.Run("doesn't treat a stopped build as a failure", func(t *testing.T) {
+		var ti PackagesToInstall
+
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		testEnv := &InstallEnv{
+			StoreDir: dir,
+			BuildDir: "/also-nonexistant",
+		}
+
+		var dependentCalled bool
+
+		other := func(ctx context.Context, ienv *InstallEnv) error {
+			return ctx.Err()
+		}
+
+		stopped := func(ctx context.Context, ienv *InstallEnv) error {
+			return errors.Wrapf(ErrBuildStopped, "stopped after build")
+		}
+
+		dependent := func(ctx context.Context, ienv *InstallEnv) error {
+			dependentCalled = true
+			return nil
+		}
+
+		ti.InstallOrder = []string{"xyz-a-1.0", "xyz-b-1.0", "xyz-c-1.0"}
+		ti.Dependencies = map[string][]string{
+			"xyz-c-1.0": {"xyz-b-1.0"},
+		}
+		ti.Installers = map[string]PackageInstaller{
+			"xyz-a-1.0": funcPkgInstaller(other),
+			"xyz-b-1.0": funcPkgInstaller(stopped),
+			"xyz-c-1.0": funcPkgInstaller(dependent),
+		}
+
+		var pkginst PackagesInstall
+		pkginst.ienv = testEnv
+		pkginst.Jobs = 4
+
+		err = pkginst.Install(context.TODO(), &ti)
+		assert.True(t, errors.Is(err, ErrBuildStopped))
+
+		assert.False(t, dependentCalled)
+
+		assert.Equal(t, []string{"xyz-a-1.0"}, pkginst.Installed)
+		assert.Equal(t, "", pkginst.Failed)
+		assert.Equal(t, "xyz-b-1.0", pkginst.Stopped)
+	})
+
+	t.Run("waits for another process installing the same package", func(t *testing.T) {
+		var ti PackagesToInstall
+
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		testEnv := &InstallEnv{
+			StoreDir: dir,
+			BuildDir: "/also-nonexistant",
+		}
+
+		lock, err := lockStore(context.TODO(), dir, "xyz-a-1.0", nil)
+		require.NoError(t, err)
+
+		// Stand in for another process that finishes the install while
+		// we're waiting on the lock.
+		go func() {
+			time.Sleep(2 * storeLockPoll)
+			os.MkdirAll(filepath.Join(dir, "xyz-a-1.0", "bin"), 0755)
+			lock.Unlock()
+		}()
+
+		var called bool
+
+		pi := func(ctx context.Context, ienv *InstallEnv) error {
+			called = true
+			return nil
+		}
+
+		ti.InstallOrder = []string{"xyz-a-1.0"}
+		ti.Installers = map[string]PackageInstaller{
+			"xyz-a-1.0": funcPkgInstaller(pi),
+		}
+
+		var pkginst PackagesInstall
+		pkginst.ienv = testEnv
+
+		err = pkginst.Install(context.TODO(), &ti)
+		require.NoError(t, err)
+
+		assert.False(t, called)
+	})
+
+	t.Run("treats a store dir that is still being built as missing", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		tmp := storeTempDir(dir, "xyz-a-1.0")
+
+		err = os.Mkdir(tmp, 0755)
+		require.NoError(t, err)
+
+		err = os.Symlink(filepath.Base(tmp), filepath.Join(dir, "xyz-a-1.0"))
+		require.NoError(t, err)
+
+		installed, err := storeInstalled(dir, "xyz-a-1.0")
+		require.NoError(t, err)
+
+		assert.False(t, installed)
+	})
 }
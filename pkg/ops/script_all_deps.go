@@ -19,7 +19,8 @@ func (i *ScriptCalcDeps) pkgRuntimeDeps(pkg *ScriptPackage) ([]*ScriptPackage, e
 outer:
 	for _, sp := range runtimeDeps {
 		for _, id := range pi.RuntimeDeps {
-			if id == sp.ID() {
+			// Referencing any output of a dep makes it a runtime dep.
+			if sp.ownsID(id) {
 				pruned = append(pruned, sp)
 				continue outer
 			}
@@ -106,3 +107,41 @@ func (i *ScriptCalcDeps) walkFromDeps(deps []*ScriptPackage, seen map[string]str
 
 	return output, nil
 }
+
+// TopoSort returns pkgs ordered so that each package comes after the ones
+// it depends on, otherwise keeping the order they were given in.
+func (i *ScriptCalcDeps) TopoSort(pkgs []*ScriptPackage) []*ScriptPackage {
+	inSet := make(map[string]bool)
+
+	for _, pkg := range pkgs {
+		inSet[pkg.ID()] = true
+	}
+
+	var (
+		output []*ScriptPackage
+		seen   = make(map[string]bool)
+		visit  func(pkg *ScriptPackage)
+	)
+
+	visit = func(pkg *ScriptPackage) {
+		if seen[pkg.ID()] {
+			return
+		}
+
+		seen[pkg.ID()] = true
+
+		for _, dep := range pkg.Dependencies() {
+			if inSet[dep.ID()] {
+				visit(dep)
+			}
+		}
+
+		output = append(output, pkg)
+	}
+
+	for _, pkg := range pkgs {
+		visit(pkg)
+	}
+
+	return output
+}
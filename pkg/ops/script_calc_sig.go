@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/hashicorp/go-hclog"
@@ -36,9 +37,42 @@ type ScriptCalcSig struct {
 	Dependencies []*ScriptPackage
 	Instances    []*Instance
 
+	// Verifies an installed package works. It's not part of the signature,
+	// so that adding tests doesn't change the package's ID.
+	Test *exprcore.Function
+
+	// Set when the package is split into phases, in the order they run.
+	// Install is then the last phase.
+	Phases []ScriptPhase
+
+	// Optional limit on how long the install function may run for. It's
+	// not part of the signature, as it doesn't change the output.
+	Timeout time.Duration
+
+	// The outputs declared by the package, starting with the main one
+	// (out). Empty when the package only has that one.
+	Outputs []string
+
+	// The specific outputs of dependencies that were referenced via
+	// pkg.output(), by the dependency's ID.
+	DependencyOutputs map[string][]string
+
+	// What the signature was calculated from, which is stored with the
+	// installed package to explain why a later build's ID differs.
+	Record *SigRecord
+
 	Work *evt.Statements
 }
 
+// BuildPhases are the phases a package can define functions for, in the
+// order they run.
+var BuildPhases = []string{"unpack", "patch", "configure", "build", "check", "install"}
+
+type ScriptPhase struct {
+	Name string
+	Fn   *exprcore.Function
+}
+
 func (s *ScriptCalcSig) extract(proto *exprcore.Prototype) error {
 	name, err := lang.StringValue(proto.Attr("name"))
 	if err != nil {
@@ -88,6 +122,52 @@ func (s *ScriptCalcSig) extract(proto *exprcore.Prototype) error {
 
 	s.Hook = hook
 
+	test, err := lang.FuncValue(proto.Attr("test"))
+	if err != nil {
+		return err
+	}
+
+	s.Test = test
+
+	for _, name := range BuildPhases[:len(BuildPhases)-1] {
+		fn, err := lang.FuncValue(proto.Attr(name))
+		if err != nil {
+			return err
+		}
+
+		if fn != nil {
+			s.Phases = append(s.Phases, ScriptPhase{Name: name, Fn: fn})
+		}
+	}
+
+	if s.Phases != nil && install != nil {
+		s.Phases = append(s.Phases, ScriptPhase{Name: "install", Fn: install})
+	}
+
+	timeout, err := lang.StringValue(proto.Attr("timeout"))
+	if err != nil {
+		return err
+	}
+
+	if timeout != "" {
+		s.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %s", timeout, err)
+		}
+	}
+
+	outputs, err := lang.ListValue(proto.Attr("outputs"))
+	if err != nil {
+		return err
+	}
+
+	if outputs != nil {
+		err = s.processOutputs(outputs)
+		if err != nil {
+			return err
+		}
+	}
+
 	deps, err := lang.ListValue(proto.Attr("dependencies"))
 	if err != nil {
 		return err
@@ -96,21 +176,90 @@ func (s *ScriptCalcSig) extract(proto *exprcore.Prototype) error {
 	if deps != nil {
 		var scripts []*ScriptPackage
 
+		var (
+			seen  = make(map[*ScriptPackage]bool)
+			whole = make(map[string]bool)
+		)
+
 		iter := deps.Iterate()
 		defer iter.Done()
 		var x exprcore.Value
 		for iter.Next(&x) {
-			if script, ok := x.(*ScriptPackage); ok {
-				scripts = append(scripts, script)
+			switch v := x.(type) {
+			case *ScriptPackage:
+				whole[v.ID()] = true
+
+				if !seen[v] {
+					seen[v] = true
+					scripts = append(scripts, v)
+				}
+			case *ScriptOutput:
+				if !seen[v.pkg] {
+					seen[v.pkg] = true
+					scripts = append(scripts, v.pkg)
+				}
+
+				if s.DependencyOutputs == nil {
+					s.DependencyOutputs = make(map[string][]string)
+				}
+
+				id := v.pkg.ID()
+
+				if !hasString(s.DependencyOutputs[id], v.name) {
+					s.DependencyOutputs[id] = append(s.DependencyOutputs[id], v.name)
+				}
 			}
 		}
 
+		// Depending on the package itself means depending on all of it's
+		// outputs.
+		for id := range whole {
+			delete(s.DependencyOutputs, id)
+		}
+
 		s.Dependencies = scripts
 	}
 
 	return nil
 }
 
+func (s *ScriptCalcSig) processOutputs(val *exprcore.List) error {
+	outputs := []string{MainOutput}
+
+	iter := val.Iterate()
+	defer iter.Done()
+
+	var x exprcore.Value
+	for iter.Next(&x) {
+		str, ok := x.(exprcore.String)
+		if !ok {
+			return fmt.Errorf("output names must be strings, not %s", x.Type())
+		}
+
+		name := string(str)
+
+		if !validOutputName(name) {
+			return fmt.Errorf("invalid output name: %q", name)
+		}
+
+		if name == MainOutput {
+			continue
+		}
+
+		if hasString(outputs, name) {
+			return fmt.Errorf("output %q declared twice", name)
+		}
+
+		outputs = append(outputs, name)
+	}
+
+	if len(outputs) > 1 {
+		s.Outputs = outputs
+	}
+
+	return nil
+}
+
 func (s *ScriptCalcSig) processInput(val exprcore.Value) error {
 	var inputs []ScriptInput
 
@@ -238,7 +387,21 @@ func (s *ScriptCalcSig) calcSig(
 		}
 	}
 
-	if s.Install != nil {
+	if s.Phases != nil {
+		work := &evt.Statements{}
+
+		for _, p := range s.Phases {
+			body, err := s.calcWork(p.Fn)
+			if err != nil {
+				return "", err
+			}
+
+			work.Statements = append(work.Statements, &evt.Phase{Name: p.Name, Body: body})
+		}
+
+		s.Work = work
+		sd.Work = work
+	} else if s.Install != nil {
 		work, err := s.calcWork(s.Install)
 		if err != nil {
 			return "", err
@@ -251,7 +414,13 @@ func (s *ScriptCalcSig) calcSig(
 	sd.Dependencies = make(map[string]struct{})
 
 	for _, scr := range s.Dependencies {
-		sd.Dependencies[scr.ID()] = struct{}{}
+		if names, ok := s.DependencyOutputs[scr.ID()]; ok {
+			for _, name := range names {
+				sd.Dependencies[scr.OutputID(name)] = struct{}{}
+			}
+		} else {
+			sd.Dependencies[scr.ID()] = struct{}{}
+		}
 	}
 
 	hb, _ := blake2b.New256(nil)
@@ -263,15 +432,54 @@ func (s *ScriptCalcSig) calcSig(
 		return "", err
 	}
 
+	// Hashed separately rather than being part of sigData, so that the
+	// signature of packages with a single output is unchanged.
+	if s.Outputs != nil {
+		err = evt.HashInto(s.Outputs, h)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var inputs []string
+
+	// Likewise for downloaded files, which are identified by their sum
+	// rather than the URLs they come from.
+	for _, in := range s.Inputs {
+		if in.Data == nil || in.Data.dir != "" || in.Data.data != nil {
+			continue
+		}
+
+		st, sv, ok := in.Data.Sum()
+		if !ok {
+			return "", fmt.Errorf("missing sum for input: %s", in.Data.path)
+		}
+
+		fmt.Fprintf(h, "input: %s\nalgo: %s\n", in.Name, st)
+		h.Write(sv)
+
+		inputs = append(inputs, fmt.Sprintf("%s %s:%s", in.Name, st, base58.Encode(sv)))
+	}
+
+	s.Record = newSigRecord(&sd, s.Outputs, inputs)
+
 	return base58.Encode(hb.Sum(nil)), nil
 }
 
 func (s *ScriptCalcSig) calcWork(fn exprcore.Value) (*evt.Statements, error) {
 	var rc RunCtx
 	rc.attrs = RunCtxFunctions
-	rc.topDir = "$top"
-	rc.buildDir = "$build"
-	rc.installDir = "$prefix"
+	rc.topDir = evt.TopDir
+	rc.buildDir = evt.BuildDir
+	rc.installDir = evt.Prefix
+
+	if s.Outputs != nil {
+		rc.outputs = make(map[string]string)
+
+		for _, name := range s.Outputs[1:] {
+			rc.outputs[name] = evt.Output(name)
+		}
+	}
 
 	var top evt.Statements
 
@@ -325,6 +533,11 @@ func (s *ScriptCalcSig) injectInputs(data ScriptData) ([]*Instance, error) {
 			continue
 		}
 
+		// Downloaded files are hashed by their sum in calcSig.
+		if i.Data.dir == "" && i.Data.data == nil {
+			continue
+		}
+
 		spew.Dump(i)
 		panic("not supported")
 
@@ -403,5 +616,9 @@ func (s *ScriptCalcSig) Calculate(
 		return "", "", err
 	}
 
-	return sig, fmt.Sprintf("%s-%s-%s", sig, s.Name, s.Version), nil
+	id := fmt.Sprintf("%s-%s-%s", sig, s.Name, s.Version)
+
+	s.Record.Id = id
+
+	return sig, id, nil
 }
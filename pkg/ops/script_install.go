@@ -1,11 +1,8 @@
 package ops
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -13,16 +10,17 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-getter"
 	"github.com/hashicorp/go-hclog"
-	"github.com/lab47/chell/pkg/cleanhttp"
+	"github.com/lab47/chell/pkg/dlcache"
 	"github.com/lab47/chell/pkg/evt"
 	"github.com/lab47/chell/pkg/fileutils"
 	"github.com/lab47/exprcore/exprcore"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/blake2b"
 )
 
 type ScriptInstall struct {
@@ -41,7 +39,7 @@ func (i *ScriptInstall) setupInstance(ui *UI, ienv *InstallEnv, dir string, in S
 	return inst.Install()
 }
 
-func (i *ScriptInstall) setupInputFile(ui *UI, dir string, in ScriptInput) error {
+func (i *ScriptInstall) setupInputFile(ctx context.Context, ui *UI, ienv *InstallEnv, buildLog io.Writer, dir string, in ScriptInput) error {
 	var (
 		tgt, archive string
 		dec          getter.Decompressor
@@ -74,16 +72,8 @@ func (i *ScriptInstall) setupInputFile(ui *UI, dir string, in ScriptInput) error
 		}
 	}
 
-	f, err := os.Create(tgt)
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
 	if in.Data.data != nil {
-		_, err = f.Write(in.Data.data)
-		return err
+		return ioutil.WriteFile(tgt, in.Data.data, 0644)
 	}
 
 	st, sv, ok := in.Data.Sum()
@@ -91,44 +81,55 @@ func (i *ScriptInstall) setupInputFile(ui *UI, dir string, in ScriptInput) error
 		return fmt.Errorf("missing sum: %s", in.Data.path)
 	}
 
-	ui.DownloadInput(in.Data.path, st, sv)
+	sum := dlcache.Sum{Type: st, Value: sv}
 
-	resp, err := cleanhttp.Get(in.Data.path)
+	if sum.Weak() {
+		i.L().Warn("input is verified with a weak sum", "name", in.Name, "algo", st)
+	}
+
+	urls, err := ienv.Mirrors.Expand(in.Data.URLs())
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
+	var url string
 
-	var (
-		w io.Writer
-		h hash.Hash
-	)
+	if ienv.CacheDir != "" && sum.Cacheable() {
+		cache := dlcache.New(ienv.CacheDir)
 
-	switch st {
-	case "b2":
-		h, _ = blake2b.New256(nil)
-		w = io.MultiWriter(f, h)
-	case "sha256":
-		h = sha256.New()
-		w = io.MultiWriter(f, h)
-	case "etag":
-		w = f
-		// ok
-	default:
-		return fmt.Errorf("unknown sum type: %s", st)
-	}
+		var found bool
+
+		found, err = cache.Get(sum, tgt)
+		if err == nil && !found {
+			if ienv.Offline {
+				return evt.OfflineError(in.Data.path, in.Data.knownSum())
+			}
 
-	io.Copy(w, resp.Body)
-	switch st {
-	case "etag":
-		if string(sv) != resp.Header.Get("Etag") {
-			return fmt.Errorf("bad etag sum: %s", in.Data.path)
+			ui.DownloadInput(in.Data.path, st, sv)
+
+			url, err = dlcache.TryEach(urls, func(url string) error {
+				return cache.Download(ctx, url, sum, tgt)
+			})
 		}
-	default:
-		if !bytes.Equal(sv, h.Sum(nil)) {
-			return fmt.Errorf("bad sum: %s", in.Data.path)
+	} else {
+		if ienv.Offline {
+			return evt.OfflineError(in.Data.path, in.Data.knownSum())
 		}
+
+		ui.DownloadInput(in.Data.path, st, sv)
+
+		url, err = dlcache.TryEach(urls, func(url string) error {
+			return i.downloadInputFile(ctx, url, sum, tgt)
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Any of the mirrors may have been used, so record which one.
+	if url != "" && buildLog != nil {
+		fmt.Fprintf(buildLog, "downloaded %s from %s\n", in.Name, url)
 	}
 
 	// If user specified where to download it to, just leave it as a file.
@@ -157,6 +158,24 @@ func (i *ScriptInstall) setupInputFile(ui *UI, dir string, in ScriptInput) error
 	return nil
 }
 
+// downloadInputFile downloads url to tgt, verifying it against the sum
+// the input was declared with.
+func (i *ScriptInstall) downloadInputFile(ctx context.Context, url string, sum dlcache.Sum, tgt string) error {
+	f, err := os.Create(tgt)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	err = dlcache.FetchURL(ctx, url, sum, f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
 func (i *ScriptInstall) setupInputDir(ui *UI, dir string, in ScriptInput) error {
 	name := in.Name
 
@@ -174,7 +193,7 @@ func (i *ScriptInstall) setupInputDir(ui *UI, dir string, in ScriptInput) error
 	return inst.Install()
 }
 
-func (i *ScriptInstall) setupInputs(ui *UI, ienv *InstallEnv, dir string) error {
+func (i *ScriptInstall) setupInputs(ctx context.Context, ui *UI, ienv *InstallEnv, buildLog io.Writer, dir string) error {
 	for _, in := range i.pkg.cs.Inputs {
 		if in.Instance != nil {
 			err := i.setupInstance(ui, ienv, dir, in)
@@ -187,7 +206,7 @@ func (i *ScriptInstall) setupInputs(ui *UI, ienv *InstallEnv, dir string) error
 				return err
 			}
 		} else {
-			err := i.setupInputFile(ui, dir, in)
+			err := i.setupInputFile(ctx, ui, ienv, buildLog, dir, in)
 			if err != nil {
 				return err
 			}
@@ -197,32 +216,124 @@ func (i *ScriptInstall) setupInputs(ui *UI, ienv *InstallEnv, dir string) error
 	return nil
 }
 
-func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
-	var thread exprcore.Thread
-
+func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) (err error) {
 	log := i.L()
 	ui := GetUI(ctx)
 
+	if ienv.Offline && i.pkg.network {
+		return errors.Wrapf(dlcache.ErrOffline, "fetch instance %s is not in the store", i.pkg.ID())
+	}
+
 	ui.RunScript(i.pkg)
 
 	buildDir := filepath.Join(ienv.BuildDir, "build-"+i.pkg.ID())
 	targetDir := filepath.Join(ienv.StoreDir, i.pkg.ID())
 
-	err := os.Mkdir(buildDir, 0755)
-	if err != nil {
-		return err
+	phases := ienv.PhaseID != "" && ienv.PhaseID == i.pkg.ID()
+
+	if phases {
+		buildDir, err = i.setupPhaseDir(ienv)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = os.Mkdir(buildDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		defer os.RemoveAll(buildDir)
 	}
 
-	defer os.RemoveAll(buildDir)
+	// Each output of the package is built into a temporary sibling of it's
+	// store dir, which is only renamed into place once the build has
+	// succeeded. The store dir is a symlink to it in the meantime, so the
+	// build still sees the path the output will end up at.
+	tmpDirs := make(map[string]string)
 
-	err = os.Mkdir(targetDir, 0755)
-	if err != nil {
-		return err
+	// The main output is renamed last, as the package only counts as
+	// installed once it is.
+	defer func() {
+		ids := i.pkg.OutputIDs()
+
+		for j := len(ids) - 1; j >= 0; j-- {
+			if _, ok := tmpDirs[ids[j]]; !ok {
+				continue
+			}
+
+			ferr := storeFinishBuild(ienv.StoreDir, ids[j], err == nil)
+			if ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+	}()
+
+	outputDirs := make(map[string]string)
+
+	for _, name := range i.pkg.Outputs() {
+		id := i.pkg.OutputID(name)
+
+		tmpDirs[id], err = storeStartBuild(ienv.StoreDir, id)
+		if err != nil {
+			delete(tmpDirs, id)
+			return err
+		}
+
+		if name != MainOutput {
+			outputDirs[name] = filepath.Join(ienv.StoreDir, id)
+		}
 	}
 
-	err = i.setupInputs(ui, ienv, buildDir)
-	if err != nil {
-		return track(err)
+	// A build run in phases keeps it's build dir anyway.
+	if ienv.FailedDir != "" && !phases {
+		// Runs before buildDir is removed above.
+		defer func() {
+			if err == nil {
+				return
+			}
+
+			dir, kerr := i.keepFailed(ienv.FailedDir, buildDir, tmpDirs)
+			if kerr != nil {
+				log.Error("error keeping failed build", "error", kerr)
+				return
+			}
+
+			ui.KeptFailedBuild(i.pkg, dir)
+		}()
+	}
+
+	var (
+		buildLog *BuildLogWriter
+
+		// Kept separately so that it's a nil interface, rather than a nil
+		// *BuildLogWriter, when there's no log.
+		logWriter io.Writer
+	)
+
+	if ienv.LogDir != "" {
+		pbl := PackageBuildLog{logDir: ienv.LogDir}
+
+		buildLog, err = pbl.Create(i.pkg.ID())
+		if err != nil {
+			return err
+		}
+
+		logWriter = buildLog
+
+		defer func() {
+			lerr := buildLog.Finish(err)
+			if lerr != nil {
+				log.Error("error writing build log", "error", lerr)
+			}
+		}()
+	}
+
+	// When resuming, the inputs are already setup in the kept build dir.
+	if !phases || ienv.FromPhase == "" {
+		err = i.setupInputs(ctx, ui, ienv, logWriter, buildDir)
+		if err != nil {
+			return track(err)
+		}
 	}
 
 	var primary *ScriptInput
@@ -263,22 +374,11 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		}
 	}
 
-	var rc RunCtx
-	rc.ctx = ctx
-	rc.L = log
-	rc.attrs = RunCtxFunctions
-	rc.installDir = targetDir
-	rc.buildDir = runDir
-	rc.topDir = buildDir
-	rc.outputPrefix = i.pkg.Name()
-
-	args := exprcore.Tuple{&rc}
-
 	var (
-		path      []string
-		cflags    []string
-		ldflags   []string
-		pkgconfig []string
+		cflags  []string
+		ldflags []string
+		libDirs []string
+		loader  string
 	)
 
 	var scd ScriptCalcDeps
@@ -290,27 +390,47 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 	}
 
 	for _, dep := range buildDeps {
-		path = append(path, filepath.Join(ienv.StoreDir, dep.ID(), "bin"))
+		for _, id := range i.pkg.depOutputIDs(dep) {
+			dir := filepath.Join(ienv.StoreDir, id)
 
-		incpath := filepath.Join(ienv.StoreDir, dep.ID(), "include")
-		if _, err := os.Stat(incpath); err == nil {
-			cflags = append(cflags, "-I"+incpath)
-		}
+			incpath := filepath.Join(dir, "include")
+			if _, err := os.Stat(incpath); err == nil {
+				cflags = append(cflags, "-I"+incpath)
+			}
 
-		libpath := filepath.Join(ienv.StoreDir, dep.ID(), "lib")
-		if _, err := os.Stat(libpath); err == nil {
-			ldflags = append(ldflags, "-L"+libpath)
+			libpath := filepath.Join(dir, "lib")
+			if _, err := os.Stat(libpath); err == nil {
+				ldflags = append(ldflags, "-L"+libpath)
+				libDirs = append(libDirs, libpath)
 
-			pcpath := filepath.Join(ienv.StoreDir, dep.ID(), "lib", "pkgconfig")
-			if _, err := os.Stat(pcpath); err == nil {
-				pkgconfig = append(pkgconfig, pcpath)
+				if loader == "" {
+					loader = findLoader(libpath)
+				}
 			}
 		}
 	}
 
-	path = append(path, "/bin", "/usr/bin")
+	if runtime.GOOS == "linux" {
+		// Link everything with all the lib dirs as it's runpath, to make
+		// room for PackageAdjustNames to set it to just the ones needed.
+		var own []string
+
+		for _, id := range i.pkg.OutputIDs() {
+			own = append(own, filepath.Join(ienv.StoreDir, id, "lib"))
+		}
+
+		libDirs = append(own, libDirs...)
+
+		for _, dir := range libDirs {
+			ldflags = append(ldflags, "-Wl,-rpath,"+dir)
+		}
+
+		if loader != "" {
+			ldflags = append(ldflags, "-Wl,--dynamic-linker="+loader)
+		}
+	}
 
-	environ := []string{"HOME=/nonexistant", "PATH=" + strings.Join(path, ":")}
+	environ := []string{"HOME=/nonexistant", "PATH=/bin:/usr/bin"}
 
 	if len(cflags) > 0 {
 		environ = append(environ, "CFLAGS="+strings.Join(cflags, " "))
@@ -320,33 +440,76 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		environ = append(environ, "LDFLAGS="+strings.Join(ldflags, " "))
 	}
 
-	if len(pkgconfig) > 0 {
-		environ = append(environ, "PKG_CONFIG_PATH="+strings.Join(pkgconfig, ":"))
+	ec := EnvCompose{
+		common:   i.common,
+		storeDir: ienv.StoreDir,
+		outputs:  i.pkg.depOutputIDs,
+	}
+
+	environ, err = ec.Compose(ctx, environ, buildDeps)
+	if err != nil {
+		return err
+	}
+
+	var sandbox *evt.Sandbox
+
+	if ienv.Sandbox {
+		sandbox = &evt.Sandbox{
+			Shell: ienv.SandboxShell,
+		}
+
+		for _, dep := range buildDeps {
+			for _, id := range i.pkg.depOutputIDs(dep) {
+				sandbox.Paths = append(sandbox.Paths, filepath.Join(ienv.StoreDir, id))
+			}
+		}
+	}
+
+	evCtx := ctx
+
+	if timeout := i.pkg.cs.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+
+		evCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var fromPhase, untilPhase string
+
+	if phases {
+		fromPhase = ienv.FromPhase
+		untilPhase = ienv.UntilPhase
+	}
+
+	var cache *dlcache.Cache
+
+	if ienv.CacheDir != "" {
+		cache = dlcache.New(ienv.CacheDir)
 	}
 
 	ev := evt.NewEvaluator(log, evt.EvaluatorEnv{
-		WorkingDir:   buildDir,
+		FromPhase:    fromPhase,
+		UntilPhase:   untilPhase,
+		Context:      evCtx,
+		TopDir:       buildDir,
+		WorkingDir:   runDir,
 		OutputDir:    targetDir,
+		Outputs:      outputDirs,
 		OutputPrefix: i.pkg.Name(),
 		Environ:      environ,
+		Observer:     &installObserver{ui: ui, pkg: i.pkg, log: buildLog},
+		Sandbox:      sandbox,
+		Log:          logWriter,
+		Cache:        cache,
+		Mirrors:      ienv.Mirrors,
+		GitCache:     ienv.GitCacheDir,
+		Offline:      ienv.Offline,
+
+		IsolateNetwork: !i.pkg.network && !ienv.NoIsolateNetwork,
 	})
 
 	ui.ListDepedencies(buildDeps)
 
-	for _, dep := range buildDeps {
-		hook := dep.cs.Hook
-		if hook == nil {
-			continue
-		}
-
-		rc.installDir = filepath.Join(ienv.StoreDir, dep.ID())
-
-		_, err := exprcore.Call(&thread, hook, args, nil)
-		if err != nil {
-			return err
-		}
-	}
-
 	if ienv.StartShell {
 		shell := "/bin/bash"
 
@@ -355,7 +518,7 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 
-		cmd.Env = append(cmd.Env, rc.extraEnv...)
+		cmd.Env = append(cmd.Env, environ...)
 		cmd.Env = append(cmd.Env, "PREFIX="+targetDir)
 
 		cmd.Dir = runDir
@@ -366,23 +529,71 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		}
 	}
 
-	rc.installDir = targetDir
-	_, err = exprcore.Call(&thread, i.pkg.cs.Install, args, nil)
+	// Run the work tree calculated by ScriptCalcSig rather than calling
+	// the install function again, so that what is built is exactly what
+	// the package signature covers.
+	if i.pkg.cs.Work != nil {
+		err = ev.Eval(i.pkg.cs.Work)
+		if err != nil {
+			var se *evt.StatementError
+
+			if ienv.ShellOnFailure && errors.As(err, &se) {
+				ui.FailureShell(i.pkg, se)
+
+				cmd := exec.Command("/bin/bash")
+				cmd.Stdin = os.Stdin
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				cmd.Env = se.Env
+				cmd.Dir = se.Dir
+
+				cmd.Run()
+			}
+
+			if ctx.Err() == nil && evCtx.Err() == context.DeadlineExceeded {
+				err = errors.Wrapf(err, "build of %s timed out after %s", i.pkg.ID(), i.pkg.cs.Timeout)
+			} else {
+				err = errors.Wrapf(err, "unable to install %s", i.pkg.ID())
+			}
+		}
+	}
+
+	if err == nil && untilPhase != "" && untilPhase != BuildPhases[len(BuildPhases)-1] {
+		return errors.Wrapf(ErrBuildStopped, "stopped %s after %s, build dir kept in %s", i.pkg.ID(), untilPhase, buildDir)
+	}
+
+	if err == nil && phases {
+		defer os.RemoveAll(buildDir)
+	}
 
 	if err != nil {
 		log.Error("error running script install", "error", err)
 	} else {
-		var pan PackageAdjustNames
+		pan := PackageAdjustNames{
+			storeDir:    ienv.StoreDir,
+			libDirs:     libDirs,
+			interpreter: loader,
+		}
 
-		perr := pan.Adjust(targetDir)
-		if perr != nil {
-			log.Error("Error adjusting library names", "error", perr)
+		pan.SetLogger(log)
+
+		for _, id := range i.pkg.OutputIDs() {
+			perr := pan.Adjust(tmpDirs[id])
+			if perr != nil {
+				log.Error("Error adjusting library names", "error", perr, "output", id)
+			}
+		}
+
+		err = i.checkPurity(ui, ienv, tmpDirs)
+		if err != nil {
+			return err
 		}
 
 		var pwi PackageWriteInfo
 		pwi.storeDir = ienv.StoreDir
+		pwi.sigDir = ienv.SigDir
 
-		_, perr = pwi.Write(i.pkg)
+		_, perr := pwi.Write(i.pkg)
 		if perr != nil {
 			log.Error("error writing package info", "error", perr)
 		}
@@ -390,9 +601,22 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		var sf StoreFreeze
 		sf.storeDir = ienv.StoreDir
 
-		perr = sf.Freeze(i.pkg.ID())
-		if perr != nil {
-			log.Error("error freezing store dir", "error", perr)
+		for _, id := range i.pkg.OutputIDs() {
+			perr = sf.Freeze(id)
+			if perr != nil {
+				log.Error("error freezing store dir", "error", perr, "output", id)
+			}
+		}
+
+		// The package isn't renamed into place yet, so it's as if it was
+		// never installed if the tests fail.
+		if ienv.RunTests && i.pkg.cs.Test != nil {
+			pt := PackageTest{common: i.common, ienv: ienv}
+
+			err = pt.run(ctx, i.pkg)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -404,7 +628,7 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 
-		cmd.Env = append(cmd.Env, rc.extraEnv...)
+		cmd.Env = append(cmd.Env, environ...)
 		cmd.Env = append(cmd.Env, "PREFIX="+targetDir)
 
 		cmd.Dir = runDir
@@ -415,95 +639,309 @@ func (i *ScriptInstall) Install(ctx context.Context, ienv *InstallEnv) error {
 	return err
 }
 
-type RunCtx struct {
-	L hclog.Logger
-
-	ctx context.Context
+var ErrBuildStopped = errors.New("build stopped before installing")
 
-	installDir, buildDir, topDir string
-	extraEnv                     []string
+// setupPhaseDir returns the build dir of a package that is built in phases.
+// It's kept between runs, so is named after the package rather than it's ID,
+// which changes as the phase functions are edited.
+func (i *ScriptInstall) setupPhaseDir(ienv *InstallEnv) (string, error) {
+	for _, name := range []string{ienv.FromPhase, ienv.UntilPhase} {
+		if name != "" && !i.hasPhase(name) {
+			return "", fmt.Errorf("%s has no %s phase", i.pkg.Name(), name)
+		}
+	}
 
-	// Used by system, so cached outside extraEnv
-	path string
+	dir := filepath.Join(ienv.PhaseDir, i.pkg.Name())
 
-	h io.Writer
+	if ienv.FromPhase != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return "", errors.Wrapf(err, "no kept build of %s to resume", i.pkg.Name())
+		}
 
-	outputPrefix string
+		return dir, nil
+	}
 
-	attrs exprcore.StringDict
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
 
-	top *evt.Statements
+	return dir, os.MkdirAll(dir, 0755)
 }
 
-// String returns the string representation of the value.
-// exprcore string values are quoted as if by Python's repr.
-func (r *RunCtx) String() string {
-	return "<runctx>"
-}
+func (i *ScriptInstall) hasPhase(name string) bool {
+	for _, p := range i.pkg.cs.Phases {
+		if p.Name == name {
+			return true
+		}
+	}
 
-// Type returns a short string describing the value's type.
-func (r *RunCtx) Type() string {
-	return "<runctx>"
+	return false
 }
 
-// Freeze causes the value, and all values transitively
-// reachable from it through collections and closures, to be
-// marked as frozen.  All subsequent mutations to the data
-// structure through this API will fail dynamically, making the
-// data structure immutable and safe for publishing to other
-// exprcore interpreters running concurrently.
-func (r *RunCtx) Freeze() {
-}
+// findLoader returns the dynamic loader in libDir, if there is one.
+func findLoader(libDir string) string {
+	for _, pattern := range []string{"ld-linux*.so.*", "ld-musl-*.so.1"} {
+		matches, _ := filepath.Glob(filepath.Join(libDir, pattern))
+		if len(matches) > 0 {
+			return matches[0]
+		}
+	}
 
-// Truth returns the truth value of an object.
-func (r *RunCtx) Truth() exprcore.Bool {
-	return exprcore.True
+	return ""
 }
 
-// Hash returns a function of x such that Equals(x, y) => Hash(x) == Hash(y).
-// Hash may fail if the value's type is not hashable, or if the value
-// contains a non-hashable value. The hash is used only by dictionaries and
-// is not exposed to the exprcore program.
-func (r *RunCtx) Hash() (uint32, error) {
-	return 0, fmt.Errorf("not hashable")
-}
+// checkPurity scans the outputs in tmpDirs for references to paths that only
+// exist on this host, failing or warning about them per the policy in ienv.
+func (i *ScriptInstall) checkPurity(ui *UI, ienv *InstallEnv, tmpDirs map[string]string) error {
+	if ienv.ImpurityPolicy == ImpurityIgnore {
+		return nil
+	}
 
-func (r *RunCtx) Attr(name string) (exprcore.Value, error) {
-	switch name {
-	case "prefix":
-		return exprcore.String(r.installDir), nil
-	case "build":
-		return exprcore.String(r.buildDir), nil
-	case "top":
-		return exprcore.String(r.topDir), nil
+	scp := StoreCheckPurity{
+		storeDir:  ienv.StoreDir,
+		forbidden: forbiddenPaths(ienv, tmpDirs),
 	}
 
-	val, err := r.attrs.Attr(name)
-	if err != nil {
-		return nil, err
+	var impurities []Impurity
+
+	for _, id := range i.pkg.OutputIDs() {
+		found, err := scp.Check(id)
+		if err != nil {
+			return errors.Wrapf(err, "unable to check output of %s", id)
+		}
+
+		impurities = append(impurities, found...)
 	}
 
-	return val.(*exprcore.Builtin).BindReceiver(r), nil
-}
+	if len(impurities) == 0 {
+		return nil
+	}
 
-func (r *RunCtx) AttrNames() []string {
-	return append([]string{"prefix", "build", "top"}, r.attrs.AttrNames()...)
-}
+	ui.ImpureOutput(i.pkg, impurities)
 
-func (r *RunCtx) stmt(n evt.EVTNode) {
-	if r.top == nil {
-		r.top = &evt.Statements{}
+	if ienv.ImpurityPolicy == ImpurityFail {
+		return errors.Wrapf(ErrImpure, "%s has %d impurities, first: %s", i.pkg.ID(), len(impurities), impurities[0])
 	}
 
-	r.top.Statements = append(r.top.Statements, n)
+	return nil
 }
 
-func noRunRC(v interface{}) (exprcore.Value, error) {
-	return nil, fmt.Errorf("no run context bound available: %T", v)
+// forbiddenPaths returns the paths that the outputs of a package built with
+// ienv into tmpDirs must not refer to: the build dirs, the temp dirs and
+// ienv's ImpurityPaths.
+func forbiddenPaths(ienv *InstallEnv, tmpDirs map[string]string) []string {
+	forbidden := []string{ienv.BuildDir, "/tmp"}
+
+	for _, dir := range tmpDirs {
+		forbidden = append(forbidden, dir)
+	}
+
+	// Such as $TMPDIR on macOS.
+	if tmp := filepath.Clean(os.TempDir()); tmp != "/tmp" {
+		forbidden = append(forbidden, tmp)
+	}
+
+	return append(forbidden, ienv.ImpurityPaths...)
 }
 
-var RunCtxFunctions = exprcore.StringDict{
-	"system":        exprcore.NewBuiltin("system", systemFn),
+// keepFailed moves the build dir and the temporary dirs of the outputs of a
+// failed build, by ID, into a dir named after the package under failedDir,
+// returning it. The main output is kept as output and the others as
+// output-<name>.
+func (i *ScriptInstall) keepFailed(failedDir, buildDir string, tmpDirs map[string]string) (string, error) {
+	dir := filepath.Join(failedDir, i.pkg.ID())
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	kept := map[string]string{
+		buildDir: filepath.Join(dir, "build"),
+	}
+
+	for _, name := range i.pkg.Outputs() {
+		src, ok := tmpDirs[i.pkg.OutputID(name)]
+		if !ok {
+			continue
+		}
+
+		if name == MainOutput {
+			kept[src] = filepath.Join(dir, "output")
+		} else {
+			kept[src] = filepath.Join(dir, "output-"+name)
+		}
+	}
+
+	for src, dest := range kept {
+		// The build dir is usually on a different filesystem, so fallback
+		// to copying.
+		if err := os.Rename(src, dest); err == nil {
+			continue
+		}
+
+		inst := fileutils.Install{
+			L:       i.L(),
+			Pattern: src,
+			Dest:    dest,
+		}
+
+		err = inst.Install()
+		if err != nil {
+			return "", err
+		}
+
+		os.RemoveAll(src)
+	}
+
+	return dir, nil
+}
+
+// installObserver reports the progress of each statement of the work tree
+// to the UI and the build log.
+type installObserver struct {
+	ui  *UI
+	pkg *ScriptPackage
+	log *BuildLogWriter
+}
+
+func (o *installObserver) StatementStart(n evt.EVTNode) {
+	o.ui.StatementStart(o.pkg, n)
+
+	if o.log != nil {
+		fmt.Fprintf(o.log, "▸ %s\n", evt.Describe(n))
+	}
+}
+
+func (o *installObserver) StatementFinish(n evt.EVTNode, dur time.Duration, exitStatus int, err error) {
+	o.ui.StatementFinish(o.pkg, n, dur, exitStatus, err)
+
+	if o.log != nil {
+		if err != nil {
+			fmt.Fprintf(o.log, "✗ %s (exit %d): %s\n", evt.Describe(n), exitStatus, err)
+		} else {
+			fmt.Fprintf(o.log, "✓ %s (%s)\n", evt.Describe(n), dur.Round(time.Millisecond))
+		}
+	}
+}
+
+type RunCtx struct {
+	L hclog.Logger
+
+	ctx context.Context
+
+	installDir, buildDir, topDir string
+	extraEnv                     []string
+
+	// Dirs of the outputs other than the main one, which is installDir.
+	outputs map[string]string
+
+	// Used by system, so cached outside extraEnv
+	path string
+
+	h io.Writer
+
+	outputPrefix string
+
+	attrs exprcore.StringDict
+
+	top *evt.Statements
+}
+
+// String returns the string representation of the value.
+// exprcore string values are quoted as if by Python's repr.
+func (r *RunCtx) String() string {
+	return "<runctx>"
+}
+
+// Type returns a short string describing the value's type.
+func (r *RunCtx) Type() string {
+	return "<runctx>"
+}
+
+// Freeze causes the value, and all values transitively
+// reachable from it through collections and closures, to be
+// marked as frozen.  All subsequent mutations to the data
+// structure through this API will fail dynamically, making the
+// data structure immutable and safe for publishing to other
+// exprcore interpreters running concurrently.
+func (r *RunCtx) Freeze() {
+}
+
+// Truth returns the truth value of an object.
+func (r *RunCtx) Truth() exprcore.Bool {
+	return exprcore.True
+}
+
+// Hash returns a function of x such that Equals(x, y) => Hash(x) == Hash(y).
+// Hash may fail if the value's type is not hashable, or if the value
+// contains a non-hashable value. The hash is used only by dictionaries and
+// is not exposed to the exprcore program.
+func (r *RunCtx) Hash() (uint32, error) {
+	return 0, fmt.Errorf("not hashable")
+}
+
+func (r *RunCtx) Attr(name string) (exprcore.Value, error) {
+	switch name {
+	case "prefix":
+		return exprcore.String(r.installDir), nil
+	case "build":
+		return exprcore.String(r.buildDir), nil
+	case "top":
+		return exprcore.String(r.topDir), nil
+	}
+
+	val, err := r.attrs.Attr(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return val.(*exprcore.Builtin).BindReceiver(r), nil
+}
+
+func (r *RunCtx) AttrNames() []string {
+	return append([]string{"prefix", "build", "top"}, r.attrs.AttrNames()...)
+}
+
+func (r *RunCtx) stmt(n evt.EVTNode) {
+	if r.top == nil {
+		r.top = &evt.Statements{}
+	}
+
+	r.top.Statements = append(r.top.Statements, n)
+}
+
+// block returns the statements that calling fn with args adds, rather than
+// adding them to r.
+func (r *RunCtx) block(thread *exprcore.Thread, fn exprcore.Callable, args exprcore.Tuple) (*evt.Statements, error) {
+	old := r.top
+	defer func() {
+		r.top = old
+	}()
+
+	var top evt.Statements
+	r.top = &top
+
+	_, err := exprcore.Call(thread, fn, args, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &top, nil
+}
+
+func noRunRC(v interface{}) (exprcore.Value, error) {
+	return nil, fmt.Errorf("no run context bound available: %T", v)
+}
+
+var RunCtxFunctions = exprcore.StringDict{
+	"system":        exprcore.NewBuiltin("system", systemFn),
 	"shell":         exprcore.NewBuiltin("shell", shellFn),
 	"apply_patch":   exprcore.NewBuiltin("apply_patch", patchFn),
 	"inreplace":     exprcore.NewBuiltin("inreplace", inreplaceFn),
@@ -521,6 +959,47 @@ var RunCtxFunctions = exprcore.StringDict{
 	"mkdir":         exprcore.NewBuiltin("mkdir", mkdirFn),
 	"download":      exprcore.NewBuiltin("download", downloadFn),
 	"unpack":        exprcore.NewBuiltin("unpack", unpackFn),
+	"output":        exprcore.NewBuiltin("output", outputDirFn),
+	"copy":          exprcore.NewBuiltin("copy", copyFn),
+	"move":          exprcore.NewBuiltin("move", moveFn),
+	"chmod":         exprcore.NewBuiltin("chmod", chmodFn),
+	"symlink":       exprcore.NewBuiltin("symlink", symlinkFn),
+	"remove_glob":   exprcore.NewBuiltin("remove_glob", removeGlobFn),
+	"exists":        exprcore.NewBuiltin("exists", existsFn),
+	"glob":          exprcore.NewBuiltin("glob", globFn),
+	"substitute":    exprcore.NewBuiltin("substitute", substituteFn),
+	"wrap_program":  exprcore.NewBuiltin("wrap_program", wrapProgramFn),
+	"autotools":     exprcore.NewBuiltin("autotools", autotoolsFn),
+	"cmake":         exprcore.NewBuiltin("cmake", cmakeFn),
+	"meson":         exprcore.NewBuiltin("meson", mesonFn),
+	"go_build":      exprcore.NewBuiltin("go_build", goBuildFn),
+}
+
+func outputDirFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	var name string
+
+	if err := exprcore.UnpackArgs(
+		"output", args, kwargs,
+		"name", &name,
+	); err != nil {
+		return nil, err
+	}
+
+	if name == MainOutput {
+		return exprcore.String(env.installDir), nil
+	}
+
+	dir, ok := env.outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no output named %q declared", name)
+	}
+
+	return exprcore.String(dir), nil
 }
 
 func setRootFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
@@ -577,196 +1056,533 @@ func chdirFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple,
 		return nil, err
 	}
 
-	old.Statements = append(old.Statements, &evt.ChangeDir{
-		Dir:  evt.FSPath(dir),
-		Body: &top,
-	})
-
-	return n, err
-}
+	old.Statements = append(old.Statements, &evt.ChangeDir{
+		Dir:  evt.FSPath(dir),
+		Body: &top,
+	})
+
+	return n, err
+}
+
+func mkdirFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	var (
+		dir string
+	)
+
+	if err := exprcore.UnpackArgs(
+		"mkdir", args, kwargs,
+		"dir", &dir,
+	); err != nil {
+		return nil, err
+	}
+
+	env.stmt(&evt.MakeDir{
+		Dir: evt.FSPath(dir),
+	})
+
+	return exprcore.None, nil
+}
+
+func findExecutable(file string) error {
+	d, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if m := d.Mode(); !m.IsDir() && m&0111 != 0 {
+		return nil
+	}
+	return os.ErrPermission
+}
+
+// LookPath searches for an executable named file in the
+// directories named by the PATH environment variable.
+// If file contains a slash, it is tried directly and the PATH is not consulted.
+// The result may be an absolute path or a path relative to the current directory.
+func lookPath(file string, path string) (string, error) {
+	// NOTE(rsc): I wish we could use the Plan 9 behavior here
+	// (only bypass the path if file begins with / or ./ or ../)
+	// but that would not match all the Unix shells.
+
+	if strings.Contains(file, "/") {
+		err := findExecutable(file)
+		if err == nil {
+			return file, nil
+		}
+		return "", err
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			// Unix shell semantics: path element "" means "."
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		if err := findExecutable(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Wrapf(ErrNotFound, "unable to find executable: %s", path)
+}
+
+func shellFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	var code string
+
+	if err := exprcore.UnpackArgs(
+		"shell", args, kwargs,
+		"code", &code,
+	); err != nil {
+		return nil, err
+	}
+
+	env.stmt(&evt.Shell{
+		Code: code,
+	})
+
+	return exprcore.None, nil
+}
+
+func patchFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	var patch string
+
+	if err := exprcore.UnpackArgs(
+		"patch", args, kwargs,
+		"patch", &patch,
+	); err != nil {
+		return nil, err
+	}
+
+	env.stmt(&evt.Patch{
+		Patch: patch,
+	})
+
+	return exprcore.None, nil
+}
+
+func systemFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	var segments []string
+
+	for _, arg := range args {
+		switch sv := arg.(type) {
+		case exprcore.String:
+			segments = append(segments, string(sv))
+		default:
+			segments = append(segments, arg.String())
+		}
+	}
+
+	var dir string
+
+	for _, item := range kwargs {
+		name, arg := item[0].(exprcore.String), item[1]
+		if name == "dir" {
+			s, ok := arg.(exprcore.String)
+			if !ok {
+				return exprcore.None, fmt.Errorf("expected a string to system")
+			}
+
+			dir = string(s)
+		}
+	}
+
+	env.stmt(&evt.System{
+		Arguments: segments,
+		Dir:       evt.FSPath(dir),
+	})
+
+	return exprcore.None, nil
+}
+
+func basicFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var name string
+
+	exprcore.UnpackArgs(
+		"pkg", args, kwargs,
+		"name", &name,
+	)
+
+	return exprcore.None, nil
+}
+
+func checkPath(path string) error {
+	if strings.Contains(path, "..") {
+		return fmt.Errorf("invalid path, contains ..")
+	}
+
+	return nil
+}
+
+func checkPaths(paths ...string) error {
+	for _, path := range paths {
+		err := checkPath(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func inreplaceFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var file, pattern, target string
+
+	err := exprcore.UnpackArgs(
+		"inreplace", args, kwargs,
+		"file", &file,
+		"pattern", &pattern,
+		"target", &target,
+	)
+
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	err = checkPath(file)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	env.stmt(&evt.Replace{
+		File:     evt.FSPath(file),
+		Replacer: strings.NewReplacer(pattern, target),
+	})
+
+	return exprcore.None, nil
+}
+
+func inreplaceReFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var file, pattern, target string
+
+	err := exprcore.UnpackArgs(
+		"inreplace", args, kwargs,
+		"file", &file,
+		"pattern", &pattern,
+		"target", &target,
+	)
+
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	err = checkPath(file)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	env.stmt(&evt.Replace{
+		File:   evt.FSPath(file),
+		Regexp: re,
+		Target: []byte(target),
+	})
+
+	return exprcore.None, nil
+}
+
+func rmrfFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var path string
+
+	err := exprcore.UnpackArgs(
+		"rmrf", args, kwargs,
+		"path", &path,
+	)
+
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	err = checkPath(path)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	env.stmt(&evt.Rmrf{
+		Target: path,
+	})
+
+	return exprcore.None, nil
+}
+
+func copyFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var source, target string
+
+	err := exprcore.UnpackArgs(
+		"copy", args, kwargs,
+		"source", &source,
+		"target", &target,
+	)
+
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	err = checkPaths(source, target)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	env.stmt(&evt.Copy{
+		Source: evt.FSPath(source),
+		Target: evt.FSPath(target),
+	})
+
+	return exprcore.None, nil
+}
+
+func moveFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var source, target string
+
+	err := exprcore.UnpackArgs(
+		"move", args, kwargs,
+		"source", &source,
+		"target", &target,
+	)
+
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	err = checkPaths(source, target)
+	if err != nil {
+		return exprcore.None, err
+	}
 
-func mkdirFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	env, ok := b.Receiver().(*RunCtx)
 	if !ok {
 		return noRunRC(b.Receiver())
 	}
 
-	var (
-		dir string
-	)
-
-	if err := exprcore.UnpackArgs(
-		"mkdir", args, kwargs,
-		"dir", &dir,
-	); err != nil {
-		return nil, err
-	}
-
-	env.stmt(&evt.MakeDir{
-		Dir: evt.FSPath(dir),
+	env.stmt(&evt.Move{
+		Source: evt.FSPath(source),
+		Target: evt.FSPath(target),
 	})
 
 	return exprcore.None, nil
 }
 
-func findExecutable(file string) error {
-	d, err := os.Stat(file)
+func chmodFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		path string
+		mode exprcore.Value
+	)
+
+	err := exprcore.UnpackArgs(
+		"chmod", args, kwargs,
+		"path", &path,
+		"mode", &mode,
+	)
+
 	if err != nil {
-		return err
+		return exprcore.None, err
 	}
-	if m := d.Mode(); !m.IsDir() && m&0111 != 0 {
-		return nil
+
+	err = checkPath(path)
+	if err != nil {
+		return exprcore.None, err
 	}
-	return os.ErrPermission
-}
 
-// LookPath searches for an executable named file in the
-// directories named by the PATH environment variable.
-// If file contains a slash, it is tried directly and the PATH is not consulted.
-// The result may be an absolute path or a path relative to the current directory.
-func lookPath(file string, path string) (string, error) {
-	// NOTE(rsc): I wish we could use the Plan 9 behavior here
-	// (only bypass the path if file begins with / or ./ or ../)
-	// but that would not match all the Unix shells.
+	// Modes are usually written in octal, which is how a string is read.
+	var perm uint64
 
-	if strings.Contains(file, "/") {
-		err := findExecutable(file)
-		if err == nil {
-			return file, nil
+	switch v := mode.(type) {
+	case exprcore.Int:
+		i, ok := v.Int64()
+		if !ok || i < 0 {
+			return exprcore.None, fmt.Errorf("invalid mode: %s", v)
 		}
-		return "", err
-	}
 
-	for _, dir := range filepath.SplitList(path) {
-		if dir == "" {
-			// Unix shell semantics: path element "" means "."
-			dir = "."
-		}
-		path := filepath.Join(dir, file)
-		if err := findExecutable(path); err == nil {
-			return path, nil
+		perm = uint64(i)
+	case exprcore.String:
+		perm, err = strconv.ParseUint(string(v), 8, 32)
+		if err != nil {
+			return exprcore.None, fmt.Errorf("invalid mode, expected octal: %s", v)
 		}
+	default:
+		return exprcore.None, fmt.Errorf("mode must be an int or octal string, got a %s", mode.Type())
+	}
+
+	if perm > 07777 {
+		return exprcore.None, fmt.Errorf("invalid mode: %o", perm)
 	}
-	return "", errors.Wrapf(ErrNotFound, "unable to find executable: %s", path)
-}
 
-func shellFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	env, ok := b.Receiver().(*RunCtx)
 	if !ok {
 		return noRunRC(b.Receiver())
 	}
 
-	var code string
-
-	if err := exprcore.UnpackArgs(
-		"shell", args, kwargs,
-		"code", &code,
-	); err != nil {
-		return nil, err
-	}
-
-	env.stmt(&evt.Shell{
-		Code: code,
+	env.stmt(&evt.Chmod{
+		Path: evt.FSPath(path),
+		Mode: os.FileMode(perm),
 	})
 
 	return exprcore.None, nil
 }
 
-func patchFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	env, ok := b.Receiver().(*RunCtx)
-	if !ok {
-		return noRunRC(b.Receiver())
+func symlinkFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var target, link string
+
+	err := exprcore.UnpackArgs(
+		"symlink", args, kwargs,
+		"target", &target,
+		"link", &link,
+	)
+
+	if err != nil {
+		return exprcore.None, err
 	}
 
-	var patch string
+	// The target is only what the link points to, so it may be relative to
+	// the link's dir, using ..
+	err = checkPath(link)
+	if err != nil {
+		return exprcore.None, err
+	}
 
-	if err := exprcore.UnpackArgs(
-		"patch", args, kwargs,
-		"patch", &patch,
-	); err != nil {
-		return nil, err
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
 	}
 
-	env.stmt(&evt.Patch{
-		Patch: patch,
+	env.stmt(&evt.Symlink{
+		Target: target,
+		Link:   evt.FSPath(link),
 	})
 
 	return exprcore.None, nil
 }
 
-func systemFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	env, ok := b.Receiver().(*RunCtx)
-	if !ok {
-		return noRunRC(b.Receiver())
-	}
+func removeGlobFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var pattern string
 
-	var segments []string
+	err := exprcore.UnpackArgs(
+		"remove_glob", args, kwargs,
+		"pattern", &pattern,
+	)
 
-	for _, arg := range args {
-		switch sv := arg.(type) {
-		case exprcore.String:
-			segments = append(segments, string(sv))
-		default:
-			segments = append(segments, arg.String())
-		}
+	if err != nil {
+		return exprcore.None, err
 	}
 
-	var dir string
-
-	for _, item := range kwargs {
-		name, arg := item[0].(exprcore.String), item[1]
-		if name == "dir" {
-			s, ok := arg.(exprcore.String)
-			if !ok {
-				return exprcore.None, fmt.Errorf("expected a string to system")
-			}
+	err = checkPath(pattern)
+	if err != nil {
+		return exprcore.None, err
+	}
 
-			dir = string(s)
-		}
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
 	}
 
-	env.stmt(&evt.System{
-		Arguments: segments,
-		Dir:       evt.FSPath(dir),
+	env.stmt(&evt.RemoveGlob{
+		Pattern: evt.FSPath(pattern),
 	})
 
 	return exprcore.None, nil
 }
 
-func basicFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	var name string
+// existsFn runs the statements fn makes only if path exists when the
+// package is built.
+func existsFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		path string
+		fn   exprcore.Callable
+	)
 
-	exprcore.UnpackArgs(
-		"pkg", args, kwargs,
-		"name", &name,
+	err := exprcore.UnpackArgs(
+		"exists", args, kwargs,
+		"path", &path,
+		"fn", &fn,
 	)
 
-	return exprcore.None, nil
-}
+	if err != nil {
+		return exprcore.None, err
+	}
 
-func checkPath(path string) error {
-	if strings.Contains(path, "..") {
-		return fmt.Errorf("invalid path, contains ..")
+	err = checkPath(path)
+	if err != nil {
+		return exprcore.None, err
 	}
 
-	return nil
+	env, ok := b.Receiver().(*RunCtx)
+	if !ok {
+		return noRunRC(b.Receiver())
+	}
+
+	body, err := env.block(thread, fn, exprcore.Tuple{})
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env.stmt(&evt.IfExists{
+		Path: evt.FSPath(path),
+		Body: body,
+	})
+
+	return exprcore.None, nil
 }
 
-func inreplaceFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	var file, pattern, target string
+// globFn runs the statements fn makes for each path matching pattern when
+// the package is built. fn is passed a placeholder that expands to the path.
+func globFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		pattern string
+		fn      exprcore.Callable
+	)
 
 	err := exprcore.UnpackArgs(
-		"inreplace", args, kwargs,
-		"file", &file,
+		"glob", args, kwargs,
 		"pattern", &pattern,
-		"target", &target,
+		"fn", &fn,
 	)
 
 	if err != nil {
 		return exprcore.None, err
 	}
 
-	err = checkPath(file)
+	err = checkPath(pattern)
 	if err != nil {
 		return exprcore.None, err
 	}
@@ -776,22 +1592,29 @@ func inreplaceFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tup
 		return noRunRC(b.Receiver())
 	}
 
-	env.stmt(&evt.Replace{
-		File:     evt.FSPath(file),
-		Replacer: strings.NewReplacer(pattern, target),
+	body, err := env.block(thread, fn, exprcore.Tuple{exprcore.String(evt.Match)})
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	env.stmt(&evt.Glob{
+		Pattern: evt.FSPath(pattern),
+		Body:    body,
 	})
 
 	return exprcore.None, nil
 }
 
-func inreplaceReFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	var file, pattern, target string
+func substituteFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		file string
+		vars *exprcore.Dict
+	)
 
 	err := exprcore.UnpackArgs(
-		"inreplace", args, kwargs,
+		"substitute", args, kwargs,
 		"file", &file,
-		"pattern", &pattern,
-		"target", &target,
+		"vars", &vars,
 	)
 
 	if err != nil {
@@ -803,7 +1626,7 @@ func inreplaceReFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.T
 		return exprcore.None, err
 	}
 
-	re, err := regexp.Compile(pattern)
+	sv, err := stringDict(vars)
 	if err != nil {
 		return exprcore.None, err
 	}
@@ -813,28 +1636,57 @@ func inreplaceReFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.T
 		return noRunRC(b.Receiver())
 	}
 
-	env.stmt(&evt.Replace{
-		File:   evt.FSPath(file),
-		Regexp: re,
-		Target: []byte(target),
+	env.stmt(&evt.Substitute{
+		File: evt.FSPath(file),
+		Vars: sv,
 	})
 
 	return exprcore.None, nil
 }
 
-func rmrfFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
-	var path string
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func wrapProgramFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var (
+		bin        string
+		setEnv     *exprcore.Dict
+		prefixPath *exprcore.List
+	)
 
 	err := exprcore.UnpackArgs(
-		"rmrf", args, kwargs,
-		"path", &path,
+		"wrap_program", args, kwargs,
+		"bin", &bin,
+		"set_env?", &setEnv,
+		"prefix_path?", &prefixPath,
 	)
 
 	if err != nil {
 		return exprcore.None, err
 	}
 
-	err = checkPath(path)
+	err = checkPath(bin)
+	if err != nil {
+		return exprcore.None, err
+	}
+
+	n := &evt.WrapProgram{
+		Program: evt.FSPath(bin),
+	}
+
+	if setEnv != nil {
+		n.SetEnv, err = stringDict(setEnv)
+		if err != nil {
+			return exprcore.None, err
+		}
+
+		for k := range n.SetEnv {
+			if !envKeyRe.MatchString(k) {
+				return exprcore.None, fmt.Errorf("invalid environment variable name: %s", k)
+			}
+		}
+	}
+
+	n.PrefixPath, err = stringList("prefix_path", prefixPath)
 	if err != nil {
 		return exprcore.None, err
 	}
@@ -844,13 +1696,31 @@ func rmrfFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, k
 		return noRunRC(b.Receiver())
 	}
 
-	env.stmt(&evt.Rmrf{
-		Target: path,
-	})
+	env.stmt(n)
 
 	return exprcore.None, nil
 }
 
+func stringDict(d *exprcore.Dict) (map[string]string, error) {
+	m := make(map[string]string, d.Len())
+
+	for _, i := range d.Items() {
+		key, ok := i.Index(0).(exprcore.String)
+		if !ok {
+			return nil, fmt.Errorf("key not a string: %s", i.Index(0))
+		}
+
+		val, ok := i.Index(1).(exprcore.String)
+		if !ok {
+			return nil, fmt.Errorf("value of %s not a string: %s", key, i.Index(1).Type())
+		}
+
+		m[string(key)] = string(val)
+	}
+
+	return m, nil
+}
+
 func setEnvFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	var key, value string
 
@@ -923,9 +1793,9 @@ func prependEnvFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tu
 	}
 
 	env.stmt(&evt.SetEnv{
-		Append: true,
-		Key:    key,
-		Value:  value,
+		Prepend: true,
+		Key:     key,
+		Value:   value,
 	})
 
 	return exprcore.None, nil
@@ -1108,8 +1978,9 @@ func unpackFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple,
 
 func downloadFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	var (
-		url, path string
-		sum       exprcore.Value
+		url  exprcore.Value
+		path string
+		sum  exprcore.Value
 	)
 
 	err := exprcore.UnpackArgs(
@@ -1123,6 +1994,11 @@ func downloadFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tupl
 		return exprcore.None, err
 	}
 
+	urls, err := urlList(url)
+	if err != nil {
+		return exprcore.None, err
+	}
+
 	env, ok := b.Receiver().(*RunCtx)
 	if !ok {
 		return noRunRC(b.Receiver())
@@ -1130,7 +2006,7 @@ func downloadFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tupl
 
 	var ks *evt.KnownSum
 
-	if sum == nil {
+	if sum != nil {
 		st, svs, err := DecodeSum(sum)
 		if err != nil {
 			return exprcore.None, err
@@ -1143,9 +2019,10 @@ func downloadFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tupl
 	}
 
 	env.stmt(&evt.Download{
-		URL:  url,
-		Path: evt.FSPath(path),
-		Sum:  ks,
+		URL:     urls[0],
+		Mirrors: urls[1:],
+		Path:    evt.FSPath(path),
+		Sum:     ks,
 	})
 
 	return exprcore.None, nil
@@ -2,11 +2,16 @@ package ops
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/lab47/chell/pkg/data"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -57,4 +62,334 @@ func TestScriptInstall(t *testing.T) {
 		_, err = os.Stat(filepath.Join(target, pkg.ID(), "flag"))
 		require.NoError(t, err)
 	})
+
+	t.Run("keeps the build and output of a failed build", func(t *testing.T) {
+		var lookup ScriptLookup
+		lookup.Path = []string{"./testdata/script_install"}
+
+		var sl ScriptLoad
+		sl.lookup = &lookup
+
+		pkg, err := sl.Load("fail")
+		require.NoError(t, err)
+
+		target := filepath.Join(top, "in")
+
+		err = os.Mkdir(target, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(target)
+
+		build := filepath.Join(top, "build")
+
+		err = os.Mkdir(build, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(build)
+
+		failed := filepath.Join(top, "failed")
+
+		ienv := &InstallEnv{
+			BuildDir:  build,
+			StoreDir:  target,
+			FailedDir: failed,
+		}
+
+		si := &ScriptInstall{
+			pkg: pkg,
+		}
+
+		ctx := context.Background()
+
+		err = si.Install(ctx, ienv)
+		require.Error(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(failed, pkg.ID(), "output", "partial"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "partial\n", string(data))
+
+		_, err = os.Stat(filepath.Join(failed, pkg.ID(), "build"))
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(build, "build-"+pkg.ID()))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("stops a build that exceeds it's timeout", func(t *testing.T) {
+		var lookup ScriptLookup
+		lookup.Path = []string{"./testdata/script_install"}
+
+		var sl ScriptLoad
+		sl.lookup = &lookup
+
+		pkg, err := sl.Load("timeout")
+		require.NoError(t, err)
+
+		target := filepath.Join(top, "in")
+
+		err = os.Mkdir(target, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(target)
+
+		build := filepath.Join(top, "build")
+
+		err = os.Mkdir(build, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(build)
+
+		ienv := &InstallEnv{
+			BuildDir: build,
+			StoreDir: target,
+		}
+
+		si := &ScriptInstall{
+			pkg: pkg,
+		}
+
+		start := time.Now()
+
+		err = si.Install(context.Background(), ienv)
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Contains(t, err.Error(), "timed out after 1s")
+		assert.True(t, time.Since(start) < 20*time.Second)
+
+		_, err = os.Stat(filepath.Join(target, pkg.ID()))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("stops after and resumes from a phase", func(t *testing.T) {
+		var lookup ScriptLookup
+		lookup.Path = []string{"./testdata/script_install"}
+
+		var sl ScriptLoad
+		sl.lookup = &lookup
+
+		pkg, err := sl.Load("phases")
+		require.NoError(t, err)
+
+		target := filepath.Join(top, "in")
+
+		err = os.Mkdir(target, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(target)
+
+		build := filepath.Join(top, "build")
+
+		err = os.Mkdir(build, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(build)
+
+		kept := filepath.Join(top, "kept")
+
+		ienv := &InstallEnv{
+			BuildDir:   build,
+			StoreDir:   target,
+			PhaseID:    pkg.ID(),
+			UntilPhase: "configure",
+			PhaseDir:   kept,
+		}
+
+		si := &ScriptInstall{
+			pkg: pkg,
+		}
+
+		ctx := context.Background()
+
+		err = si.Install(ctx, ienv)
+		require.Error(t, err)
+
+		assert.True(t, errors.Is(err, ErrBuildStopped))
+
+		_, err = os.Stat(filepath.Join(kept, "phases", "config.status"))
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(target, pkg.ID()))
+		assert.True(t, os.IsNotExist(err))
+
+		ienv.UntilPhase = ""
+		ienv.FromPhase = "build"
+
+		err = si.Install(ctx, ienv)
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(target, pkg.ID(), "built"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "configured\n", string(data))
+	})
+
+	t.Run("installs each output into it's own store dir", func(t *testing.T) {
+		var lookup ScriptLookup
+		lookup.Path = []string{"./testdata/script_install"}
+
+		var sl ScriptLoad
+		sl.lookup = &lookup
+
+		pkg, err := sl.Load("split")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"out", "dev"}, pkg.Outputs())
+
+		devID := pkg.OutputID("dev")
+		assert.NotEqual(t, idHash(pkg.ID()), idHash(devID))
+
+		target := filepath.Join(top, "in")
+
+		err = os.Mkdir(target, 0755)
+		require.NoError(t, err)
+
+		defer removeFrozen(target)
+
+		build := filepath.Join(top, "build")
+
+		err = os.Mkdir(build, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(build)
+
+		ienv := &InstallEnv{
+			BuildDir: build,
+			StoreDir: target,
+		}
+
+		si := &ScriptInstall{
+			pkg: pkg,
+		}
+
+		err = si.Install(context.Background(), ienv)
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(target, pkg.ID(), "lib", "split.txt"))
+		require.NoError(t, err)
+
+		header, err := ioutil.ReadFile(filepath.Join(target, devID, "include", "split.h"))
+		require.NoError(t, err)
+
+		assert.Equal(t, filepath.Join(target, pkg.ID())+"\n", string(header))
+
+		assert.Equal(t, map[string]string{"dev": devID}, pkg.PackageInfo.Outputs)
+		assert.Empty(t, pkg.PackageInfo.RuntimeDeps)
+
+		var di data.PackageInfo
+
+		f, err := os.Open(filepath.Join(target, devID, pkgInfoFile))
+		require.NoError(t, err)
+
+		defer f.Close()
+
+		require.NoError(t, json.NewDecoder(f).Decode(&di))
+
+		assert.Equal(t, "dev", di.Output)
+		assert.Equal(t, []string{pkg.ID()}, di.RuntimeDeps)
+	})
+
+	t.Run("doesn't install a package if it's tests fail", func(t *testing.T) {
+		var lookup ScriptLookup
+		lookup.Path = []string{"./testdata/script_install"}
+
+		var sl ScriptLoad
+		sl.lookup = &lookup
+
+		pkg, err := sl.Load("tested")
+		require.NoError(t, err)
+
+		target := filepath.Join(top, "in")
+
+		err = os.Mkdir(target, 0755)
+		require.NoError(t, err)
+
+		defer removeFrozen(target)
+
+		build := filepath.Join(top, "build")
+
+		err = os.Mkdir(build, 0755)
+		require.NoError(t, err)
+
+		defer os.RemoveAll(build)
+
+		ienv := &InstallEnv{
+			BuildDir: build,
+			StoreDir: target,
+			RunTests: true,
+		}
+
+		si := &ScriptInstall{
+			pkg: pkg,
+		}
+
+		err = si.Install(context.Background(), ienv)
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "tests of "+pkg.ID()+" failed")
+
+		_, err = os.Lstat(filepath.Join(target, pkg.ID()))
+		assert.True(t, os.IsNotExist(err))
+
+		_, err = os.Stat(storeTempDir(target, pkg.ID()))
+		assert.True(t, os.IsNotExist(err))
+
+		ienv.RunTests = false
+
+		err = si.Install(context.Background(), ienv)
+		require.NoError(t, err)
+
+		pt := PackageTest{ienv: ienv}
+
+		err = pt.Test(context.Background(), pkg)
+		assert.Error(t, err)
+	})
+}
+
+func TestKeepFailed(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	pkg := &ScriptPackage{id: "abc-split-1.0", sig: "abc", name: "split"}
+	pkg.cs.Version = "1.0"
+	pkg.cs.Outputs = []string{MainOutput, "dev"}
+
+	build := filepath.Join(top, "build")
+	require.NoError(t, os.Mkdir(build, 0755))
+
+	tmpDirs := make(map[string]string)
+
+	for _, id := range pkg.OutputIDs() {
+		dir := filepath.Join(top, ".tmp-"+id)
+		require.NoError(t, os.Mkdir(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "partial"), []byte(id), 0644))
+
+		tmpDirs[id] = dir
+	}
+
+	si := &ScriptInstall{pkg: pkg}
+
+	dir, err := si.keepFailed(filepath.Join(top, "failed"), build, tmpDirs)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(top, "failed", pkg.ID()), dir)
+
+	_, err = os.Stat(filepath.Join(dir, "build"))
+	require.NoError(t, err)
+
+	for kept, id := range map[string]string{
+		"output":     pkg.ID(),
+		"output-dev": pkg.OutputID("dev"),
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, kept, "partial"))
+		require.NoError(t, err)
+
+		assert.Equal(t, id, string(data))
+
+		_, err = os.Stat(tmpDirs[id])
+		assert.True(t, os.IsNotExist(err))
+	}
 }
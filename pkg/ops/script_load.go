@@ -1,7 +1,6 @@
 package ops
 
 import (
-	"encoding/hex"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -10,10 +9,12 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/lab47/chell/pkg/data"
 	"github.com/lab47/chell/pkg/evt"
+	"github.com/lab47/chell/pkg/hashdetect"
 	"github.com/lab47/exprcore/exprcore"
 	"github.com/mr-tron/base58"
 	"github.com/pkg/errors"
@@ -76,6 +77,13 @@ type ScriptPackage struct {
 
 	constraints map[string]string
 
+	// Allow the install statements network access, only set for fetch()
+	// instances.
+	network bool
+
+	// Guards PackageInfo, which is filled in lazily while packages are
+	// being installed in parallel.
+	infoMu      sync.Mutex
 	PackageInfo *data.PackageInfo
 }
 
@@ -275,6 +283,7 @@ func (s *ScriptLoad) Load(name string, opts ...Option) (*ScriptPackage, error) {
 		"fmt":      exprcore.NewBuiltin("fmt", fmtFn),
 		"basename": exprcore.NewBuiltin("basename", basenameFn),
 		"fetch":    exprcore.NewBuiltin("fetch", s.fetchFn),
+		"git":      exprcore.NewBuiltin("git", s.gitFn),
 		"sys":      sysobj,
 	}
 
@@ -439,20 +448,61 @@ func (l *ScriptLoad) idFn(thread *exprcore.Thread, b *exprcore.Builtin, args exp
 
 func (l *ScriptLoad) fileFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	var (
-		path, darwin, linux string
-		into                string
+		pathv         exprcore.Value
+		darwin, linux string
+		into          string
+		sum           exprcore.Value
 	)
 
 	if err := exprcore.UnpackArgs(
 		"file", args, kwargs,
-		"path?", &path,
+		"path?", &pathv,
 		"darwin?", &darwin,
 		"linux?", &linux,
 		"into?", &into,
+		"sum?", &sum,
 	); err != nil {
 		return nil, err
 	}
 
+	var (
+		path string
+		urls []string
+	)
+
+	if pathv != nil {
+		var err error
+
+		urls, err = urlList(pathv)
+		if err != nil {
+			return nil, err
+		}
+
+		path = urls[0]
+	}
+
+	// A URL, or a list of them to try in turn, is downloaded when the
+	// package is built rather than being read from the script's assets.
+	if len(urls) > 1 || strings.Contains(path, "://") {
+		if sum == nil {
+			return nil, fmt.Errorf("file() of a URL requires a sum: %s", path)
+		}
+
+		st, sv, err := DecodeSum(sum)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ScriptFile{
+			logger:   l.common.L(),
+			path:     path,
+			urls:     urls,
+			sumType:  st,
+			sumValue: sv,
+			into:     into,
+		}, nil
+	}
+
 	if path == "" {
 		switch runtime.GOOS {
 		case "darwin":
@@ -501,6 +551,34 @@ func (l *ScriptLoad) fileFn(thread *exprcore.Thread, b *exprcore.Builtin, args e
 	return inst, nil
 }
 
+// urlList returns the URLs in v, which is either a single URL or a list of
+// them.
+func urlList(v exprcore.Value) ([]string, error) {
+	switch v := v.(type) {
+	case exprcore.String:
+		return []string{string(v)}, nil
+	case *exprcore.List:
+		var urls []string
+
+		for i := 0; i < v.Len(); i++ {
+			str, ok := v.Index(i).(exprcore.String)
+			if !ok {
+				return nil, fmt.Errorf("expected a URL, got %s", v.Index(i).Type())
+			}
+
+			urls = append(urls, string(str))
+		}
+
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("empty list of URLs")
+		}
+
+		return urls, nil
+	default:
+		return nil, fmt.Errorf("expected a URL or list of URLs, got %s", v.Type())
+	}
+}
+
 func hashDir(l hclog.Logger, dir string) ([]byte, error) {
 	h, _ := blake2b.New256(nil)
 
@@ -595,6 +673,8 @@ func (l *ScriptLoad) fetchFn(thread *exprcore.Thread, b *exprcore.Builtin, args
 		return nil, err
 	}
 
+	inst.Fetch = true
+
 	sumType, sumValue, err := DecodeSum(sum)
 	if err != nil {
 		return nil, err
@@ -626,6 +706,56 @@ func (l *ScriptLoad) fetchFn(thread *exprcore.Thread, b *exprcore.Builtin, args
 	return inst, nil
 }
 
+// gitFn returns an instance containing the tree of a revision of a git repo,
+// without the git metadata. Like fetch(), it's identified by it's sum rather
+// than how it's fetched.
+func (l *ScriptLoad) gitFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	var url, rev, sum string
+
+	if err := exprcore.UnpackArgs(
+		"git", args, kwargs,
+		"url", &url,
+		"rev", &rev,
+		"sum?", &sum,
+	); err != nil {
+		return nil, err
+	}
+
+	work := &evt.Statements{
+		Statements: []evt.EVTNode{
+			&evt.GitCheckout{
+				URL: url,
+				Rev: rev,
+				Dir: evt.Prefix,
+				Sum: sum,
+			},
+		},
+	}
+
+	inst, err := NewWorkInstance("git", work)
+	if err != nil {
+		return nil, err
+	}
+
+	inst.Fetch = true
+
+	h, _ := blake2b.New256(nil)
+
+	fmt.Fprintln(h, "git")
+
+	// Without a sum the checkout fails, reporting the sum it should have.
+	if sum == "" {
+		fmt.Fprintf(h, "%s@%s", url, rev)
+	} else {
+		fmt.Fprintf(h, "tree-%s", sum)
+	}
+
+	inst.Signature = base58.Encode(h.Sum(nil))
+	inst.Version = inst.Signature[:8]
+
+	return inst, nil
+}
+
 func fmtFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
 	var format string
 
@@ -703,11 +833,28 @@ type ScriptFile struct {
 	into     string
 	chdir    bool
 
+	// All the URLs the file can be downloaded from, starting with path.
+	urls []string
+
 	dir string
 
 	data []byte
 }
 
+// URLs returns the URLs to try downloading the file from, in order.
+func (s *ScriptFile) URLs() []string {
+	if s.urls == nil {
+		return []string{s.path}
+	}
+
+	return s.urls
+}
+
+// knownSum returns the sum of the file as it was declared.
+func (s *ScriptFile) knownSum() *evt.KnownSum {
+	return &evt.KnownSum{Type: s.sumType, Value: s.sumValue}
+}
+
 func (s *ScriptFile) Sum() (string, []byte, bool) {
 	if s.dir != "" {
 		if s.sumValue != "" {
@@ -745,19 +892,8 @@ func (s *ScriptFile) Sum() (string, []byte, bool) {
 		}
 
 		return "etag", []byte(sv), true
-	case "sha256":
-		d, err := hex.DecodeString(s.sumValue)
-		if err != nil {
-			return "", nil, false
-		}
-
-		return "sha256", d, true
 	default:
-		if s.sumValue == "" {
-			panic("oh no")
-		}
-
-		b, err := base58.Decode(s.sumValue)
+		b, err := hashdetect.Decode(s.sumType, s.sumValue)
 		if err != nil {
 			return "", nil, false
 		}
@@ -854,6 +990,8 @@ func (s *ScriptPackage) Attr(name string) (exprcore.Value, error) {
 	switch name {
 	case "prefix":
 		return exprcore.String(filepath.Join(s.loader.StoreDir, s.ID())), nil
+	case "output":
+		return exprcore.NewBuiltin("output", outputFn).BindReceiver(s), nil
 	}
 
 	if s.helpers == nil {
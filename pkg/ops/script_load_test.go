@@ -3,6 +3,7 @@ package ops
 import (
 	"testing"
 
+	"github.com/lab47/chell/pkg/evt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -90,4 +91,32 @@ func TestScriptLoad(t *testing.T) {
 
 		assert.Regexp(t, ".*-v1-2.7.7", pkg.ID())
 	})
+
+	t.Run("expands build system helpers into the work tree", func(t *testing.T) {
+		var (
+			load   ScriptLoad
+			lookup ScriptLookup
+		)
+
+		lookup.Path = []string{"./testdata/script_load"}
+
+		load.lookup = &lookup
+
+		pkg, err := load.Load("buildsys")
+		require.NoError(t, err)
+
+		assert.Equal(t, &evt.Statements{
+			Statements: []evt.EVTNode{
+				&evt.System{Arguments: []string{
+					"cmake", "-S", ".", "-B", "_build",
+					"-DCMAKE_INSTALL_PREFIX=" + evt.Prefix,
+					"-DCMAKE_INSTALL_LIBDIR=lib",
+					"-DCMAKE_BUILD_TYPE=Release",
+					"-DBUILD_TESTING=OFF",
+				}},
+				&evt.System{Arguments: []string{"cmake", "--build", "_build", "--parallel", evt.Jobs}},
+				&evt.System{Arguments: []string{"cmake", "--install", "_build"}},
+			},
+		}, pkg.cs.Work)
+	})
 }
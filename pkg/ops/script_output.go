@@ -0,0 +1,188 @@
+package ops
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/lab47/exprcore/exprcore"
+	"github.com/mr-tron/base58"
+	"golang.org/x/crypto/blake2b"
+)
+
+// MainOutput is the output every package has, which is installed at the
+// package's ID.
+const MainOutput = "out"
+
+func validOutputName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9':
+		case r == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Outputs returns the names of the outputs of the package, starting with
+// MainOutput.
+func (s *ScriptPackage) Outputs() []string {
+	if s.cs.Outputs == nil {
+		return []string{MainOutput}
+	}
+
+	return s.cs.Outputs
+}
+
+func (s *ScriptPackage) hasOutput(name string) bool {
+	return hasString(s.Outputs(), name)
+}
+
+func hasString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OutputID returns the store ID of the named output. Each output has it's
+// own hash, so that references to it can be told apart from references to
+// the other outputs when scanning for runtime deps.
+func (s *ScriptPackage) OutputID(name string) string {
+	if name == MainOutput {
+		return s.ID()
+	}
+
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte(s.sig))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+
+	return fmt.Sprintf("%s-%s-%s-%s", base58.Encode(h.Sum(nil)), s.name, s.cs.Version, name)
+}
+
+// OutputIDs returns the store IDs of all the outputs of the package.
+func (s *ScriptPackage) OutputIDs() []string {
+	var ids []string
+
+	for _, name := range s.Outputs() {
+		ids = append(ids, s.OutputID(name))
+	}
+
+	return ids
+}
+
+// ownsID returns true if id is the ID of one of the outputs of the package.
+func (s *ScriptPackage) ownsID(id string) bool {
+	return hasString(s.OutputIDs(), id)
+}
+
+// depOutputIDs returns the IDs of the outputs of dep that are used when
+// building the package, which are all of them unless the package
+// referenced specific ones via dep.output().
+func (s *ScriptPackage) depOutputIDs(dep *ScriptPackage) []string {
+	names, ok := s.cs.DependencyOutputs[dep.ID()]
+	if !ok {
+		return dep.OutputIDs()
+	}
+
+	var ids []string
+
+	for _, name := range names {
+		ids = append(ids, dep.OutputID(name))
+	}
+
+	return ids
+}
+
+func outputFn(thread *exprcore.Thread, b *exprcore.Builtin, args exprcore.Tuple, kwargs []exprcore.Tuple) (exprcore.Value, error) {
+	pkg, ok := b.Receiver().(*ScriptPackage)
+	if !ok {
+		return nil, fmt.Errorf("output called on %T", b.Receiver())
+	}
+
+	var name string
+
+	if err := exprcore.UnpackArgs(
+		"output", args, kwargs,
+		"name", &name,
+	); err != nil {
+		return nil, err
+	}
+
+	if !pkg.hasOutput(name) {
+		return nil, fmt.Errorf("%s has no output named %q", pkg.Name(), name)
+	}
+
+	return &ScriptOutput{pkg: pkg, name: name}, nil
+}
+
+// ScriptOutput is a single output of a package, as returned by
+// pkg.output(name). It can be used as a dependency in place of the
+// package to depend on only that output.
+type ScriptOutput struct {
+	pkg  *ScriptPackage
+	name string
+}
+
+func (s *ScriptOutput) ID() string {
+	return s.pkg.OutputID(s.name)
+}
+
+// String returns the string representation of the value.
+// exprcore string values are quoted as if by Python's repr.
+func (s *ScriptOutput) String() string {
+	return "<output " + s.name + ">"
+}
+
+// Type returns a short string describing the value's type.
+func (s *ScriptOutput) Type() string {
+	return "output"
+}
+
+// Freeze causes the value, and all values transitively
+// reachable from it through collections and closures, to be
+// marked as frozen.  All subsequent mutations to the data
+// structure through this API will fail dynamically, making the
+// data structure immutable and safe for publishing to other
+// exprcore interpreters running concurrently.
+func (s *ScriptOutput) Freeze() {
+}
+
+// Truth returns the truth value of an object.
+func (s *ScriptOutput) Truth() exprcore.Bool {
+	return exprcore.True
+}
+
+// Hash returns a function of x such that Equals(x, y) => Hash(x) == Hash(y).
+// Hash may fail if the value's type is not hashable, or if the value
+// contains a non-hashable value. The hash is used only by dictionaries and
+// is not exposed to the exprcore program.
+func (s *ScriptOutput) Hash() (uint32, error) {
+	return 0, fmt.Errorf("not hashable")
+}
+
+func (s *ScriptOutput) Attr(name string) (exprcore.Value, error) {
+	switch name {
+	case "prefix":
+		return exprcore.String(filepath.Join(s.pkg.loader.StoreDir, s.ID())), nil
+	case "name":
+		return exprcore.String(s.name), nil
+	}
+
+	return nil, nil
+}
+
+func (s *ScriptOutput) AttrNames() []string {
+	return []string{"name", "prefix"}
+}
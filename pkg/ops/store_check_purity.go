@@ -0,0 +1,138 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrImpure = errors.New("package output refers to paths outside the store")
+
+const (
+	// Log each impurity found but install the package anyway. The default.
+	ImpurityWarn = "warn"
+
+	// Fail the build if any impurities are found.
+	ImpurityFail = "fail"
+
+	// Don't check for impurities at all.
+	ImpurityIgnore = "ignore"
+)
+
+// Impurity is a reference in a package's output to a path that only exists
+// on the host that built it.
+type Impurity struct {
+	// Path of the file, relative to the package's store dir.
+	File string
+
+	Offset int64
+	Prefix string
+}
+
+func (i Impurity) String() string {
+	return fmt.Sprintf("%s at offset %d refers to %s", i.File, i.Offset, i.Prefix)
+}
+
+// StoreCheckPurity scans the files of an installed package for forbidden
+// path prefixes, such as the dir it was built in.
+type StoreCheckPurity struct {
+	storeDir  string
+	forbidden []string
+}
+
+// Check returns every occurance of a forbidden prefix in the files of id.
+func (s *StoreCheckPurity) Check(id string) ([]Impurity, error) {
+	root := storeBuildDir(s.storeDir, id)
+
+	var prefixes []string
+
+	for _, p := range s.forbidden {
+		p = filepath.Clean(p)
+
+		// Packages are allowed to refer to the store, even if it happens to
+		// live under a forbidden dir.
+		if p == "/" || strings.HasPrefix(s.storeDir+"/", p+"/") {
+			continue
+		}
+
+		prefixes = append(prefixes, p)
+	}
+
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	var impurities []Impurity
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(target, prefix+"/") {
+					impurities = append(impurities, Impurity{File: rel, Prefix: prefix})
+				}
+			}
+
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		var writers []io.Writer
+
+		for _, prefix := range prefixes {
+			prefix := prefix
+
+			dr := &depDetect{
+				file:   path,
+				prefix: []byte(prefix + "/"),
+				buf:    new(bytes.Buffer),
+				match: func(offset int64) {
+					impurities = append(impurities, Impurity{
+						File:   rel,
+						Offset: offset,
+						Prefix: prefix,
+					})
+				},
+			}
+
+			writers = append(writers, dr)
+		}
+
+		_, err = io.Copy(io.MultiWriter(writers...), f)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return impurities, nil
+}
@@ -0,0 +1,108 @@
+package ops
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreCheckPurity(t *testing.T) {
+	setup := func(t *testing.T) (string, string, func()) {
+		top, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		store := filepath.Join(top, "store")
+
+		require.NoError(t, os.MkdirAll(filepath.Join(store, "abc-test-1.0", "bin"), 0755))
+
+		return top, store, func() { os.RemoveAll(top) }
+	}
+
+	t.Run("reports the file and offset of forbidden prefixes", func(t *testing.T) {
+		top, store, cleanup := setup(t)
+		defer cleanup()
+
+		var buf bytes.Buffer
+		buf.WriteString("\x7fELF//tmp/chell-build")
+		buf.Write(make([]byte, 100000))
+		buf.WriteString("/tmp/chell-build123/src/foo.c\x00")
+
+		bin := filepath.Join(store, "abc-test-1.0", "bin", "test")
+
+		require.NoError(t, ioutil.WriteFile(bin, buf.Bytes(), 0755))
+
+		scp := StoreCheckPurity{
+			storeDir:  store,
+			forbidden: []string{"/tmp/chell-build123", filepath.Join(top, "home")},
+		}
+
+		impurities, err := scp.Check("abc-test-1.0")
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(impurities))
+
+		assert.Equal(t, "bin/test", impurities[0].File)
+		assert.Equal(t, int64(100021), impurities[0].Offset)
+		assert.Equal(t, "/tmp/chell-build123", impurities[0].Prefix)
+	})
+
+	t.Run("checks symlink targets", func(t *testing.T) {
+		top, store, cleanup := setup(t)
+		defer cleanup()
+
+		home := filepath.Join(top, "home")
+
+		require.NoError(t, os.Symlink(filepath.Join(home, "bin", "tool"), filepath.Join(store, "abc-test-1.0", "bin", "tool")))
+
+		scp := StoreCheckPurity{
+			storeDir:  store,
+			forbidden: []string{home},
+		}
+
+		impurities, err := scp.Check("abc-test-1.0")
+		require.NoError(t, err)
+
+		require.Equal(t, 1, len(impurities))
+
+		assert.Equal(t, "bin/tool", impurities[0].File)
+	})
+
+	t.Run("allows references to the store under a forbidden dir", func(t *testing.T) {
+		top, store, cleanup := setup(t)
+		defer cleanup()
+
+		bin := filepath.Join(store, "abc-test-1.0", "bin", "test")
+
+		require.NoError(t, ioutil.WriteFile(bin, []byte("#!"+store+"/abc-test-1.0/bin/sh\n"), 0755))
+
+		scp := StoreCheckPurity{
+			storeDir:  store,
+			forbidden: []string{top},
+		}
+
+		impurities, err := scp.Check("abc-test-1.0")
+		require.NoError(t, err)
+
+		assert.Empty(t, impurities)
+	})
+}
+
+func TestForbiddenPaths(t *testing.T) {
+	ienv := &InstallEnv{
+		BuildDir:      "/var/tmp/chell-build123",
+		ImpurityPaths: []string{"/home/user"},
+	}
+
+	forbidden := forbiddenPaths(ienv, map[string]string{"abc-test-1.0": "/store/.tmp-abc-test-1.0"})
+
+	assert.Contains(t, forbidden, "/var/tmp/chell-build123")
+	assert.Contains(t, forbidden, "/tmp")
+	assert.Contains(t, forbidden, filepath.Clean(os.TempDir()))
+	assert.Contains(t, forbidden, "/store/.tmp-abc-test-1.0")
+	assert.Contains(t, forbidden, "/home/user")
+}
@@ -0,0 +1,304 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// TreeDifference is a path that differs between two store dirs.
+type TreeDifference struct {
+	Path   string
+	Reason string
+
+	// Unified diff of the contents, only set for text files.
+	Diff string
+}
+
+func (t TreeDifference) String() string {
+	return fmt.Sprintf("%s: %s", t.Path, t.Reason)
+}
+
+// Files larger than this are compared without reading them into memory,
+// and without a diff.
+const maxDiffSize = 1024 * 1024
+
+// StoreDiff compares the contents of two dirs, such as two builds of the
+// same package.
+type StoreDiff struct {
+	// Paths relative to the dirs to skip.
+	ignore map[string]struct{}
+
+	// Replaced in the contents and symlinks of the second dir before
+	// comparing, such as when it was built in a different store dir. They
+	// must be the same length.
+	rewriteFrom string
+	rewriteTo   string
+}
+
+func (s *StoreDiff) walk(root string) (map[string]os.FileInfo, error) {
+	entries := make(map[string]os.FileInfo)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		if _, ok := s.ignore[rel]; ok {
+			return nil
+		}
+
+		entries[rel] = info
+		return nil
+	})
+
+	return entries, err
+}
+
+// Diff returns the differences between the trees a and b, sorted by path.
+func (s *StoreDiff) Diff(a, b string) ([]TreeDifference, error) {
+	aEntries, err := s.walk(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bEntries, err := s.walk(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []TreeDifference
+
+	for path, ai := range aEntries {
+		bi, ok := bEntries[path]
+		if !ok {
+			diffs = append(diffs, TreeDifference{Path: path, Reason: "only in " + a})
+			continue
+		}
+
+		diff, err := s.diffEntry(path, filepath.Join(a, path), ai, filepath.Join(b, path), bi)
+		if err != nil {
+			return nil, err
+		}
+
+		if diff != nil {
+			diffs = append(diffs, *diff)
+		}
+	}
+
+	for path := range bEntries {
+		if _, ok := aEntries[path]; !ok {
+			diffs = append(diffs, TreeDifference{Path: path, Reason: "only in " + b})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+
+	return diffs, nil
+}
+
+func (s *StoreDiff) diffEntry(rel, aPath string, ai os.FileInfo, bPath string, bi os.FileInfo) (*TreeDifference, error) {
+	if ai.Mode() != bi.Mode() {
+		return &TreeDifference{
+			Path:   rel,
+			Reason: fmt.Sprintf("mode %s != %s", ai.Mode(), bi.Mode()),
+		}, nil
+	}
+
+	if ai.Mode()&os.ModeSymlink != 0 {
+		at, err := os.Readlink(aPath)
+		if err != nil {
+			return nil, err
+		}
+
+		bt, err := os.Readlink(bPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.rewriteFrom != "" {
+			bt = strings.ReplaceAll(bt, s.rewriteFrom, s.rewriteTo)
+		}
+
+		if at != bt {
+			return &TreeDifference{
+				Path:   rel,
+				Reason: fmt.Sprintf("symlink target %s != %s", at, bt),
+			}, nil
+		}
+
+		return nil, nil
+	}
+
+	if !ai.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	if ai.Size() != bi.Size() && (ai.Size() > maxDiffSize || bi.Size() > maxDiffSize) {
+		return &TreeDifference{
+			Path:   rel,
+			Reason: fmt.Sprintf("size %d != %d", ai.Size(), bi.Size()),
+		}, nil
+	}
+
+	if ai.Size() > maxDiffSize {
+		same, err := s.sameContents(aPath, bPath)
+		if err != nil || same {
+			return nil, err
+		}
+
+		return &TreeDifference{Path: rel, Reason: "contents differ"}, nil
+	}
+
+	ad, err := ioutil.ReadFile(aPath)
+	if err != nil {
+		return nil, err
+	}
+
+	bd, err := ioutil.ReadFile(bPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.rewriteFrom != "" {
+		bd = bytes.ReplaceAll(bd, []byte(s.rewriteFrom), []byte(s.rewriteTo))
+	}
+
+	if bytes.Equal(ad, bd) {
+		return nil, nil
+	}
+
+	td := &TreeDifference{Path: rel, Reason: "contents differ"}
+
+	if isText(ad) && isText(bd) {
+		td.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(ad)),
+			B:        difflib.SplitLines(string(bd)),
+			FromFile: aPath,
+			ToFile:   bPath,
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return td, nil
+}
+
+func (s *StoreDiff) sameContents(a, b string) (bool, error) {
+	af, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+
+	defer af.Close()
+
+	bf, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+
+	defer bf.Close()
+
+	var br io.Reader = bf
+
+	if s.rewriteFrom != "" {
+		br = &rewriteReader{r: bf, from: []byte(s.rewriteFrom), to: []byte(s.rewriteTo)}
+	}
+
+	abuf := make([]byte, 32*1024)
+	bbuf := make([]byte, 32*1024)
+
+	for {
+		an, aerr := io.ReadFull(af, abuf)
+		bn, berr := io.ReadFull(br, bbuf)
+
+		if !bytes.Equal(abuf[:an], bbuf[:bn]) {
+			return false, nil
+		}
+
+		if aerr != nil || berr != nil {
+			if aerr == io.ErrUnexpectedEOF || aerr == io.EOF {
+				return berr == io.ErrUnexpectedEOF || berr == io.EOF, nil
+			}
+
+			if aerr != nil {
+				return false, aerr
+			}
+
+			return false, berr
+		}
+	}
+}
+
+// rewriteReader replaces from with to, which are the same length, in what's
+// read from r. The end of what's been read is held back until it's known
+// not to be the start of from.
+type rewriteReader struct {
+	r        io.Reader
+	from, to []byte
+
+	buf   []byte
+	ready int
+	err   error
+}
+
+func (rr *rewriteReader) Read(p []byte) (int, error) {
+	for rr.ready == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+
+		chunk := make([]byte, 32*1024)
+
+		n, err := rr.r.Read(chunk)
+
+		rr.buf = bytes.ReplaceAll(append(rr.buf, chunk[:n]...), rr.from, rr.to)
+		rr.err = err
+
+		rr.ready = len(rr.buf)
+		if err == nil {
+			rr.ready -= len(rr.from) - 1
+			if rr.ready < 0 {
+				rr.ready = 0
+			}
+		}
+	}
+
+	n := copy(p, rr.buf[:rr.ready])
+
+	rr.buf = rr.buf[n:]
+	rr.ready -= n
+
+	return n, nil
+}
+
+// isText returns true if data looks like it's text rather than binary.
+func isText(data []byte) bool {
+	check := data
+	if len(check) > 8000 {
+		check = check[:8000]
+	}
+
+	return bytes.IndexByte(check, 0) == -1 && utf8.Valid(data)
+}
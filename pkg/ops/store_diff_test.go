@@ -0,0 +1,165 @@
+package ops
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreDiff(t *testing.T) {
+	setup := func(t *testing.T) (string, string, func()) {
+		top, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		a := filepath.Join(top, "a")
+		b := filepath.Join(top, "b")
+
+		for _, dir := range []string{a, b} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "tool"), []byte("\x7fELF\x00\x01"), 0755))
+			require.NoError(t, os.Symlink("tool", filepath.Join(dir, "bin", "alias")))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pkgInfoFile), []byte(dir), 0644))
+		}
+
+		return a, b, func() { os.RemoveAll(top) }
+	}
+
+	t.Run("finds no differences in identical trees", func(t *testing.T) {
+		a, b, cleanup := setup(t)
+		defer cleanup()
+
+		sd := StoreDiff{ignore: map[string]struct{}{pkgInfoFile: {}}}
+
+		diffs, err := sd.Diff(a, b)
+		require.NoError(t, err)
+
+		assert.Empty(t, diffs)
+	})
+
+	t.Run("reports mode, symlink and content differences", func(t *testing.T) {
+		a, b, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, os.Chmod(filepath.Join(b, "bin", "tool"), 0644))
+
+		require.NoError(t, os.Remove(filepath.Join(b, "bin", "alias")))
+		require.NoError(t, os.Symlink("other", filepath.Join(b, "bin", "alias")))
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(a, "config"), []byte("one\ntwo\nthree\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(b, "config"), []byte("one\n2\nthree\n"), 0644))
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(b, "extra"), []byte("extra"), 0644))
+
+		sd := StoreDiff{ignore: map[string]struct{}{pkgInfoFile: {}}}
+
+		diffs, err := sd.Diff(a, b)
+		require.NoError(t, err)
+
+		require.Equal(t, 4, len(diffs))
+
+		assert.Equal(t, "bin/alias", diffs[0].Path)
+		assert.Contains(t, diffs[0].Reason, "symlink target tool != other")
+
+		assert.Equal(t, "bin/tool", diffs[1].Path)
+		assert.Contains(t, diffs[1].Reason, "mode")
+		assert.Equal(t, "", diffs[1].Diff)
+
+		assert.Equal(t, "config", diffs[2].Path)
+		assert.Contains(t, diffs[2].Diff, "-two\n+2\n")
+
+		assert.Equal(t, "extra", diffs[3].Path)
+		assert.Equal(t, "only in "+b, diffs[3].Reason)
+	})
+
+	t.Run("doesn't diff binary files", func(t *testing.T) {
+		a, b, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(b, "bin", "tool"), []byte("\x7fELF\x00\x02"), 0755))
+
+		var sd StoreDiff
+
+		diffs, err := sd.Diff(a, b)
+		require.NoError(t, err)
+
+		require.Equal(t, 2, len(diffs))
+
+		assert.Equal(t, pkgInfoFile, diffs[0].Path)
+
+		assert.Equal(t, "bin/tool", diffs[1].Path)
+		assert.Equal(t, "contents differ", diffs[1].Reason)
+		assert.Equal(t, "", diffs[1].Diff)
+	})
+	t.Run("swaps the store dir the second tree was built in", func(t *testing.T) {
+		a, b, cleanup := setup(t)
+		defer cleanup()
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(a, "config"), []byte("prefix=/store/x\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(b, "config"), []byte("prefix=/.tore/x\n"), 0644))
+
+		// Large enough to be compared in chunks, with the path across the
+		// end of the first.
+		big := bytes.Repeat([]byte{0}, maxDiffSize+1)
+
+		ab := append([]byte(nil), big...)
+		copy(ab[32*1024-3:], "/store/lib")
+		require.NoError(t, ioutil.WriteFile(filepath.Join(a, "bin", "big"), ab, 0755))
+
+		bb := append([]byte(nil), big...)
+		copy(bb[32*1024-3:], "/.tore/lib")
+		require.NoError(t, ioutil.WriteFile(filepath.Join(b, "bin", "big"), bb, 0755))
+
+		require.NoError(t, os.Symlink("/store/x/lib", filepath.Join(a, "lib")))
+		require.NoError(t, os.Symlink("/.tore/x/lib", filepath.Join(b, "lib")))
+
+		sd := StoreDiff{
+			ignore:      map[string]struct{}{pkgInfoFile: {}},
+			rewriteFrom: "/.tore",
+			rewriteTo:   "/store",
+		}
+
+		diffs, err := sd.Diff(a, b)
+		require.NoError(t, err)
+
+		assert.Empty(t, diffs)
+
+		sd.rewriteFrom = ""
+
+		diffs, err = sd.Diff(a, b)
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, len(diffs))
+	})
+}
+
+func TestCheckStoreDir(t *testing.T) {
+	top, err := ioutil.TempDir("", "chell")
+	require.NoError(t, err)
+
+	defer os.RemoveAll(top)
+
+	store := filepath.Join(top, "store")
+	require.NoError(t, os.Mkdir(store, 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(store, "abc-dep-1"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(store, "def-pkg-1"), 0755))
+
+	scratch, err := checkStoreDir(store)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(top, ".tore"), scratch)
+	assert.Equal(t, len(store), len(scratch))
+
+	require.NoError(t, linkStore(store, scratch, []string{"def-pkg-1"}))
+
+	target, err := os.Readlink(filepath.Join(scratch, "abc-dep-1"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(store, "abc-dep-1"), target)
+
+	_, err = os.Lstat(filepath.Join(scratch, "def-pkg-1"))
+	assert.True(t, os.IsNotExist(err))
+}
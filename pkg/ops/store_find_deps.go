@@ -5,18 +5,52 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type StoreFindDeps struct {
 	storeDir string
 }
 
-func (s *StoreFindDeps) PruneDeps(id string, deps []*ScriptPackage) ([]*ScriptPackage, error) {
+// FindRefs returns the store IDs out of candidates that the store dir of id
+// references, other than id itself.
+func (s *StoreFindDeps) FindRefs(id string, candidates []string) []string {
+	seen := s.scanRefs(id)
+
+	var refs []string
+
+	for _, cand := range candidates {
+		if cand == id {
+			continue
+		}
+
+		if _, ok := seen[idHash(cand)]; ok {
+			refs = append(refs, cand)
+		}
+	}
+
+	return refs
+}
+
+// idHash returns the hash part of a store ID.
+func idHash(id string) string {
+	if idx := strings.IndexByte(id, '-'); idx != -1 {
+		return id[:idx]
+	}
+
+	return id
+}
+
+// scanRefs returns the hashes of the store paths referenced by the files
+// in the store dir of id.
+func (s *StoreFindDeps) scanRefs(id string) map[string]struct{} {
 	seen := make(map[string]struct{})
 
 	var trbuf bytes.Buffer
 
-	filepath.Walk(filepath.Join(s.storeDir, id), func(path string, info os.FileInfo, err error) error {
+	root := storeBuildDir(s.storeDir, id)
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -43,13 +77,5 @@ func (s *StoreFindDeps) PruneDeps(id string, deps []*ScriptPackage) ([]*ScriptPa
 		return nil
 	})
 
-	var runtimeDeps []*ScriptPackage
-
-	for _, sp := range deps {
-		if _, ok := seen[sp.Signature()]; ok {
-			runtimeDeps = append(runtimeDeps, sp)
-		}
-	}
-
-	return runtimeDeps, nil
+	return seen
 }
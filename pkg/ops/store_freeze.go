@@ -10,8 +10,10 @@ type StoreFreeze struct {
 }
 
 func (s *StoreFreeze) Freeze(id string) error {
+	root := storeBuildDir(s.storeDir, id)
+
 	var dirs []string
-	err := filepath.Walk(filepath.Join(s.storeDir, id), func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			dirs = append(dirs, path)
 		}
@@ -0,0 +1,157 @@
+package ops
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StoreLock is held while a package is being installed into the store, so
+// that other processes installing the same package wait for it rather than
+// racing on the store dir.
+type StoreLock struct {
+	f *os.File
+}
+
+const storeLockPoll = 100 * time.Millisecond
+
+// lockStore acquires the lock for installing id into storeDir, waiting until
+// any other process holding it is done. waiting is called once if the lock
+// is held by someone else.
+func lockStore(ctx context.Context, storeDir, id string, waiting func()) (*StoreLock, error) {
+	f, err := os.OpenFile(filepath.Join(storeDir, ".lock-"+id), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &StoreLock{f: f}, nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrapf(err, "unable to lock store for %s", id)
+		}
+
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(storeLockPoll):
+		}
+	}
+}
+
+func (s *StoreLock) Unlock() error {
+	syscall.Flock(int(s.f.Fd()), syscall.LOCK_UN)
+	return s.f.Close()
+}
+
+// storeInstalled returns true if id has been completely installed into
+// storeDir. Packages that are still being built only have a symlink to their
+// temporary dir, which doesn't count.
+func storeInstalled(storeDir, id string) (bool, error) {
+	path := filepath.Join(storeDir, id)
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if fi.IsDir() {
+		return true, nil
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return false, nil
+	}
+
+	return false, errors.Wrapf(ErrCorruption, "store path not a dir: %s", path)
+}
+
+// storeTempDir returns the temporary sibling that id is installed into
+// before being renamed into place.
+func storeTempDir(storeDir, id string) string {
+	return filepath.Join(storeDir, ".tmp-"+id)
+}
+
+// storeBuildDir returns the dir that id's files are in, which is the
+// temporary dir that id's store dir is a symlink to while it's being built.
+func storeBuildDir(storeDir, id string) string {
+	root := filepath.Join(storeDir, id)
+	if rp, err := filepath.EvalSymlinks(root); err == nil {
+		root = rp
+	}
+
+	return root
+}
+
+// storeStartBuild creates the temporary dir that id is built into, with id's
+// store dir a symlink to it so the build sees the path the package will end
+// up at. It returns the temporary dir.
+func storeStartBuild(storeDir, id string) (string, error) {
+	tmpDir := storeTempDir(storeDir, id)
+	target := filepath.Join(storeDir, id)
+
+	// Cleanup after a previous build of this package that was interrupted.
+	err := removeFrozen(tmpDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to remove leftover build of %s", id)
+	}
+
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(target)
+	}
+
+	err = os.Mkdir(tmpDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Symlink(filepath.Base(tmpDir), target)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	return tmpDir, nil
+}
+
+// storeFinishBuild renames the temporary dir of id into place if the build
+// succeeded, otherwise it's removed.
+func storeFinishBuild(storeDir, id string, success bool) error {
+	tmpDir := storeTempDir(storeDir, id)
+
+	os.Remove(filepath.Join(storeDir, id))
+
+	if success {
+		err := os.Rename(tmpDir, filepath.Join(storeDir, id))
+		if err == nil {
+			return nil
+		}
+
+		removeFrozen(tmpDir)
+
+		return err
+	}
+
+	// It might have already been frozen if the tests failed.
+	removeFrozen(tmpDir)
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package ops
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreStartBuild(t *testing.T) {
+	t.Run("replaces a frozen dir left by an interrupted build", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "chell")
+		require.NoError(t, err)
+
+		defer removeFrozen(dir)
+
+		id := "abc-test-1.0"
+
+		left := filepath.Join(storeTempDir(dir, id), "lib")
+		require.NoError(t, os.MkdirAll(left, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(left, "libold.so"), []byte("old"), 0644))
+
+		// As it's left when interrupted after the output was frozen.
+		require.NoError(t, os.Symlink(filepath.Base(storeTempDir(dir, id)), filepath.Join(dir, id)))
+
+		var sf StoreFreeze
+		sf.storeDir = dir
+
+		require.NoError(t, sf.Freeze(id))
+
+		tmpDir, err := storeStartBuild(dir, id)
+		require.NoError(t, err)
+
+		entries, err := ioutil.ReadDir(tmpDir)
+		require.NoError(t, err)
+
+		assert.Empty(t, entries)
+
+		link, err := os.Readlink(filepath.Join(dir, id))
+		require.NoError(t, err)
+
+		assert.Equal(t, filepath.Base(tmpDir), link)
+	})
+}
@@ -26,6 +26,17 @@ func (s *StoreRuntimeDeps) Pack(ctx context.Context, pkg *ScriptPackage) error {
 		s.knownPackages = make(map[string]knownPackage)
 	}
 
+	for _, name := range pkg.Outputs() {
+		err := s.packOutput(pkg, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StoreRuntimeDeps) packOutput(pkg *ScriptPackage, output string) error {
 	var cp CarPack
 	cp.PrivateKey = s.priv
 	cp.PublicKey = s.pub
@@ -34,7 +45,7 @@ func (s *StoreRuntimeDeps) Pack(ctx context.Context, pkg *ScriptPackage) error {
 
 	var cinfo data.CarInfo
 
-	id := pkg.ID()
+	id := pkg.OutputID(output)
 
 	cinfo.ID = id
 	cinfo.Name = pkg.cs.Name
@@ -43,6 +54,10 @@ func (s *StoreRuntimeDeps) Pack(ctx context.Context, pkg *ScriptPackage) error {
 	cinfo.Signer = base58.Encode(s.pub)
 	cinfo.Constraints = pkg.Constraints()
 
+	if output != MainOutput {
+		cinfo.Output = output
+	}
+
 	dir := filepath.Join(s.storePath, id)
 
 	err := cp.Pack(&cinfo, dir, ioutil.Discard)
@@ -27,11 +27,25 @@ type StoreToCar struct {
 	knownPackages map[string]knownPackage
 }
 
+// Pack writes a car for each output of pkg, so that installing one output
+// doesn't require downloading the others. The runtime deps of each car are
+// detected from the references in that output alone.
 func (s *StoreToCar) Pack(ctx context.Context, pkg *ScriptPackage) error {
 	if s.knownPackages == nil {
 		s.knownPackages = make(map[string]knownPackage)
 	}
 
+	for _, name := range pkg.Outputs() {
+		err := s.packOutput(pkg, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StoreToCar) packOutput(pkg *ScriptPackage, output string) error {
 	var cp CarPack
 	cp.PrivateKey = s.priv
 	cp.PublicKey = s.pub
@@ -40,7 +54,7 @@ func (s *StoreToCar) Pack(ctx context.Context, pkg *ScriptPackage) error {
 
 	var cinfo data.CarInfo
 
-	id := pkg.ID()
+	id := pkg.OutputID(output)
 
 	cinfo.ID = id
 	cinfo.Name = pkg.cs.Name
@@ -49,6 +63,10 @@ func (s *StoreToCar) Pack(ctx context.Context, pkg *ScriptPackage) error {
 	cinfo.Signer = base58.Encode(s.pub)
 	cinfo.Constraints = pkg.Constraints()
 
+	if output != MainOutput {
+		cinfo.Output = output
+	}
+
 	dir := filepath.Join(s.storePath, id)
 
 	f, err := os.Create(filepath.Join(s.outputPath, id+".car"))
@@ -56,6 +74,8 @@ func (s *StoreToCar) Pack(ctx context.Context, pkg *ScriptPackage) error {
 		return err
 	}
 
+	defer f.Close()
+
 	err = cp.Pack(&cinfo, dir, f)
 	if err != nil {
 		return err
@@ -1,7 +1,13 @@
 package ops
 
-import "github.com/lab47/exprcore/exprcore"
-
+import (
+	"github.com/lab47/chell/pkg/hashdetect"
+	"github.com/lab47/exprcore/exprcore"
+)
+
+// DecodeSum returns the type and value of a sum given as a (type, value)
+// tuple or a string. A string is an SRI style sum such as sha256-<base64>,
+// or a fetch() hash of type self.
 func DecodeSum(sum exprcore.Value) (string, string, error) {
 	switch v := sum.(type) {
 	case exprcore.Tuple:
@@ -25,20 +31,12 @@ func DecodeSum(sum exprcore.Value) (string, string, error) {
 
 		return string(sumType), string(sumVal), nil
 	case exprcore.String:
+		if st, sv, ok := hashdetect.ParseSRI(string(v)); ok {
+			return st, sv, nil
+		}
+
 		return "self", string(v), nil
 	default:
 		return "", "", ErrSumFormat
 	}
 }
-
-func CompareEtag(a, b string) bool {
-	if a[0] == '"' {
-		a = a[1 : len(a)-2]
-	}
-
-	if b[0] == '"' {
-		b = b[1 : len(b)-2]
-	}
-
-	return a == b
-}
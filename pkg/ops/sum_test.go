@@ -0,0 +1,32 @@
+package ops
+
+import (
+	"testing"
+
+	"github.com/lab47/exprcore/exprcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSum(t *testing.T) {
+	st, sv, err := DecodeSum(exprcore.Tuple{exprcore.String("sha1"), exprcore.String("abcd")})
+	require.NoError(t, err)
+
+	assert.Equal(t, "sha1", st)
+	assert.Equal(t, "abcd", sv)
+
+	st, sv, err = DecodeSum(exprcore.String("sha512-AAAA=="))
+	require.NoError(t, err)
+
+	assert.Equal(t, "sha512", st)
+	assert.Equal(t, "AAAA==", sv)
+
+	st, sv, err = DecodeSum(exprcore.String("7Hs2mZ"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "self", st)
+	assert.Equal(t, "7Hs2mZ", sv)
+
+	_, _, err = DecodeSum(exprcore.Tuple{exprcore.String("sha256")})
+	assert.Error(t, err)
+}
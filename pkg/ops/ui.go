@@ -3,8 +3,10 @@ package ops
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/lab47/chell/pkg/config"
+	"github.com/lab47/chell/pkg/evt"
 	"github.com/mr-tron/base58"
 )
 
@@ -52,6 +54,41 @@ func (u *UI) ListDepedencies(pkgs []*ScriptPackage) {
 	}
 }
 
+func (u *UI) StatementStart(pkg *ScriptPackage, n evt.EVTNode) {
+	fmt.Printf("%s ▸ %s\n", pkg.Name(), evt.Describe(n))
+}
+
+func (u *UI) StatementFinish(pkg *ScriptPackage, n evt.EVTNode, dur time.Duration, exitStatus int, err error) {
+	dur = dur.Round(time.Millisecond)
+
+	if err != nil {
+		fmt.Printf("%s ✗ %s (%s, exit %d): %s\n", pkg.Name(), evt.Describe(n), dur, exitStatus, err)
+		return
+	}
+
+	fmt.Printf("%s ✓ %s (%s)\n", pkg.Name(), evt.Describe(n), dur)
+}
+
+func (u *UI) RunTests(pkg *ScriptPackage) {
+	fmt.Printf("Testing %s...\n", pkg.ID())
+}
+
+func (u *UI) KeptFailedBuild(pkg *ScriptPackage, dir string) {
+	fmt.Printf("Kept failed build of %s in %s\n", pkg.ID(), dir)
+}
+
+func (u *UI) FailureShell(pkg *ScriptPackage, se *evt.StatementError) {
+	fmt.Printf("Starting shell in %s where '%s' failed, exit to continue\n", se.Dir, evt.Describe(se.Statement))
+}
+
+func (u *UI) ImpureOutput(pkg *ScriptPackage, impurities []Impurity) {
+	fmt.Printf("%s refers to paths outside the store:\n", pkg.ID())
+
+	for _, imp := range impurities {
+		fmt.Printf("  %s\n", imp)
+	}
+}
+
 type uiMarker struct{}
 
 func GetUI(ctx context.Context) *UI {